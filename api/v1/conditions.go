@@ -0,0 +1,50 @@
+package v1
+
+// Condition types set on Requests, Entitlements and EntitlementBindings.
+const (
+	// ConditionReady is true when a request holds its license, an entitlement has grants to hand out, or a
+	// binding is honoured
+	ConditionReady = "Ready"
+	// ConditionOffered is true when capacity has been set aside for a request
+	ConditionOffered = "Offered"
+	// ConditionExpiring is true when a license of an entitlement expires soon
+	ConditionExpiring = "Expiring"
+	// ConditionDegraded is true when an entitlement can't serve every request made of it
+	ConditionDegraded = "Degraded"
+	// ConditionCompliant is true when no unit of an entitlement measured from the cluster is used more than
+	// licensed, and none is allocated beyond what is licensed
+	ConditionCompliant = "Compliant"
+)
+
+// Condition reasons.
+const (
+	ReasonDiscovering        = "Discovering"
+	ReasonQueued             = "Queued"
+	ReasonOffered            = "Offered"
+	ReasonAwaitingAck        = "AwaitingAcknowledgement"
+	ReasonAcknowledged       = "Acknowledged"
+	ReasonLeaseExpired       = "LeaseExpired"
+	ReasonOfferExpired       = "OfferExpired"
+	ReasonPreempted          = "Preempted"
+	ReasonGrantDeleted       = "GrantDeleted"
+	ReasonAllocationLost     = "AllocationLost"
+	ReasonGrantsAvailable    = "GrantsAvailable"
+	ReasonNoGrants           = "NoGrants"
+	ReasonLicenseExpiring    = "LicenseExpiring"
+	ReasonLicensesValid      = "LicensesValid"
+	ReasonRequestsWaiting    = "RequestsWaiting"
+	ReasonAllRequestsServed  = "AllRequestsServed"
+	ReasonWithinLicense      = "WithinLicense"
+	ReasonOverLicense        = "OverLicense"
+	ReasonScaleDenied        = "ScaleDenied"
+	ReasonReplicasUnlicensed = "ReplicasUnlicensed"
+	ReasonOverageStarted     = "OverageStarted"
+	ReasonOverageClosing     = "OverageWindowClosing"
+	ReasonOverageClosed      = "OverageWindowClosed"
+	ReasonConstraintsNotMet  = "ConstraintsNotMet"
+	ReasonBound              = "Bound"
+	ReasonBindingIgnored     = "BindingIgnored"
+	ReasonInvalidSelector    = "InvalidSelector"
+	ReasonBindingRemoved     = "BindingRemoved"
+	ReasonQuotaExceeded      = "QuotaExceeded"
+)
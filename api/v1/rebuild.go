@@ -0,0 +1,40 @@
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/retry"
+	"time"
+)
+
+// RebuildAnnotation on a namespace asks the operator to rebuild the entitlements in it.
+// Any new value triggers a rebuild; once done the operator copies the value to RebuiltAnnotation.
+const (
+	RebuildAnnotation = "licensing.cattle.io/rebuild"
+	RebuiltAnnotation = "licensing.cattle.io/rebuilt"
+)
+
+// RequestRebuild asks the operator to rebuild the entitlements of a namespace by annotating it, using the
+// given functions to read and write namespaces. Returns the value requested, which the operator copies to
+// RebuiltAnnotation once it is done.
+func RequestRebuild(get func(name string) (*corev1.Namespace, error),
+	update func(namespace *corev1.Namespace) (*corev1.Namespace, error), namespace string) (string, error) {
+	// a new value each time, so the operator knows this is a new request
+	requested := time.Now().UTC().Format(time.RFC3339Nano)
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ns, err := get(namespace)
+		if err != nil {
+			return err
+		}
+
+		ns = ns.DeepCopy()
+		if ns.Annotations == nil {
+			ns.Annotations = map[string]string{}
+		}
+		ns.Annotations[RebuildAnnotation] = requested
+		_, err = update(ns)
+		return err
+	})
+
+	return requested, err
+}
@@ -3,6 +3,7 @@ package v1
 import (
 	"github.com/ebauman/klicense/kubernetes"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 var (
@@ -13,26 +14,150 @@ var (
 	UsageRequestStatusDiscover     UsageRequestStatus = "Discover"
 	UsageRequestStatusOffer        UsageRequestStatus = "Offer"
 	UsageRequestStatusAcknowledged UsageRequestStatus = "Acknowledged"
+	// UsageRequestStatusExpired means the request's lease lapsed and its capacity was reclaimed
+	UsageRequestStatusExpired UsageRequestStatus = "Expired"
+
+	LicenseSourceSecret    LicenseSourceType = "Secret"
+	LicenseSourceConfigMap LicenseSourceType = "ConfigMap"
+	LicenseSourceDirectory LicenseSourceType = "Directory"
+	LicenseSourceHTTP      LicenseSourceType = "HTTP"
+
+	// OveragePhaseOpen means more than is licensed may be allocated
+	OveragePhaseOpen OveragePhase = "Open"
+	// OveragePhaseClosing means the overage window closes soon
+	OveragePhaseClosing OveragePhase = "Closing"
+	// OveragePhaseClosed means the overage window has closed, and nothing more is allocated beyond what is licensed
+	OveragePhaseClosed OveragePhase = "Closed"
 )
 
+type LicenseSourceType string
+
+// LicenseSource identifies where the license backing a grant was discovered.
+// Name is an object name for Secret and ConfigMap sources, a file path for
+// Directory sources and a URL for HTTP sources.
+type LicenseSource struct {
+	Type      LicenseSourceType `json:"type"`
+	Namespace string            `json:"namespace,omitempty"`
+	Name      string            `json:"name"`
+}
+
 type GrantStatus string
 
+type OveragePhase string
+
+// OveragePolicy allows a grant to be allocated Percent more than its amount, for up to Days after
+// the overage started. Zero Days never closes the window.
+type OveragePolicy struct {
+	Percent int `json:"percent" wrangler:"min=0"`
+	Days    int `json:"days,omitempty" wrangler:"min=0"`
+}
+
 type Grant struct {
 	Id            string                    `json:"id"`
-	Amount    int         `json:"amount"`
-	Unit      string      `json:"unit"`
-	NotBefore metav1.Time `json:"notBefore"`
+	Amount        int                       `json:"amount" wrangler:"min=0"`
+	Unit          string                    `json:"unit"`
+	NotBefore     metav1.Time               `json:"notBefore"`
 	NotAfter      metav1.Time               `json:"notAfter"`
 	LicenseSecret kubernetes.NamespacedName `json:"licenseSecret"`
-	Status        GrantStatus               `json:"grantStatus"`
-	Request       kubernetes.NamespacedName `json:"request"`
+	Source        LicenseSource             `json:"source"`
+	License       string                    `json:"license,omitempty"`
+	// OveragePolicy is the overage policy of the license, if it has one
+	OveragePolicy *OveragePolicy `json:"overagePolicy,omitempty"`
+	// Constraints are the CEL expressions of the license that must hold for a request to be offered the grant
+	Constraints []string    `json:"constraints,omitempty"`
+	Status      GrantStatus `json:"grantStatus"`
+	Allocated   int         `json:"allocated" wrangler:"min=0"`
+	Available   int         `json:"available" wrangler:"min=0"`
+	// Overage is how much more of the grant is allocated than its amount
+	Overage int `json:"overage,omitempty" wrangler:"min=0"`
+	// Request is the request a grant was allocated to whole, before allocations were recorded per request.
+	// Deprecated: it is only read to migrate such grants into Allocations, and cleared once it has been.
+	Request *kubernetes.NamespacedName `json:"request,omitempty"`
+}
+
+// RequestAllocation records the capacity of grants held by a single request.
+// Status is Pending while the request has been offered the capacity, and InUse once it acknowledges it.
+// RequestUID, Unit and Amount identify what the allocation was made for, so that it is reused rather
+// than made again if the same request is processed more than once.
+type RequestAllocation struct {
+	Request    kubernetes.NamespacedName `json:"request"`
+	RequestUID types.UID                 `json:"requestUID"`
+	Unit       string                    `json:"unit"`
+	Amount     int                       `json:"amount" wrangler:"min=1"`
+	Priority   int                       `json:"priority,omitempty"`
+	Status     GrantStatus               `json:"status"`
+	Grants     []Allocation              `json:"grants"`
+}
+
+// UnitUsage totals the capacity of all grants of a unit.
+type UnitUsage struct {
+	Amount    int `json:"amount"`
+	Used      int `json:"used"`
+	Available int `json:"available"`
+	// Overage is how much of Used is beyond what is licensed
+	Overage int `json:"overage,omitempty"`
+	// OverageAvailable is how much more may still be allocated beyond what is licensed, under the overage policy
+	OverageAvailable int `json:"overageAvailable,omitempty"`
+}
+
+// UnitOverage tracks a unit of an entitlement allocated beyond what its licenses grant, as their
+// overage policy allows.
+type UnitOverage struct {
+	// Amount is how much more is allocated than is licensed, zero if the unit is back within license
+	// while its window is open
+	Amount int `json:"amount"`
+	// Allowed is how much more than is licensed the overage policy allows
+	Allowed int `json:"allowed"`
+	// Since is when more than is licensed was first allocated
+	Since metav1.Time `json:"since"`
+	// Until is when the overage window closes, unset if it never does
+	Until *metav1.Time `json:"until,omitempty"`
+	Phase OveragePhase `json:"phase"`
+	// Reported is the phase last reported with an event
+	Reported OveragePhase `json:"reported,omitempty"`
+}
+
+// QueuedRequest is a request waiting for capacity to become available.
+type QueuedRequest struct {
+	Request    kubernetes.NamespacedName `json:"request"`
+	RequestUID types.UID                 `json:"requestUID"`
+	Unit       string                    `json:"unit"`
+	Amount     int                       `json:"amount"`
+	Priority   int                       `json:"priority,omitempty"`
+	Since      metav1.Time               `json:"since"`
+}
+
+// MeasuredUnit compares the usage of a unit measured from the cluster with what licenses grant of it.
+type MeasuredUnit struct {
+	// Measure is what the unit is measured as, e.g. nodes or cpu
+	Measure  string `json:"measure"`
+	Measured int    `json:"measured"`
+	Licensed int    `json:"licensed"`
+	// Overage is how much more is measured than is licensed
+	Overage int `json:"overage"`
+	// OverageSince is when more than is licensed was first measured, unset while within license
+	OverageSince *metav1.Time `json:"overageSince,omitempty"`
 }
 
 type EntitlementStatus struct {
 	Grants map[string]Grant `json:"grants"`
-	Licenses int `json:"licenses"`
-	Units string `json:"units"`
-	EarliestExpiration metav1.Time `json:"earliestExpiration"`
+	// Allocations are keyed by request name, or namespace/name for requests of other namespaces
+	Allocations map[string]RequestAllocation `json:"allocations,omitempty"`
+	Usage       map[string]UnitUsage         `json:"usage,omitempty"`
+	Used        string                       `json:"used"`
+	Available   string                       `json:"available"`
+	// Queue holds requests waiting for capacity, in the order they will be served
+	Queue              []QueuedRequest `json:"queue,omitempty"`
+	Waiting            int             `json:"waiting"`
+	Licenses           int             `json:"licenses"`
+	Units              string          `json:"units"`
+	EarliestExpiration metav1.Time     `json:"earliestExpiration"`
+	// Measured is keyed by unit, for units measured from the cluster rather than reported by requests
+	Measured map[string]MeasuredUnit `json:"measured,omitempty"`
+	// Overage is keyed by unit, for units allocated beyond what is licensed
+	Overage            map[string]UnitOverage `json:"overage,omitempty"`
+	ObservedGeneration int64                  `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition     `json:"conditions,omitempty"`
 }
 
 // +genclient
@@ -48,16 +173,56 @@ type Entitlement struct {
 type UsageRequestStatus string
 
 type RequestSpec struct {
-	Kind   string `json:"kind"`
-	Unit   string `json:"unit"`
-	Amount int    `json:"amount"`
+	Kind   string `json:"kind" wrangler:"required"`
+	Unit   string `json:"unit" wrangler:"required,minLength=1"`
+	Amount int    `json:"amount" wrangler:"required,min=1"`
+	// Priority orders requests competing for the same capacity, higher is served first.
+	// With preemption enabled a request may evict lower priority requests.
+	Priority int `json:"priority,omitempty"`
+	// LeaseDurationSeconds is how long an acknowledged request keeps its capacity without being renewed.
+	// Zero means the request holds its capacity until it is deleted.
+	LeaseDurationSeconds int `json:"leaseDurationSeconds,omitempty" wrangler:"min=0"`
+}
+
+// Allocation records a grant that contributes to satisfying a request, and how much of the request it covers.
+type Allocation struct {
+	Grant         string `json:"grant"`
+	Amount        int    `json:"amount" wrangler:"min=1"`
+	LicenseSecret string `json:"licenseSecret,omitempty"`
+	License       string `json:"license,omitempty"`
+	// Overage is how much of Amount is beyond what the grant licenses, allowed by its overage policy
+	Overage int `json:"overage,omitempty" wrangler:"min=0"`
+}
+
+// ConstraintFailure records a constraint of a grant that did not hold for a request, or could not be evaluated.
+type ConstraintFailure struct {
+	Grant      string `json:"grant"`
+	Expression string `json:"expression"`
+	// Error is set if the constraint could not be evaluated, rather than evaluating to false
+	Error string `json:"error,omitempty"`
 }
 
 type RequestStatus struct {
 	Status        UsageRequestStatus `json:"status"`
 	Grant         string             `json:"grant"`
 	LicenseSecret string             `json:"licenseSecret"`
-	Message       string             `json:"message"`
+	License       string             `json:"license,omitempty"`
+	Allocations   []Allocation       `json:"allocations,omitempty"`
+	// QueuePosition is the request's place in the queue for its unit while it waits for capacity, starting at 1
+	QueuePosition int `json:"queuePosition,omitempty" wrangler:"min=0"`
+	// OfferTime is when the request was last offered capacity
+	OfferTime *metav1.Time `json:"offerTime,omitempty"`
+	// RenewTime is when the client last renewed its lease on the capacity it holds
+	RenewTime *metav1.Time `json:"renewTime,omitempty"`
+	// ConstraintFailures are the constraints of grants of the request's unit that did not hold for it when it
+	// last looked for capacity
+	ConstraintFailures []ConstraintFailure `json:"constraintFailures,omitempty"`
+	// EntitlementNamespace is the namespace of the entitlement the request draws on, another namespace
+	// if an EntitlementBinding binds the request's namespace to it
+	EntitlementNamespace string             `json:"entitlementNamespace,omitempty"`
+	Message              string             `json:"message"`
+	ObservedGeneration   int64              `json:"observedGeneration,omitempty"`
+	Conditions           []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // +genclient
@@ -70,3 +235,68 @@ type Request struct {
 	Spec   RequestSpec   `json:"spec,omitempty"`
 	Status RequestStatus `json:"status,omitempty"`
 }
+
+// EntitlementBindingSpec chooses the entitlements of the binding's namespace to share, and the namespaces
+// that may draw on them.
+type EntitlementBindingSpec struct {
+	// Kinds are the entitlements shared, every entitlement of the namespace if empty
+	Kinds []string `json:"kinds,omitempty"`
+	// Namespaces are bound by name
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector binds namespaces by their labels, in addition to Namespaces
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+type EntitlementBindingStatus struct {
+	// Namespaces are the namespaces currently bound
+	Namespaces         []string           `json:"namespaces,omitempty"`
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// EntitlementBinding lets requests in other namespaces draw on the entitlements of its namespace, so
+// licenses can be installed once in a central namespace and shared with tenants. A request uses an
+// entitlement of its own namespace if there is one.
+type EntitlementBinding struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EntitlementBindingSpec   `json:"spec,omitempty"`
+	Status EntitlementBindingStatus `json:"status,omitempty"`
+}
+
+type LicenseQuotaSpec struct {
+	// Kind is the entitlement the quota applies to
+	Kind string `json:"kind" wrangler:"required"`
+	// Hard caps how much of each unit the requests the quota applies to may hold together, keyed by unit
+	Hard map[string]int `json:"hard"`
+	// Selector limits the quota to requests with matching labels, it applies to every request of its
+	// namespace if unset
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+type LicenseQuotaStatus struct {
+	// Hard is the quota last enforced, keyed by unit
+	Hard map[string]int `json:"hard,omitempty"`
+	// Used is how much of each unit the requests the quota applies to hold, keyed by unit
+	Used               map[string]int `json:"used,omitempty"`
+	ObservedGeneration int64          `json:"observedGeneration,omitempty"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// LicenseQuota caps how much of an entitlement the requests of its namespace, or those of them selected by
+// labels, may hold, so that one team can't use all of a license shared with others. A request that would
+// take its requests beyond the quota waits until they hold less. Lowering a quota doesn't take back what
+// is already held.
+type LicenseQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LicenseQuotaSpec   `json:"spec,omitempty"`
+	Status LicenseQuotaStatus `json:"status,omitempty"`
+}
@@ -11,9 +11,43 @@ All Rights Reserved
 package v1
 
 import (
+	kubernetes "github.com/ebauman/klicense/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Allocation) DeepCopyInto(out *Allocation) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Allocation.
+func (in *Allocation) DeepCopy() *Allocation {
+	if in == nil {
+		return nil
+	}
+	out := new(Allocation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConstraintFailure) DeepCopyInto(out *ConstraintFailure) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConstraintFailure.
+func (in *ConstraintFailure) DeepCopy() *ConstraintFailure {
+	if in == nil {
+		return nil
+	}
+	out := new(ConstraintFailure)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Entitlement) DeepCopyInto(out *Entitlement) {
 	*out = *in
@@ -41,6 +75,126 @@ func (in *Entitlement) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EntitlementBinding) DeepCopyInto(out *EntitlementBinding) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EntitlementBinding.
+func (in *EntitlementBinding) DeepCopy() *EntitlementBinding {
+	if in == nil {
+		return nil
+	}
+	out := new(EntitlementBinding)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *EntitlementBinding) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EntitlementBindingList) DeepCopyInto(out *EntitlementBindingList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]EntitlementBinding, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EntitlementBindingList.
+func (in *EntitlementBindingList) DeepCopy() *EntitlementBindingList {
+	if in == nil {
+		return nil
+	}
+	out := new(EntitlementBindingList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *EntitlementBindingList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EntitlementBindingSpec) DeepCopyInto(out *EntitlementBindingSpec) {
+	*out = *in
+	if in.Kinds != nil {
+		in, out := &in.Kinds, &out.Kinds
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EntitlementBindingSpec.
+func (in *EntitlementBindingSpec) DeepCopy() *EntitlementBindingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(EntitlementBindingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EntitlementBindingStatus) DeepCopyInto(out *EntitlementBindingStatus) {
+	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EntitlementBindingStatus.
+func (in *EntitlementBindingStatus) DeepCopy() *EntitlementBindingStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(EntitlementBindingStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *EntitlementList) DeepCopyInto(out *EntitlementList) {
 	*out = *in
@@ -84,7 +238,49 @@ func (in *EntitlementStatus) DeepCopyInto(out *EntitlementStatus) {
 			(*out)[key] = *val.DeepCopy()
 		}
 	}
+	if in.Allocations != nil {
+		in, out := &in.Allocations, &out.Allocations
+		*out = make(map[string]RequestAllocation, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.Usage != nil {
+		in, out := &in.Usage, &out.Usage
+		*out = make(map[string]UnitUsage, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Queue != nil {
+		in, out := &in.Queue, &out.Queue
+		*out = make([]QueuedRequest, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	in.EarliestExpiration.DeepCopyInto(&out.EarliestExpiration)
+	if in.Measured != nil {
+		in, out := &in.Measured, &out.Measured
+		*out = make(map[string]MeasuredUnit, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.Overage != nil {
+		in, out := &in.Overage, &out.Overage
+		*out = make(map[string]UnitOverage, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -104,7 +300,22 @@ func (in *Grant) DeepCopyInto(out *Grant) {
 	in.NotBefore.DeepCopyInto(&out.NotBefore)
 	in.NotAfter.DeepCopyInto(&out.NotAfter)
 	out.LicenseSecret = in.LicenseSecret
-	out.Request = in.Request
+	out.Source = in.Source
+	if in.OveragePolicy != nil {
+		in, out := &in.OveragePolicy, &out.OveragePolicy
+		*out = new(OveragePolicy)
+		**out = **in
+	}
+	if in.Constraints != nil {
+		in, out := &in.Constraints, &out.Constraints
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Request != nil {
+		in, out := &in.Request, &out.Request
+		*out = new(kubernetes.NamespacedName)
+		**out = **in
+	}
 	return
 }
 
@@ -118,13 +329,202 @@ func (in *Grant) DeepCopy() *Grant {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LicenseQuota) DeepCopyInto(out *LicenseQuota) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LicenseQuota.
+func (in *LicenseQuota) DeepCopy() *LicenseQuota {
+	if in == nil {
+		return nil
+	}
+	out := new(LicenseQuota)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *LicenseQuota) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LicenseQuotaList) DeepCopyInto(out *LicenseQuotaList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]LicenseQuota, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LicenseQuotaList.
+func (in *LicenseQuotaList) DeepCopy() *LicenseQuotaList {
+	if in == nil {
+		return nil
+	}
+	out := new(LicenseQuotaList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *LicenseQuotaList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LicenseQuotaSpec) DeepCopyInto(out *LicenseQuotaSpec) {
+	*out = *in
+	if in.Hard != nil {
+		in, out := &in.Hard, &out.Hard
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LicenseQuotaSpec.
+func (in *LicenseQuotaSpec) DeepCopy() *LicenseQuotaSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(LicenseQuotaSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LicenseQuotaStatus) DeepCopyInto(out *LicenseQuotaStatus) {
+	*out = *in
+	if in.Hard != nil {
+		in, out := &in.Hard, &out.Hard
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Used != nil {
+		in, out := &in.Used, &out.Used
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LicenseQuotaStatus.
+func (in *LicenseQuotaStatus) DeepCopy() *LicenseQuotaStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(LicenseQuotaStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LicenseSource) DeepCopyInto(out *LicenseSource) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LicenseSource.
+func (in *LicenseSource) DeepCopy() *LicenseSource {
+	if in == nil {
+		return nil
+	}
+	out := new(LicenseSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MeasuredUnit) DeepCopyInto(out *MeasuredUnit) {
+	*out = *in
+	if in.OverageSince != nil {
+		in, out := &in.OverageSince, &out.OverageSince
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MeasuredUnit.
+func (in *MeasuredUnit) DeepCopy() *MeasuredUnit {
+	if in == nil {
+		return nil
+	}
+	out := new(MeasuredUnit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OveragePolicy) DeepCopyInto(out *OveragePolicy) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OveragePolicy.
+func (in *OveragePolicy) DeepCopy() *OveragePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(OveragePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QueuedRequest) DeepCopyInto(out *QueuedRequest) {
+	*out = *in
+	out.Request = in.Request
+	in.Since.DeepCopyInto(&out.Since)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QueuedRequest.
+func (in *QueuedRequest) DeepCopy() *QueuedRequest {
+	if in == nil {
+		return nil
+	}
+	out := new(QueuedRequest)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Request) DeepCopyInto(out *Request) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -146,6 +546,28 @@ func (in *Request) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RequestAllocation) DeepCopyInto(out *RequestAllocation) {
+	*out = *in
+	out.Request = in.Request
+	if in.Grants != nil {
+		in, out := &in.Grants, &out.Grants
+		*out = make([]Allocation, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RequestAllocation.
+func (in *RequestAllocation) DeepCopy() *RequestAllocation {
+	if in == nil {
+		return nil
+	}
+	out := new(RequestAllocation)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RequestList) DeepCopyInto(out *RequestList) {
 	*out = *in
@@ -198,6 +620,31 @@ func (in *RequestSpec) DeepCopy() *RequestSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RequestStatus) DeepCopyInto(out *RequestStatus) {
 	*out = *in
+	if in.Allocations != nil {
+		in, out := &in.Allocations, &out.Allocations
+		*out = make([]Allocation, len(*in))
+		copy(*out, *in)
+	}
+	if in.OfferTime != nil {
+		in, out := &in.OfferTime, &out.OfferTime
+		*out = (*in).DeepCopy()
+	}
+	if in.RenewTime != nil {
+		in, out := &in.RenewTime, &out.RenewTime
+		*out = (*in).DeepCopy()
+	}
+	if in.ConstraintFailures != nil {
+		in, out := &in.ConstraintFailures, &out.ConstraintFailures
+		*out = make([]ConstraintFailure, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -210,3 +657,40 @@ func (in *RequestStatus) DeepCopy() *RequestStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UnitOverage) DeepCopyInto(out *UnitOverage) {
+	*out = *in
+	in.Since.DeepCopyInto(&out.Since)
+	if in.Until != nil {
+		in, out := &in.Until, &out.Until
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UnitOverage.
+func (in *UnitOverage) DeepCopy() *UnitOverage {
+	if in == nil {
+		return nil
+	}
+	out := new(UnitOverage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UnitUsage) DeepCopyInto(out *UnitUsage) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UnitUsage.
+func (in *UnitUsage) DeepCopy() *UnitUsage {
+	if in == nil {
+		return nil
+	}
+	out := new(UnitUsage)
+	in.DeepCopyInto(out)
+	return out
+}
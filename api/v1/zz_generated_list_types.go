@@ -46,3 +46,37 @@ func NewRequest(namespace, name string, obj Request) *Request {
 	obj.Namespace = namespace
 	return &obj
 }
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// EntitlementBindingList is a list of EntitlementBinding resources
+type EntitlementBindingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []EntitlementBinding `json:"items"`
+}
+
+func NewEntitlementBinding(namespace, name string, obj EntitlementBinding) *EntitlementBinding {
+	obj.APIVersion, obj.Kind = SchemeGroupVersion.WithKind("EntitlementBinding").ToAPIVersionAndKind()
+	obj.Name = name
+	obj.Namespace = namespace
+	return &obj
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// LicenseQuotaList is a list of LicenseQuota resources
+type LicenseQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []LicenseQuota `json:"items"`
+}
+
+func NewLicenseQuota(namespace, name string, obj LicenseQuota) *LicenseQuota {
+	obj.APIVersion, obj.Kind = SchemeGroupVersion.WithKind("LicenseQuota").ToAPIVersionAndKind()
+	obj.Name = name
+	obj.Namespace = namespace
+	return &obj
+}
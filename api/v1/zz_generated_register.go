@@ -17,8 +17,10 @@ import (
 )
 
 var (
-	EntitlementResourceName = "entitlements"
-	RequestResourceName     = "requests"
+	EntitlementResourceName        = "entitlements"
+	EntitlementBindingResourceName = "entitlementbindings"
+	LicenseQuotaResourceName       = "licensequotas"
+	RequestResourceName            = "requests"
 )
 
 // SchemeGroupVersion is group version used to register these objects
@@ -44,6 +46,10 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 	scheme.AddKnownTypes(SchemeGroupVersion,
 		&Entitlement{},
 		&EntitlementList{},
+		&EntitlementBinding{},
+		&EntitlementBindingList{},
+		&LicenseQuota{},
+		&LicenseQuotaList{},
 		&Request{},
 		&RequestList{},
 	)
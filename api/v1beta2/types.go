@@ -0,0 +1,73 @@
+package v1beta2
+
+import (
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LicensedGrant is capacity granted by a license, as projected from its source. Only the operator
+// writes grants; how much of a grant is in use is recorded separately in GrantAllocation.
+type LicensedGrant struct {
+	Id            string                    `json:"id"`
+	Amount        int                       `json:"amount" wrangler:"min=0"`
+	Unit          string                    `json:"unit"`
+	NotBefore     metav1.Time               `json:"notBefore"`
+	NotAfter      metav1.Time               `json:"notAfter"`
+	LicenseSecret kubernetes.NamespacedName `json:"licenseSecret"`
+	Source        v1.LicenseSource          `json:"source"`
+	License       string                    `json:"license,omitempty"`
+	// OveragePolicy is the overage policy of the license, if it has one
+	OveragePolicy *v1.OveragePolicy `json:"overagePolicy,omitempty"`
+	// Constraints are the CEL expressions of the license that must hold for a request to be offered the grant
+	Constraints []string `json:"constraints,omitempty"`
+}
+
+// GrantAllocation records how much of a grant has been allocated to requests.
+type GrantAllocation struct {
+	Status    v1.GrantStatus `json:"grantStatus"`
+	Allocated int            `json:"allocated" wrangler:"min=0"`
+	Available int            `json:"available" wrangler:"min=0"`
+	// Overage is how much more of the grant is allocated than its amount
+	Overage int `json:"overage,omitempty" wrangler:"min=0"`
+}
+
+type EntitlementSpec struct {
+	// Grants are keyed by grant id
+	Grants map[string]LicensedGrant `json:"grants,omitempty"`
+}
+
+type EntitlementStatus struct {
+	// Grants are keyed by grant id, the same as the grants in the spec
+	Grants map[string]GrantAllocation `json:"grants,omitempty"`
+	// Allocations are keyed by request name, or namespace/name for requests of other namespaces
+	Allocations map[string]v1.RequestAllocation `json:"allocations,omitempty"`
+	Usage       map[string]v1.UnitUsage         `json:"usage,omitempty"`
+	Used        string                          `json:"used"`
+	Available   string                          `json:"available"`
+	// Queue holds requests waiting for capacity, in the order they will be served
+	Queue              []v1.QueuedRequest `json:"queue,omitempty"`
+	Waiting            int                `json:"waiting"`
+	Licenses           int                `json:"licenses"`
+	Units              string             `json:"units"`
+	EarliestExpiration metav1.Time        `json:"earliestExpiration"`
+	// Measured is keyed by unit, for units measured from the cluster rather than reported by requests
+	Measured map[string]v1.MeasuredUnit `json:"measured,omitempty"`
+	// Overage is keyed by unit, for units allocated beyond what is licensed
+	Overage            map[string]v1.UnitOverage `json:"overage,omitempty"`
+	ObservedGeneration int64                     `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition         `json:"conditions,omitempty"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// Entitlement splits what licenses grant, in its spec, from what has been allocated, in its status,
+// so that grants can't be changed by anyone who can update status.
+type Entitlement struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EntitlementSpec   `json:"spec,omitempty"`
+	Status EntitlementStatus `json:"status,omitempty"`
+}
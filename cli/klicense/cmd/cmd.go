@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/ebauman/klicense/cli/klicense/cmd/entitlement"
 	"github.com/ebauman/klicense/cli/klicense/cmd/key"
 	"github.com/ebauman/klicense/cli/klicense/cmd/license"
 	"github.com/spf13/cobra"
@@ -11,6 +12,7 @@ import (
 func init() {
 	rootCmd.AddCommand(license.Cmd)
 	rootCmd.AddCommand(key.Cmd)
+	rootCmd.AddCommand(entitlement.Cmd)
 }
 
 var rootCmd = &cobra.Command {
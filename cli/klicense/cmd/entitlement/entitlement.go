@@ -0,0 +1,17 @@
+package entitlement
+
+import "github.com/spf13/cobra"
+
+var kubeconfig string
+var namespace string
+
+func init() {
+	Cmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "path to a kubeconfig, defaults to the usual kubeconfig locations")
+	Cmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "", "namespace, defaults to the namespace of the current context")
+}
+
+var Cmd = &cobra.Command {
+	Use: "entitlement",
+	Aliases: []string{"entitlements", "ent"},
+	Short: "operations on entitlements",
+}
@@ -0,0 +1,82 @@
+package entitlement
+
+import (
+	"context"
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	wranglerKubeconfig "github.com/rancher/wrangler/pkg/kubeconfig"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"time"
+)
+
+var waitForRebuild bool
+var timeout time.Duration
+
+func init() {
+	rebuildCmd.Flags().BoolVar(&waitForRebuild, "wait", true, "wait for the operator to finish the rebuild")
+	rebuildCmd.Flags().DurationVar(&timeout, "timeout", 2*time.Minute, "how long to wait for the rebuild")
+	Cmd.AddCommand(rebuildCmd)
+}
+
+var rebuildCmd = &cobra.Command{
+	Use: "rebuild",
+	Short: "rebuild the entitlements in a namespace from its licenses",
+	Long: "asks the operator to recreate the entitlements in a namespace from every license source, and restore the allocations of its requests",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		clientConfig := wranglerKubeconfig.GetNonInteractiveClientConfig(kubeconfig)
+
+		cfg, err := clientConfig.ClientConfig()
+		if err != nil {
+			return fmt.Errorf("error obtaining client config: %s", err.Error())
+		}
+
+		if namespace == "" {
+			if namespace, _, err = clientConfig.Namespace(); err != nil {
+				return fmt.Errorf("error obtaining namespace: %s", err.Error())
+			}
+		}
+
+		kube, err := clientset.NewForConfig(cfg)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		namespaces := kube.CoreV1().Namespaces()
+		requested, err := licensingv1.RequestRebuild(
+			func(name string) (*corev1.Namespace, error) {
+				return namespaces.Get(ctx, name, metav1.GetOptions{})
+			},
+			func(ns *corev1.Namespace) (*corev1.Namespace, error) {
+				return namespaces.Update(ctx, ns, metav1.UpdateOptions{})
+			},
+			namespace)
+		if err != nil {
+			return fmt.Errorf("error requesting rebuild: %s", err.Error())
+		}
+
+		if !waitForRebuild {
+			fmt.Printf("rebuild of namespace %s requested\n", namespace)
+			return nil
+		}
+
+		err = wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+			ns, err := kube.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+
+			return ns.Annotations[licensingv1.RebuiltAnnotation] == requested, nil
+		})
+		if err != nil {
+			return fmt.Errorf("error waiting for rebuild of namespace %s: %s", namespace, err.Error())
+		}
+
+		fmt.Printf("entitlements in namespace %s rebuilt\n", namespace)
+		return nil
+	},
+}
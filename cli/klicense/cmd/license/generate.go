@@ -16,6 +16,9 @@ func init() {
 	generateCmd.Flags().StringVar(&keyFilePath, "key", "", "key")
 	generateCmd.Flags().StringVar(&notBefore, "not-before", time.Now().Format("2006-01-02"), "license not valid before this date (yyyy-mm-dd)")
 	generateCmd.Flags().StringVar(&notAfter, "not-after", "", "license not valid after this date (yyyy-mm-dd)")
+	generateCmd.Flags().IntVar(&overagePercent, "overage-percent", 0, "percent of each grant that may be used above it for a limited time, 0 allows no overage")
+	generateCmd.Flags().IntVar(&overageDays, "overage-days", 0, "days overage may last before no more is allowed, 0 never closes the window")
+	generateCmd.Flags().StringArrayVar(&constraintSlice, "constraint", []string{}, "CEL expression over request, ns (its namespace) and cluster that must hold for capacity to be offered, e.g. ns.labels[\"env\"] == \"prod\"")
 
 	for _, v := range []string{"licensee", "grant", "key", "not-after"} {
 		_ = generateCmd.MarkFlagRequired(v)
@@ -41,6 +44,12 @@ var generateCmd = &cobra.Command {
 		if err := license2.FlagToNotBefore(notBefore, &license); err != nil {
 			return err
 		}
+		if err := license2.FlagsToOverage(overagePercent, overageDays, &license); err != nil {
+			return err
+		}
+		if err := license2.FlagsToConstraints(constraintSlice, &license); err != nil {
+			return err
+		}
 
 		key, err := cert.LoadKey(keyFilePath)
 		if err != nil {
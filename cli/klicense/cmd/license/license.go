@@ -17,6 +17,11 @@ var keyFilePath string
 var notBefore string
 var notAfter string
 
+var overagePercent int
+var overageDays int
+
+var constraintSlice []string
+
 var Cmd = &cobra.Command{
 	Use: "license",
 	Short: "operations on licenses",
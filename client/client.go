@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	klicensev1 "github.com/ebauman/klicense/api/v1"
 	"github.com/ebauman/klicense/client/controllers"
@@ -15,17 +16,31 @@ import (
 	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
 	"os"
+	"time"
 )
 
 type LicenseStatus string
 
 type LicenseClient struct {
+	ctx           context.Context
 	requestClient v1.RequestClient
+	kube          clientset.Interface
 	namespace     string
-	notifiers     map[string]chan<- bool
+	notifiers     *controllers.Notifiers
+	priority      int
+	leaseDuration time.Duration
+	ownerLevel    OwnerLevel
 }
 
+// DefaultLeaseDuration is how long a license is held without being renewed, unless changed with WithLeaseDuration.
+// It is zero, so licenses are held until their requests are deleted, as they were before leases. Clients opt in
+// to leases with WithLeaseDuration; the client then renews them while it runs, so the operator only reclaims
+// licenses of clients that have gone away.
+var DefaultLeaseDuration time.Duration
+
 const licenseUsedAnnotation string = "licensing.cattle.io/used-by"
 const licenseAmountAnnotation string = "licensing.cattle.io/used-amount"
 
@@ -49,15 +64,24 @@ func NewLicenseClient(kubeconfig string) (*LicenseClient, error) {
 		return nil, err
 	}
 
+	kube, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	ns, _, err := clientConfig.Namespace()
 	if err != nil {
 		return nil, fmt.Errorf("error attempting to obtain namespace of running workload")
 	}
 
 	l := &LicenseClient{
+		ctx:           ctx,
 		requestClient: licensingFactory.Licensing().V1().Request(),
-		notifiers:     make(map[string]chan<- bool),
+		kube:          kube,
+		ownerLevel:    OwnerPod,
+		notifiers:     controllers.NewNotifiers(),
 		namespace:     ns,
+		leaseDuration: DefaultLeaseDuration,
 	}
 
 	controllers.Register(
@@ -75,6 +99,30 @@ func NewLicenseClient(kubeconfig string) (*LicenseClient, error) {
 	return l, nil
 }
 
+// WithPriority sets the priority of requests made by this client. When capacity is short, higher
+// priority requests are served first, and may preempt lower priority ones if the operator allows it.
+func (l *LicenseClient) WithPriority(priority int) *LicenseClient {
+	l.priority = priority
+	return l
+}
+
+// WithLeaseDuration sets how long licenses granted to this client are held without being renewed.
+// A zero duration holds licenses until their requests are deleted. Leases are renewed every third of
+// the duration, so a client that stalls for longer than the duration loses its licenses; a minute or
+// more leaves room for pauses and api server throttling.
+func (l *LicenseClient) WithLeaseDuration(duration time.Duration) *LicenseClient {
+	l.leaseDuration = duration
+	return l
+}
+
+// WithOwner sets which object requests made by this client are owned by. Deleting the owner deletes the
+// requests, releasing their licenses. Defaults to OwnerPod, which needs the pod name from the downward API
+// in the POD_NAME environment variable, and permission to get pods (and replicasets for OwnerWorkload).
+func (l *LicenseClient) WithOwner(level OwnerLevel) *LicenseClient {
+	l.ownerLevel = level
+	return l
+}
+
 // License submits a request for licensing of the calling code application.
 // A particular entitlement is identified by kind and unit.
 // A request will be created with these properties as well as the amount.
@@ -88,7 +136,7 @@ func (l *LicenseClient) License(kind string, unit string, amount int, applicatio
 
 	notify := make(chan bool, 1)
 
-	l.notifiers[string(req.UID)] = notify
+	l.notifiers.Register(string(req.UID), notify)
 
 	for {
 		status := <-notify
@@ -102,6 +150,8 @@ func (l *LicenseClient) License(kind string, unit string, amount int, applicatio
 // Arguments are the same as License, with the exception of notify.
 // Upon successful licensure, notify will emit a bool:true value.
 // If the software becomes unlicensed, notify will emit a bool:false value.
+// Notifications are sent without blocking, so notify should be buffered and read promptly; one that
+// arrives while notify is full is dropped.
 func (l *LicenseClient) LicenseAsync(kind string, unit string, amount int, notify chan<- bool, applicationIdentifier string) {
 	req := l.setupLicense(kind, unit, amount, applicationIdentifier)
 	if req == nil {
@@ -109,7 +159,7 @@ func (l *LicenseClient) LicenseAsync(kind string, unit string, amount int, notif
 		return
 	}
 
-	l.notifiers[string(req.UID)] = notify
+	l.notifiers.Register(string(req.UID), notify)
 }
 
 // Standalone looks for a license in the application's namespace that fulfills the kind, unit and amount parameters.
@@ -150,25 +200,27 @@ func Standalone(kubeconfig string, kind string, unit string, amount int, applica
 			}
 		}
 
-		license, err := license2.ValidateSecret(&s)
+		licenses, err := license2.ValidateSecret(&s)
 		if err != nil {
 			continue
 		}
 
-		for grantName, grantAmount := range license.Grants {
-			if grantName == fmt.Sprintf("%s/%s", kind, unit) {
-				if grantAmount >= amount {
-					// this license satisfies
-					// annotate that the license is in use
-					sCopy := s.DeepCopy()
-					sCopy.Annotations[licenseUsedAnnotation] = applicationIdentifier
-					sCopy.Annotations[licenseAmountAnnotation] = string(rune(amount))
-					sCopy, err := wrangler.Core().V1().Secret().Update(sCopy)
-					if err != nil {
-						return false, fmt.Errorf("error reserving license for use: %s", err.Error())
+		for _, license := range licenses {
+			for grantName, grantAmount := range license.Grants {
+				if grantName == fmt.Sprintf("%s/%s", kind, unit) {
+					if grantAmount >= amount {
+						// this license satisfies
+						// annotate that the license is in use
+						sCopy := s.DeepCopy()
+						sCopy.Annotations[licenseUsedAnnotation] = applicationIdentifier
+						sCopy.Annotations[licenseAmountAnnotation] = string(rune(amount))
+						sCopy, err := wrangler.Core().V1().Secret().Update(sCopy)
+						if err != nil {
+							return false, fmt.Errorf("error reserving license for use: %s", err.Error())
+						}
+
+						return true, nil
 					}
-
-					return true, nil
 				}
 			}
 		}
@@ -189,6 +241,29 @@ func (l *LicenseClient) setupLicense(kind string, unit string, amount int, appli
 
 	// first, see if there is an existing request
 	req, err := l.requestClient.Get(l.namespace, applicationIdentifier, metav1.GetOptions{})
+	if err == nil && (req.Spec.Kind != kind || req.Spec.Unit != unit) {
+		// kind and unit can't be changed, so a request for something else has to start over
+		err = l.requestClient.Delete(l.namespace, applicationIdentifier, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			logrus.Errorf("error deleting request in kubernetes: %s", err.Error())
+			return nil
+		}
+
+		// the operator holds on to the request until it has released what it holds
+		err = wait.PollImmediate(time.Second, time.Minute, func() (bool, error) {
+			_, err := l.requestClient.Get(l.namespace, applicationIdentifier, metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				return true, nil
+			}
+			return false, err
+		})
+		if err != nil {
+			logrus.Errorf("error waiting for request to be deleted in kubernetes: %s", err.Error())
+			return nil
+		}
+		err = errors.NewNotFound(klicensev1.Resource("requests"), applicationIdentifier)
+	}
+
 	create := false
 	if errors.IsNotFound(err) {
 		create = true
@@ -203,9 +278,18 @@ func (l *LicenseClient) setupLicense(kind string, unit string, amount int, appli
 	req.Spec.Kind = kind
 	req.Spec.Unit = unit
 	req.Spec.Amount = amount
+	req.Spec.Priority = l.priority
+	req.Spec.LeaseDurationSeconds = int(l.leaseDuration.Seconds())
 	req.Name = applicationIdentifier
 	req.Namespace = l.namespace
 
+	owner, err := ownerReference(l.ctx, l.kube, l.ownerLevel, l.namespace)
+	if err != nil {
+		// an unowned request still works, it just has to be cleaned up by hand
+		logrus.Warnf("error finding owner for request: %s", err.Error())
+	}
+	setOwner(&req.ObjectMeta, owner)
+
 	if create {
 		req, err = l.requestClient.Create(req)
 		if err != nil {
@@ -220,6 +304,7 @@ func (l *LicenseClient) setupLicense(kind string, unit string, amount int, appli
 	}
 
 	req.Status.Status = klicensev1.UsageRequestStatusDiscover
+	req.Status.RenewTime = nil
 
 	req, err = l.requestClient.UpdateStatus(req)
 	if err != nil {
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+// Notifiers tells whoever asked for a license whether their request is licensed. It is shared by the
+// workers of the request controller and the LicenseClient, which registers requests from the caller's
+// goroutine, so it is only used through its lock.
+type Notifiers struct {
+	lock      sync.Mutex
+	notifiers map[string]chan<- bool
+	// licensed tracks which requests we have told are licensed, keyed by request UID
+	licensed map[string]bool
+}
+
+func NewNotifiers() *Notifiers {
+	return &Notifiers{
+		notifiers: map[string]chan<- bool{},
+		licensed:  map[string]bool{},
+	}
+}
+
+// Register has notify told whether the request with the given UID is licensed. The request may have been
+// licensed before it was registered, in which case notify is told straight away.
+func (n *Notifiers) Register(uid string, notify chan<- bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.notifiers[uid] = notify
+	if n.licensed[uid] {
+		send(notify, true)
+	}
+}
+
+// owns returns true if the request was made by this client, i.e. someone is waiting to hear about it.
+func (n *Notifiers) owns(uid string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	_, ok := n.notifiers[uid]
+	return ok
+}
+
+// set records whether a request is licensed, and tells its requester if that changed.
+// Returns true if it changed.
+func (n *Notifiers) set(uid string, licensed bool) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.licensed[uid] == licensed {
+		return false
+	}
+
+	n.licensed[uid] = licensed
+	if notify, ok := n.notifiers[uid]; ok {
+		send(notify, licensed)
+	}
+
+	return true
+}
+
+// remove tells the requester of a deleted request that it is no longer licensed, and forgets about it.
+// Returns false if nobody was waiting to hear about the request.
+func (n *Notifiers) remove(uid string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	notify, ok := n.notifiers[uid]
+	if !ok {
+		return false
+	}
+
+	send(notify, false)
+	delete(n.notifiers, uid)
+	delete(n.licensed, uid)
+	return true
+}
+
+// send never blocks, so a requester that stopped listening, e.g. License once it has returned, can't
+// hold up the worker. A requester that isn't ready misses the notification.
+func send(notify chan<- bool, licensed bool) {
+	select {
+	case notify <- licensed:
+	default:
+		logrus.Debugf("requester is not listening, dropped notification licensed=%t", licensed)
+	}
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotifiersNeverBlock(t *testing.T) {
+	n := NewNotifiers()
+	notify := make(chan bool, 1)
+	n.Register("uid", notify)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// nobody reads notify, as with License once it has returned
+		n.set("uid", true)
+		n.set("uid", false)
+		n.set("uid", true)
+		n.remove("uid")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifying a requester that isn't listening blocked")
+	}
+
+	if licensed := <-notify; !licensed {
+		t.Error("expected the first notification to be kept")
+	}
+}
+
+func TestNotifiersTellOnlyChanges(t *testing.T) {
+	n := NewNotifiers()
+	notify := make(chan bool, 10)
+	n.Register("uid", notify)
+
+	for _, licensed := range []bool{false, true, true, false, false} {
+		n.set("uid", licensed)
+	}
+	close(notify)
+
+	var told []bool
+	for licensed := range notify {
+		told = append(told, licensed)
+	}
+	if len(told) != 2 || !told[0] || told[1] {
+		t.Errorf("expected to be told licensed then unlicensed, got %v", told)
+	}
+}
+
+func TestNotifiersCatchUpOnRegister(t *testing.T) {
+	n := NewNotifiers()
+
+	// the offer may be acknowledged before the requester registers
+	n.set("uid", true)
+
+	notify := make(chan bool, 1)
+	n.Register("uid", notify)
+
+	select {
+	case licensed := <-notify:
+		if !licensed {
+			t.Error("expected to be told licensed")
+		}
+	default:
+		t.Error("requester registering after the request was licensed wasn't told")
+	}
+}
+
+func TestNotifiersConcurrentUse(t *testing.T) {
+	n := NewNotifiers()
+
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 1000; j++ {
+				n.set("uid", j%2 == 0)
+				n.owns("uid")
+			}
+			done <- struct{}{}
+		}()
+	}
+	for j := 0; j < 1000; j++ {
+		n.Register("uid", make(chan bool, 1))
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
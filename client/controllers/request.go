@@ -9,6 +9,7 @@ import (
 	license2 "github.com/ebauman/klicense/license"
 	v14 "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
 	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"time"
 )
 
@@ -16,11 +17,12 @@ func Register(ctx context.Context,
 	requestClient v1.RequestClient,
 	namespace string,
 	secretCache v14.SecretCache,
-	notifiers map[string]chan<- bool,
+	notifiers *Notifiers,
 	requestController v13.RequestController) {
 
 	handler := RequestHandler{
 		requestClient:    requestClient,
+		enqueueAfter:     requestController.EnqueueAfter,
 		namespace:        namespace,
 		secretCache:      secretCache,
 		notifiers:        notifiers,
@@ -31,18 +33,23 @@ func Register(ctx context.Context,
 
 type RequestHandler struct {
 	requestClient v1.RequestClient
+	enqueueAfter func(namespace string, name string, duration time.Duration)
 	namespace string
 	secretCache v14.SecretCache
-	notifiers map[string]chan<- bool
+	notifiers *Notifiers
 }
 
 func (r *RequestHandler) OnRequestChanged(key string, request *licensingv1.Request) (*licensingv1.Request, error) {
+	if request == nil {
+		return nil, nil
+	}
+
 	if !request.DeletionTimestamp.IsZero() {
 		// this request has been deleted, either by us or by another user
 		// find the corresponding requester and notify of unlicensed status
-		if notify, ok := r.notifiers[string(request.UID)]; ok {
-			notify <- false
-		}
+		// the operator's finalizer keeps the request around until its license is released,
+		// so we may see it more than once. only tell the requester the first time
+		r.notifiers.remove(string(request.UID))
 
 		// nothing else to do
 		return nil, nil
@@ -52,68 +59,185 @@ func (r *RequestHandler) OnRequestChanged(key string, request *licensingv1.Reque
 	case licensingv1.UsageRequestStatusDiscover:
 		// this is the initial creation of the request
 		// there is curently nothing for us to do, because Discover status
-		// means that the request is awaiting fulfillment from the operator
+		// means that the request is awaiting fulfillment from the operator.
+		// if we were licensed before, the operator has taken the license back
+		// (e.g. preempted by a higher priority request), so tell someone
+		if r.notifiers.set(string(request.UID), false) {
+			logrus.Warnf("license for request %s/%s revoked: %s", request.Namespace, request.Name, request.Status.Message)
+		}
 		return nil, nil
 	case licensingv1.UsageRequestStatusOffer:
-		// if there is an offer, we need to verify the license
-		// let's get the secret that the license is int
-		cachedSecret, err := r.secretCache.Get(r.namespace, request.Status.LicenseSecret)
-		secret := cachedSecret.DeepCopy()
-		if err != nil {
-			logrus.Errorf("error retrieving secret for license: %s", err.Error())
-			return nil, err
+		// if there is an offer, we need to verify the license(s)
+		// the operator may combine several grants to satisfy the request
+		total := 0
+		for _, allocation := range offeredAllocations(request) {
+			license, err := r.offeredLicense(allocation)
+			if err != nil {
+				logrus.Errorf("error validating license for grant: %s", err.Error())
+				return nil, err
+			}
+
+			// if we have gotten here, the license is valid
+			// now just check start/end times and amounts
+			if license.NotAfter.Before(time.Now()) || license.NotBefore.After(time.Now()) {
+				logrus.Errorf("license %s expired or not yet valid", license.Id)
+				return nil, nil
+			}
+
+			grantName := fmt.Sprintf("%s/%s", request.Spec.Kind, request.Spec.Unit)
+			amount, ok := license.Grants[grantName]
+			if !ok {
+				logrus.Errorf("could not locate grant in license %s with name %s", license.Id, grantName)
+				return nil, nil
+			}
+
+			if amount < allocation.Amount {
+				logrus.Errorf("amount allocated from license %s is higher than its grant", license.Id)
+				return nil, nil
+			}
+
+			total += allocation.Amount
 		}
 
-		// once we have the secret, pull out the license
-		license, err := license2.ValidateSecret(secret)
+		if total < request.Spec.Amount {
+			// requesting too much
+			logrus.Error("amount requested is higher than offered grants")
+			return nil, nil
+		}
+
+		// at this point, we have licenses with the grant requested, in the amount requested (at least)
+		// that aren't expired or not yet valid. we can acknowledge and accept them!
+		// acknowledging starts the lease on what we were offered
+		request = request.DeepCopy()
+		request.Status.Status = licensingv1.UsageRequestStatusAcknowledged
+		now := metav1.Now()
+		request.Status.RenewTime = &now
+
+		_, err := r.requestClient.UpdateStatus(request)
 		if err != nil {
-			logrus.Errorf("error validating license for grant: %s", err.Error())
+			logrus.Errorf("error updating status of request object in kubernetes: %s", err.Error())
 			return nil, err
 		}
 
-		// if we have gotten here, the license is valid
-		// now just check start/end times and amounts
-		if license.NotAfter.Before(time.Now()) || license.NotBefore.After(time.Now()) {
-			logrus.Errorf("license expired or not yet valid")
-			return nil, err
+		r.notifiers.set(string(request.UID), true)
+
+		if interval, ok := renewInterval(request); ok {
+			r.enqueueAfter(request.Namespace, request.Name, interval)
+		}
+
+		return nil, nil
+
+	case licensingv1.UsageRequestStatusAcknowledged:
+		// the license is ours, tell someone!
+		r.notifiers.set(string(request.UID), true)
+
+		return nil, r.renewLease(request)
+
+	case licensingv1.UsageRequestStatusExpired:
+		// the operator reclaimed our capacity because our lease lapsed
+		if !r.notifiers.owns(string(request.UID)) {
+			// not ours, whoever made it has gone away
+			return nil, nil
 		}
 
-		grantName := fmt.Sprintf("%s/%s", request.Spec.Kind, request.Spec.Unit)
-		amount, ok := license.Grants[grantName]
-		if !ok {
-			logrus.Errorf("could not locate grant in license with name %s", grantName)
+		if r.notifiers.set(string(request.UID), false) {
+			logrus.Warnf("lease of request %s/%s expired: %s", request.Namespace, request.Name, request.Status.Message)
 		}
 
-		if amount < request.Spec.Amount {
-			// requesting too much
-			logrus.Error("amount requested is higher than offered grant")
+		// we are still here, so ask again
+		request = request.DeepCopy()
+		request.Status.Status = licensingv1.UsageRequestStatusDiscover
+		request.Status.RenewTime = nil
+		if _, err := r.requestClient.UpdateStatus(request); err != nil {
+			logrus.Errorf("error updating status of request object in kubernetes: %s", err.Error())
 			return nil, err
 		}
 
-		// at this point, we have a license with the grant requested, in the amount requested (at least)
-		// that isn't expired or not yet valid. we can acknowledge and accept it!
-		request.Status.Status = licensingv1.UsageRequestStatusAcknowledged
+		return nil, nil
+	}
 
-		_, err = r.requestClient.UpdateStatus(request)
+	return nil, nil
+}
+
+// offeredAllocations returns the allocations offered to a request. Offers made before
+// allocations were recorded only carry a single grant.
+func offeredAllocations(request *licensingv1.Request) []licensingv1.Allocation {
+	if len(request.Status.Allocations) > 0 {
+		return request.Status.Allocations
+	}
+
+	return []licensingv1.Allocation{{
+		Grant:         request.Status.Grant,
+		Amount:        request.Spec.Amount,
+		LicenseSecret: request.Status.LicenseSecret,
+		License:       request.Status.License,
+	}}
+}
+
+// offeredLicense verifies the license offered in an allocation. The operator copies the signed license
+// into the request, which works for licenses from any source. Offers without it fall back to
+// reading the license secret.
+func (r *RequestHandler) offeredLicense(allocation licensingv1.Allocation) (*license2.License, error) {
+	if allocation.License != "" {
+		license, err := license2.Validate([]byte(allocation.License))
 		if err != nil {
-			logrus.Errorf("error updating status of request object in kubernetes: %s", err.Error())
 			return nil, err
 		}
 
-		if notify, ok := r.notifiers[string(request.UID)]; ok {
-			notify <- true
+		if license.Id != allocation.Grant {
+			return nil, fmt.Errorf("offered license %s does not match grant %s", license.Id, allocation.Grant)
 		}
 
-		return nil, nil
+		return license, nil
+	}
 
-	case licensingv1.UsageRequestStatusAcknowledged:
-		// the license is ours, tell someone!
-		if notify, ok := r.notifiers[string(request.UID)]; ok {
-			notify <- true
+	// let's get the secret that the license is in
+	secret, err := r.secretCache.Get(r.namespace, allocation.LicenseSecret)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving secret for license: %s", err.Error())
+	}
+
+	// once we have the secret, pull out the license that was offered
+	return license2.FindInSecret(secret, allocation.Grant)
+}
+
+// renewInterval returns how often the lease of a request is renewed. ok is false if the request has no lease.
+// Leases are renewed well before they lapse, so a missed renewal or two doesn't lose the license.
+func renewInterval(request *licensingv1.Request) (time.Duration, bool) {
+	if request.Spec.LeaseDurationSeconds <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(request.Spec.LeaseDurationSeconds) * time.Second / 3, true
+}
+
+// renewLease renews the lease of a request made by this client once it is due,
+// and schedules the next renewal. Requests made by other clients are left to them.
+func (r *RequestHandler) renewLease(request *licensingv1.Request) error {
+	interval, ok := renewInterval(request)
+	if !ok {
+		return nil
+	}
+
+	if !r.notifiers.owns(string(request.UID)) {
+		return nil
+	}
+
+	if request.Status.RenewTime != nil {
+		if due := request.Status.RenewTime.Add(interval); time.Now().Before(due) {
+			r.enqueueAfter(request.Namespace, request.Name, time.Until(due))
+			return nil
 		}
+	}
 
-		return nil, nil
+	request = request.DeepCopy()
+	now := metav1.Now()
+	request.Status.RenewTime = &now
+	if _, err := r.requestClient.UpdateStatus(request); err != nil {
+		logrus.Errorf("error renewing lease of request %s/%s: %s", request.Namespace, request.Name, err.Error())
+		return err
 	}
 
-	return nil, nil
-}
\ No newline at end of file
+	r.enqueueAfter(request.Namespace, request.Name, interval)
+	return nil
+}
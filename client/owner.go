@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"os"
+)
+
+// Environment variables the client reads its own pod from. Set them with the downward API:
+//
+//	env:
+//	- name: POD_NAME
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: metadata.name
+//	- name: POD_NAMESPACE
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: metadata.namespace
+const (
+	PodNameEnv      = "POD_NAME"
+	PodNamespaceEnv = "POD_NAMESPACE"
+)
+
+// OwnerLevel decides which object a request is owned by, and so what deleting releases its license.
+type OwnerLevel string
+
+const (
+	// OwnerNone leaves requests unowned, they have to be deleted by hand
+	OwnerNone OwnerLevel = "none"
+	// OwnerPod has requests deleted along with the pod that made them
+	OwnerPod OwnerLevel = "pod"
+	// OwnerWorkload has requests deleted along with the workload that runs the pod, e.g. a Deployment
+	// or StatefulSet, so licenses outlive pods being replaced
+	OwnerWorkload OwnerLevel = "workload"
+)
+
+// ownerReference finds the object that requests made from this pod are owned by.
+// Returns nil if there is none, e.g. because the client isn't running in a pod.
+func ownerReference(ctx context.Context, kube clientset.Interface, level OwnerLevel, namespace string) (*metav1.OwnerReference, error) {
+	if level == OwnerNone || kube == nil {
+		return nil, nil
+	}
+
+	podName := os.Getenv(PodNameEnv)
+	if podName == "" {
+		logrus.Debugf("%s not set, requests will not be owned by a pod", PodNameEnv)
+		return nil, nil
+	}
+
+	if podNamespace := os.Getenv(PodNamespaceEnv); podNamespace != "" && podNamespace != namespace {
+		// owner references can't cross namespaces
+		logrus.Warnf("pod namespace %s differs from request namespace %s, requests will not be owned by the pod",
+			podNamespace, namespace)
+		return nil, nil
+	}
+
+	pod, err := kube.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving pod %s/%s: %s", namespace, podName, err.Error())
+	}
+
+	owner := &metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       pod.Name,
+		UID:        pod.UID,
+	}
+
+	if level != OwnerWorkload {
+		return owner, nil
+	}
+
+	// walk up the controllers of the pod, e.g. pod -> replicaset -> deployment
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		return owner, nil
+	}
+
+	if controller.Kind == "ReplicaSet" {
+		rs, err := kube.AppsV1().ReplicaSets(namespace).Get(ctx, controller.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving replicaset %s/%s: %s", namespace, controller.Name, err.Error())
+		}
+
+		if deployment := metav1.GetControllerOf(rs); deployment != nil {
+			controller = deployment
+		}
+	}
+
+	return &metav1.OwnerReference{
+		APIVersion: controller.APIVersion,
+		Kind:       controller.Kind,
+		Name:       controller.Name,
+		UID:        controller.UID,
+	}, nil
+}
+
+// setOwner adds owner to the owner references of an object, if it isn't there already.
+func setOwner(meta *metav1.ObjectMeta, owner *metav1.OwnerReference) {
+	if owner == nil {
+		return
+	}
+
+	for _, ref := range meta.OwnerReferences {
+		if ref.UID == owner.UID {
+			return
+		}
+	}
+
+	meta.OwnerReferences = append(meta.OwnerReferences, *owner)
+}
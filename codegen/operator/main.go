@@ -2,6 +2,7 @@ package main
 
 import (
 	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/api/v1beta2"
 	controllergen "github.com/rancher/wrangler/pkg/controller-gen"
 	"github.com/rancher/wrangler/pkg/controller-gen/args"
 	corev1 "k8s.io/api/core/v1"
@@ -19,6 +20,9 @@ func main() {
 				Types: []interface{}{
 					v1.Entitlement{},
 					v1.Request{},
+					v1.EntitlementBinding{},
+					v1.LicenseQuota{},
+					v1beta2.Entitlement{},
 				},
 				GenerateTypes: true,
 			},
@@ -0,0 +1,29 @@
+package license
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ValidateConfigMap reads every license out of a configmap, from both its data and binary data.
+// Data keys are selected the same way as for secrets, see ValidateSecret.
+func ValidateConfigMap(configMap *corev1.ConfigMap) ([]*License, error) {
+	data := make(map[string][]byte, len(configMap.Data)+len(configMap.BinaryData))
+	for k, v := range configMap.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range configMap.BinaryData {
+		data[k] = v
+	}
+
+	return ValidateData(configMap.Annotations, data)
+}
+
+// FindInConfigMap returns the license with the given id from a configmap.
+func FindInConfigMap(configMap *corev1.ConfigMap, id string) (*License, error) {
+	licenses, err := ValidateConfigMap(configMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return Find(licenses, id)
+}
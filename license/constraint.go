@@ -0,0 +1,101 @@
+package license
+
+import (
+	"fmt"
+	"github.com/google/cel-go/cel"
+	"sync"
+)
+
+// Constraints are CEL expressions carried in a license that must all evaluate to true for a request to
+// be offered capacity from it. They can refer to:
+//
+//   - request: name, namespace, kind, unit, amount, priority, labels and annotations of the request
+//   - ns: name, labels and annotations of the request's namespace, and requests, the number of other
+//     requests in it holding capacity of the same entitlement (namespace is reserved in CEL)
+//   - cluster: nodes, the number of nodes, and cpu and memory, their allocatable cpu in cores and memory in GiB
+//
+// e.g. `ns.labels["env"] == "prod"` or `ns.requests < 3`. Looking up a missing label is an error, which
+// doesn't hold either; `"env" in ns.labels` tests for one.
+var constraintVariables = []string{"request", "ns", "cluster"}
+
+var (
+	constraintEnv     *cel.Env
+	constraintEnvErr  error
+	constraintEnvOnce sync.Once
+
+	// compiled programs are kept, as the same constraints are evaluated for every request
+	constraintPrograms sync.Map
+)
+
+func env() (*cel.Env, error) {
+	constraintEnvOnce.Do(func() {
+		var options []cel.EnvOption
+		for _, v := range constraintVariables {
+			options = append(options, cel.Variable(v, cel.MapType(cel.StringType, cel.DynType)))
+		}
+		constraintEnv, constraintEnvErr = cel.NewEnv(options...)
+	})
+
+	return constraintEnv, constraintEnvErr
+}
+
+// CompileConstraint checks a constraint expression and returns a program evaluating it.
+func CompileConstraint(expression string) (cel.Program, error) {
+	if program, ok := constraintPrograms.Load(expression); ok {
+		return program.(cel.Program), nil
+	}
+
+	e, err := env()
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := e.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid constraint %q: %v", expression, issues.Err())
+	}
+
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		return nil, fmt.Errorf("invalid constraint %q: must evaluate to a bool, not %s", expression, t)
+	}
+
+	program, err := e.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid constraint %q: %v", expression, err)
+	}
+
+	constraintPrograms.Store(expression, program)
+	return program, nil
+}
+
+// EvaluateConstraint evaluates a constraint expression against the given variables, returning whether it holds.
+func EvaluateConstraint(expression string, variables map[string]interface{}) (bool, error) {
+	program, err := CompileConstraint(expression)
+	if err != nil {
+		return false, err
+	}
+
+	out, _, err := program.Eval(variables)
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("evaluated to %v, not a bool", out.Value())
+	}
+
+	return result, nil
+}
+
+// FlagsToConstraints checks constraint expressions and adds them to a license.
+func FlagsToConstraints(flags []string, license *License) error {
+	for _, expression := range flags {
+		if _, err := CompileConstraint(expression); err != nil {
+			return err
+		}
+		license.Constraints = append(license.Constraints, expression)
+	}
+
+	return nil
+}
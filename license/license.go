@@ -22,6 +22,9 @@ const (
 	entitlementName = `(([a-zA-Z]{1})|([a-zA-Z]{1}[a-zA-Z]{1})|([a-zA-Z]{1}[0-9]{1})|([0-9]{1}[a-zA-Z]{1})|([a-zA-Z0-9][a-zA-Z0-9-_]{1,61}[a-zA-Z0-9]))\.([a-zA-Z]{2,6}|[a-zA-Z0-9-]{2,30}\.[a-zA-Z]{2,3})`
 )
 
+// EntitlementNamePattern matches the kind of an entitlement, e.g. my.app.domain
+const EntitlementNamePattern = entitlementName
+
 var GrantStringRegexp *regexp.Regexp
 var EntitlementNameRegexp *regexp.Regexp
 
@@ -37,6 +40,36 @@ type License struct {
 	Grants    map[string]int    `json:"grants"`
 	NotBefore time.Time         `json:"notBefore"`
 	NotAfter  time.Time         `json:"notAfter"`
+	// Overage, if set, allows using more than the license grants for a limited time
+	Overage *Overage `json:"overage,omitempty"`
+	// Constraints are CEL expressions that must all hold for a request to be offered capacity from the license
+	Constraints []string `json:"constraints,omitempty"`
+
+	// Raw is the signed license this License was decoded from
+	Raw string `json:"-"`
+}
+
+// Overage allows each grant of a license to be exceeded by Percent of its amount. The overage is
+// reported rather than blocked until Days after it started; zero Days never closes the window.
+type Overage struct {
+	Percent int `json:"percent"`
+	Days    int `json:"days,omitempty"`
+}
+
+// FlagsToOverage sets the overage policy of a license, or leaves it unset if percent is zero.
+func FlagsToOverage(percent int, days int, license *License) error {
+	if percent < 0 || days < 0 {
+		return fmt.Errorf("overage percent and days can't be negative")
+	}
+	if percent == 0 {
+		if days != 0 {
+			return fmt.Errorf("overage days need an overage percent")
+		}
+		return nil
+	}
+
+	license.Overage = &Overage{Percent: percent, Days: days}
+	return nil
 }
 
 var publicKeys = make([]*rsa.PublicKey, 0)
@@ -64,6 +97,9 @@ func Validate(licenseBytes []byte) (*License, error) {
 	}
 
 	licenseSlice := strings.Split(string(licenseBytes), ".")
+	if len(licenseSlice) != 2 {
+		return nil, fmt.Errorf("invalid license")
+	}
 	// first part of the slice is the json content
 	// second part is the sign of the hash
 	hash := sha256.New()
@@ -102,6 +138,8 @@ func Validate(licenseBytes []byte) (*License, error) {
 		return nil, fmt.Errorf("invalid license")
 	}
 
+	license.Raw = string(licenseBytes)
+
 	return &license, nil
 }
 
@@ -1,15 +1,145 @@
 package license
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"path"
+	"sort"
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
 )
 
-func ValidateSecret(secret *corev1.Secret) (*License, error) {
-	licenseData, ok := secret.Data["license"]
-	if !ok {
-		return nil, fmt.Errorf("secret does not contain license field")
+// DataKeysAnnotation can be set on a license secret to override which data keys are read.
+// Its value is a comma-separated list of keys, each of which may be a glob pattern (e.g. "license-*").
+const DataKeysAnnotation = "licensing.cattle.io/license-keys"
+
+// DefaultDataKeys are the data keys read from a license secret that does not carry the DataKeysAnnotation.
+// The operator overrides this from its --license-keys flag.
+var DefaultDataKeys = []string{"license"}
+
+// DataKeys returns the data key patterns that should be read from the given secret.
+func DataKeys(secret *corev1.Secret) []string {
+	return dataKeys(secret.Annotations)
+}
+
+func dataKeys(annotations map[string]string) []string {
+	if value, ok := annotations[DataKeysAnnotation]; ok {
+		if keys := SplitKeys(value); len(keys) > 0 {
+			return keys
+		}
+	}
+
+	return DefaultDataKeys
+}
+
+// SplitKeys splits a comma-separated list of data key patterns, dropping empty entries.
+func SplitKeys(value string) []string {
+	var keys []string
+	for _, k := range strings.Split(value, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// ValidateSecret reads every license out of a secret. Each data key matching DataKeys may hold
+// a single license or a newline-delimited bundle of licenses.
+// Licenses that fail validation are skipped; an error is only returned if no valid license was found.
+func ValidateSecret(secret *corev1.Secret) ([]*License, error) {
+	return ValidateData(secret.Annotations, secret.Data)
+}
+
+// ValidateData reads every license out of the data of a secret or configmap, using annotations to
+// determine which data keys to read. See ValidateSecret.
+func ValidateData(annotations map[string]string, data map[string][]byte) ([]*License, error) {
+	patterns := dataKeys(annotations)
+
+	var keys []string
+	for k := range data {
+		if matchesAny(patterns, k) {
+			keys = append(keys, k)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no license field matching %s", strings.Join(patterns, ","))
+	}
+
+	// sort so that the order of licenses is stable between calls
+	sort.Strings(keys)
+
+	var licenses []*License
+	var invalid []string
+	for _, k := range keys {
+		for i, entry := range SplitBundle(data[k]) {
+			license, err := Validate(entry)
+			if err != nil {
+				invalid = append(invalid, fmt.Sprintf("%s[%d]", k, i))
+				continue
+			}
+
+			licenses = append(licenses, license)
+		}
+	}
+
+	if len(licenses) == 0 {
+		return nil, fmt.Errorf("no valid license found (invalid entries: %s)", strings.Join(invalid, ","))
+	}
+
+	return licenses, nil
+}
+
+// FindInSecret returns the license with the given id from a secret.
+func FindInSecret(secret *corev1.Secret, id string) (*License, error) {
+	licenses, err := ValidateSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return Find(licenses, id)
+}
+
+// Find returns the license with the given id.
+func Find(licenses []*License, id string) (*License, error) {
+	for _, l := range licenses {
+		if l.Id == id {
+			return l, nil
+		}
+	}
+
+	return nil, fmt.Errorf("license %s not found", id)
+}
+
+// SplitBundle splits data containing one or more newline-delimited licenses into individual entries.
+func SplitBundle(data []byte) [][]byte {
+	var entries [][]byte
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		entry := make([]byte, len(line))
+		copy(entry, line)
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if ok, err := path.Match(p, key); err == nil && ok {
+			return true
+		}
 	}
 
-	return Validate(licenseData)
+	return false
 }
@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"fmt"
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	"sort"
+	"strings"
+	"time"
+)
+
+// selectGrants picks grants of the request's unit whose remaining capacity together satisfies the request,
+// using the entitlement's allocation strategy. If what is licensed isn't enough, it falls back to what
+// the overage policy allows. Returns nil if the request can't be satisfied.
+func selectGrants(entitlement *v1.Entitlement, request *v1.Request) []v1.Allocation {
+	var candidates []v1.Grant
+	for _, grant := range entitlement.Status.Grants {
+		if grant.Unit != request.Spec.Unit {
+			continue
+		}
+
+		if grant.Available <= 0 {
+			continue
+		}
+
+		candidates = append(candidates, grant)
+	}
+
+	if allocations := strategyFor(entitlement).Select(candidates, request.Spec.Amount); allocations != nil {
+		return allocations
+	}
+
+	return selectOverage(entitlement, request, time.Now())
+}
+
+func allocationFor(grant v1.Grant, amount int) v1.Allocation {
+	return v1.Allocation{
+		Grant:         grant.Id,
+		Amount:        amount,
+		LicenseSecret: grant.LicenseSecret.Name,
+		License:       grant.License,
+	}
+}
+
+// allocate records that the request holds the given allocations, replacing anything it held before.
+func allocate(entitlement *v1.Entitlement, request *v1.Request, status v1.GrantStatus, allocations []v1.Allocation) {
+	if entitlement.Status.Allocations == nil {
+		entitlement.Status.Allocations = map[string]v1.RequestAllocation{}
+	}
+
+	// the entitlement only needs to know how much of which grant is held,
+	// the licenses themselves are already on the grants
+	grants := make([]v1.Allocation, 0, len(allocations))
+	for _, a := range allocations {
+		grants = append(grants, v1.Allocation{
+			Grant:   a.Grant,
+			Amount:  a.Amount,
+			Overage: a.Overage,
+		})
+	}
+
+	entitlement.Status.Allocations[allocationKey(entitlement, requestName(request))] = v1.RequestAllocation{
+		Request:    requestName(request),
+		RequestUID: request.UID,
+		Unit:       request.Spec.Unit,
+		Amount:     request.Spec.Amount,
+		Priority:   request.Spec.Priority,
+		Status:     status,
+		Grants:     grants,
+	}
+
+	// a request holding capacity is no longer waiting for it
+	leaveQueue(entitlement, requestName(request))
+	recalculate(entitlement)
+}
+
+// existingAllocation returns the allocations already recorded for the request, if they were made for
+// the same request and spec and every grant they draw on still exists. This makes allocation idempotent:
+// a request processed again, e.g. because writing its offer failed, is offered the same capacity.
+func existingAllocation(entitlement *v1.Entitlement, request *v1.Request) []v1.Allocation {
+	ra, ok := heldAllocation(entitlement, request)
+	if !ok {
+		return nil
+	}
+
+	if !heldBy(ra, request) || ra.Unit != request.Spec.Unit || ra.Amount != request.Spec.Amount {
+		return nil
+	}
+
+	return heldAllocations(entitlement, ra)
+}
+
+// heldBy returns true if the allocation record was made for the request. Records migrated from grants
+// allocated before allocations were recorded per request don't know the uid of their request, and are
+// taken to be held by the request of their name.
+func heldBy(ra v1.RequestAllocation, request *v1.Request) bool {
+	return ra.RequestUID == request.UID || ra.RequestUID == ""
+}
+
+// MigrateGrantRequests records grants allocated whole to a request, as they were before allocations were
+// recorded per request, as allocations of that request, so that what they hold isn't freed by being
+// recalculated from the allocation records. Returns true if any grant was migrated.
+func MigrateGrantRequests(entitlement *v1.Entitlement) bool {
+	migrated := false
+	for id, grant := range entitlement.Status.Grants {
+		if grant.Request == nil {
+			continue
+		}
+
+		request := *grant.Request
+		grant.Request = nil
+		migrated = true
+
+		held := grant.Status == v1.GrantStatusPending || grant.Status == v1.GrantStatusInUse
+		if request.Name == "" || !held || grant.Amount <= 0 {
+			entitlement.Status.Grants[id] = grant
+			continue
+		}
+
+		if entitlement.Status.Allocations == nil {
+			entitlement.Status.Allocations = map[string]v1.RequestAllocation{}
+		}
+
+		key := allocationKey(entitlement, request)
+		if _, ok := entitlement.Status.Allocations[key]; !ok {
+			entitlement.Status.Allocations[key] = v1.RequestAllocation{
+				Request: request,
+				Unit:    grant.Unit,
+				Amount:  grant.Amount,
+				Status:  grant.Status,
+				Grants:  []v1.Allocation{{Grant: id, Amount: grant.Amount}},
+			}
+			grant.Allocated, grant.Available = grant.Amount, 0
+		}
+
+		entitlement.Status.Grants[id] = grant
+	}
+
+	return migrated
+}
+
+// releaseGrants returns all capacity held by the request to its grants. Returns true if anything was released.
+func releaseGrants(entitlement *v1.Entitlement, request kubernetes.NamespacedName) bool {
+	key := allocationKey(entitlement, request)
+	if _, ok := entitlement.Status.Allocations[key]; !ok {
+		return false
+	}
+
+	delete(entitlement.Status.Allocations, key)
+	recalculate(entitlement)
+
+	return true
+}
+
+// recalculate derives the allocated and available capacity of each grant, and the entitlement's
+// usage totals and overage, from the allocation records.
+func recalculate(entitlement *v1.Entitlement) {
+	allocated := map[string]int{}
+	pending := map[string]bool{}
+	for _, ra := range entitlement.Status.Allocations {
+		for _, a := range ra.Grants {
+			allocated[a.Grant] += a.Amount
+			if ra.Status == v1.GrantStatusPending {
+				pending[a.Grant] = true
+			}
+		}
+	}
+
+	usage := map[string]v1.UnitUsage{}
+	allowed := map[string]int{}
+	for id, grant := range entitlement.Status.Grants {
+		grant.Allocated = allocated[id]
+		grant.Available = grant.Amount - grant.Allocated
+		grant.Overage = 0
+		if grant.Available < 0 {
+			grant.Overage = -grant.Available
+			grant.Available = 0
+		}
+
+		switch {
+		case grant.Allocated == 0:
+			grant.Status = v1.GrantStatusFree
+		case pending[id]:
+			grant.Status = v1.GrantStatusPending
+		default:
+			grant.Status = v1.GrantStatusInUse
+		}
+
+		entitlement.Status.Grants[id] = grant
+
+		u := usage[grant.Unit]
+		u.Amount += grant.Amount
+		u.Used += grant.Allocated
+		u.Available += grant.Available
+		u.Overage += grant.Overage
+		if allowance := overageAllowance(entitlement, grant); allowance > grant.Overage {
+			u.OverageAvailable += allowance - grant.Overage
+		}
+		usage[grant.Unit] = u
+		allowed[grant.Unit] += overageAllowance(entitlement, grant)
+	}
+
+	now := time.Now()
+	for unit, u := range usage {
+		if !overageOpen(entitlement, unit, now) {
+			u.OverageAvailable = 0
+			usage[unit] = u
+		}
+	}
+
+	units := make([]string, 0, len(usage))
+	for unit := range usage {
+		units = append(units, unit)
+	}
+	sort.Strings(units)
+
+	var used, available []string
+	for _, unit := range units {
+		used = append(used, fmt.Sprintf("%s=%d", unit, usage[unit].Used))
+		available = append(available, fmt.Sprintf("%s=%d", unit, usage[unit].Available))
+	}
+
+	entitlement.Status.Usage = usage
+	entitlement.Status.Used = strings.Join(used, ",")
+	entitlement.Status.Available = strings.Join(available, ",")
+
+	trackOverage(entitlement, allowed, now)
+}
+
+// requestAllocations returns the allocations of a request. Requests offered a single grant
+// before allocations were recorded only carry the grant id.
+func requestAllocations(request *v1.Request) []v1.Allocation {
+	if len(request.Status.Allocations) > 0 {
+		return request.Status.Allocations
+	}
+
+	if request.Status.Grant == "" {
+		return nil
+	}
+
+	return []v1.Allocation{{
+		Grant:         request.Status.Grant,
+		Amount:        request.Spec.Amount,
+		LicenseSecret: request.Status.LicenseSecret,
+		License:       request.Status.License,
+	}}
+}
+
+// allocationKey returns the key of a request's allocation record. Requests of the entitlement's own
+// namespace are keyed by name, those of namespaces bound to it by namespace and name.
+func allocationKey(entitlement *v1.Entitlement, request kubernetes.NamespacedName) string {
+	if request.Namespace == "" || request.Namespace == entitlement.Namespace {
+		return request.Name
+	}
+
+	return request.Namespace + "/" + request.Name
+}
+
+// heldAllocation returns the allocation record of a request, if the entitlement has one for it.
+func heldAllocation(entitlement *v1.Entitlement, request *v1.Request) (v1.RequestAllocation, bool) {
+	ra, ok := entitlement.Status.Allocations[allocationKey(entitlement, requestName(request))]
+	return ra, ok
+}
+
+func requestName(request *v1.Request) kubernetes.NamespacedName {
+	return kubernetes.NamespacedName{
+		Name:      request.Name,
+		Namespace: request.Namespace,
+	}
+}
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sync"
+)
+
+// Allocator is the single writer of Entitlements within the operator.
+// Updates to an entitlement are serialised, so two handlers can never allocate from the same
+// view of an entitlement, and are guarded by optimistic concurrency against any other writer.
+//
+// Entitlements are stored as v1beta2, where what licenses grant is in the spec and how much of it is
+// allocated is in the status. Through v1 both are in the status, so a change to what is granted is
+// written to the entitlement itself as well as its status.
+type Allocator struct {
+	entitlementCache  v1.EntitlementCache
+	entitlementClient v1.EntitlementClient
+
+	lock  sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func NewAllocator(entitlementController v1.EntitlementController) *Allocator {
+	return &Allocator{
+		entitlementCache:  entitlementController.Cache(),
+		entitlementClient: entitlementController,
+		locks:             map[string]*sync.Mutex{},
+	}
+}
+
+// MutateFunc changes an entitlement, returning false if nothing changed and no write is needed.
+// It is called again with the latest entitlement if the write conflicts, so it must derive every
+// change from the entitlement it is given and must not have side effects outside of it.
+type MutateFunc func(entitlement *licensingv1.Entitlement) (bool, error)
+
+// Update applies mutate to the current entitlement and writes it.
+func (a *Allocator) Update(namespace string, name string, mutate MutateFunc) (*licensingv1.Entitlement, error) {
+	l := a.lockFor(namespace, name)
+	l.Lock()
+	defer l.Unlock()
+
+	var result *licensingv1.Entitlement
+	fresh := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// the cache is cheap but may lag behind our own writes. that is caught by the conflict
+		// on write, after which we read straight from the api server
+		var current *licensingv1.Entitlement
+		var err error
+		if fresh {
+			current, err = a.entitlementClient.Get(namespace, name, metav1.GetOptions{})
+		} else {
+			current, err = a.entitlementCache.Get(namespace, name)
+			if errors.IsNotFound(err) {
+				// may have only just been created
+				current, err = a.entitlementClient.Get(namespace, name, metav1.GetOptions{})
+			}
+		}
+		fresh = true
+		if err != nil {
+			return err
+		}
+
+		entitlement := current.DeepCopy()
+		migrated := MigrateGrantRequests(entitlement)
+		if migrated {
+			recalculate(entitlement)
+		}
+
+		changed, err := mutate(entitlement)
+		if err != nil {
+			return err
+		}
+		changed = changed || migrated
+
+		if !changed {
+			result = entitlement
+			return nil
+		}
+
+		if grantsChanged(current, entitlement) {
+			updated, err := a.entitlementClient.Update(entitlement)
+			if err != nil {
+				return err
+			}
+
+			// the status is ignored when updating the entitlement, it is written next
+			entitlement.ResourceVersion = updated.ResourceVersion
+			entitlement.Generation = updated.Generation
+		}
+
+		setEntitlementConditions(entitlement)
+
+		result, err = a.entitlementClient.UpdateStatus(entitlement)
+		return err
+	})
+
+	return result, err
+}
+
+// Ensure creates the entitlement if it doesn't exist yet.
+func (a *Allocator) Ensure(namespace string, name string) error {
+	_, err := a.entitlementCache.Get(namespace, name)
+	if !errors.IsNotFound(err) {
+		return err
+	}
+
+	l := a.lockFor(namespace, name)
+	l.Lock()
+	defer l.Unlock()
+
+	_, err = a.entitlementClient.Create(&licensingv1.Entitlement{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	})
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (a *Allocator) lockFor(namespace string, name string) *sync.Mutex {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := namespace + "/" + name
+	l, ok := a.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		a.locks[key] = l
+	}
+
+	return l
+}
+
+// grantsChanged returns true if the grants of an entitlement changed other than in how much of them is
+// allocated, which is all that is written with its status.
+func grantsChanged(current *licensingv1.Entitlement, updated *licensingv1.Entitlement) bool {
+	if len(current.Status.Grants) != len(updated.Status.Grants) {
+		return true
+	}
+
+	for id, g := range updated.Status.Grants {
+		c, ok := current.Status.Grants[id]
+		if !ok {
+			return true
+		}
+
+		c.Status, c.Allocated, c.Available, c.Overage = g.Status, g.Allocated, g.Available, g.Overage
+		if !equality.Semantic.DeepEqual(c, g) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,232 @@
+package controllers
+
+import (
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testKind = "test.example.com"
+
+func testGrant(id string, unit string, amount int) licensingv1.Grant {
+	return licensingv1.Grant{
+		Id:        id,
+		Amount:    amount,
+		Unit:      unit,
+		NotBefore: metav1.NewTime(time.Now().Add(-time.Hour)),
+		NotAfter:  metav1.NewTime(time.Now().Add(24 * time.Hour)),
+		Status:    licensingv1.GrantStatusFree,
+		Available: amount,
+	}
+}
+
+func testEntitlement(grants ...licensingv1.Grant) *licensingv1.Entitlement {
+	entitlement := &licensingv1.Entitlement{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: testKind},
+	}
+	entitlement.Status.Grants = map[string]licensingv1.Grant{}
+	for _, g := range grants {
+		entitlement.Status.Grants[g.Id] = g
+	}
+	recalculate(entitlement)
+
+	return entitlement
+}
+
+func testRequest(namespace string, name string, unit string, amount int) *licensingv1.Request {
+	request := &licensingv1.Request{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			UID:       types.UID(namespace + "/" + name),
+		},
+	}
+	request.Spec.Kind = testKind
+	request.Spec.Unit = unit
+	request.Spec.Amount = amount
+	request.Status.Status = licensingv1.UsageRequestStatusDiscover
+
+	return request
+}
+
+func newTestRequestHandler(entitlements *fakeEntitlements, requests *fakeRequests,
+	quotas ...*licensingv1.LicenseQuota) *RequestHandler {
+	return &RequestHandler{
+		allocator: &Allocator{
+			entitlementCache:  entitlements.cache(),
+			entitlementClient: entitlements,
+			locks:             map[string]*sync.Mutex{},
+		},
+		enqueue:           func(namespace string, name string) {},
+		enqueueAfter:      func(namespace string, name string, duration time.Duration) {},
+		requestCache:      requests.cache(),
+		requestClient:     requests,
+		entitlementCache:  entitlements.cache(),
+		entitlementClient: entitlements,
+		constraints: &ConstraintChecker{
+			namespaceCache: &fakeNamespaceCache{},
+			nodeCache:      &fakeNodeCache{},
+		},
+		quotas:   newCachedQuotaChecker(&fakeQuotaCache{quotas: quotas}, requests.cache()),
+		resolver: &EntitlementResolver{getEntitlement: entitlements.cache().Get},
+	}
+}
+
+// TestAllocatorNeverDoubleAllocates discovers many requests at once, each more than once, through two
+// allocators sharing the same entitlement. The allocators stand in for two operators racing each other,
+// which only optimistic concurrency keeps apart. However the updates interleave, no grant may be
+// allocated beyond its amount, and every offer must be backed by the allocation record of its request.
+func TestAllocatorNeverDoubleAllocates(t *testing.T) {
+	entitlements := newFakeEntitlements(testEntitlement(
+		testGrant("a", "seats", 10),
+		testGrant("b", "seats", 7),
+		testGrant("c", "seats", 5)))
+
+	var requests []*licensingv1.Request
+	for i := 0; i < 60; i++ {
+		requests = append(requests, testRequest("default", fmt.Sprintf("r%02d", i), "seats", 1+i%4))
+	}
+	store := newFakeRequests(requests...)
+
+	handlers := []*RequestHandler{
+		newTestRequestHandler(entitlements, store),
+		newTestRequestHandler(entitlements, store),
+	}
+
+	var wg sync.WaitGroup
+	for round := 0; round < 3; round++ {
+		for i, request := range requests {
+			wg.Add(1)
+			go func(h *RequestHandler, request *licensingv1.Request) {
+				defer wg.Done()
+
+				// a request whose update keeps conflicting is requeued, as the controller would
+				for attempt := 0; ; attempt++ {
+					_, err := h.discover(request)
+					if err == nil {
+						return
+					}
+					if !errors.IsConflict(err) || attempt == 50 {
+						t.Errorf("discovering %s: %v", request.Name, err)
+						return
+					}
+				}
+			}(handlers[(i+round)%len(handlers)], request)
+		}
+	}
+	wg.Wait()
+
+	entitlement := entitlements.get("default", testKind)
+
+	held := map[string]int{}
+	for _, ra := range entitlement.Status.Allocations {
+		for _, a := range ra.Grants {
+			held[a.Grant] += a.Amount
+		}
+	}
+
+	for id, grant := range entitlement.Status.Grants {
+		if held[id] > grant.Amount {
+			t.Errorf("grant %s of %d is allocated %d", id, grant.Amount, held[id])
+		}
+		if grant.Allocated != held[id] {
+			t.Errorf("grant %s reports %d allocated, its allocation records hold %d", id, grant.Allocated, held[id])
+		}
+	}
+
+	offered := 0
+	for _, request := range requests {
+		current, err := store.Get(request.Namespace, request.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ra, recorded := heldAllocation(entitlement, current)
+		if current.Status.Status != licensingv1.UsageRequestStatusOffer {
+			if recorded {
+				t.Errorf("request %s holds capacity but was not offered it", current.Name)
+			}
+			continue
+		}
+
+		offered += current.Spec.Amount
+		if !recorded || ra.RequestUID != current.UID {
+			t.Errorf("request %s was offered capacity that isn't allocated to it", current.Name)
+			continue
+		}
+
+		recordedGrants := map[string]int{}
+		for _, a := range ra.Grants {
+			recordedGrants[a.Grant] += a.Amount
+		}
+		for _, a := range current.Status.Allocations {
+			recordedGrants[a.Grant] -= a.Amount
+		}
+		for id, difference := range recordedGrants {
+			if difference != 0 {
+				t.Errorf("request %s was offered a different amount of grant %s than is allocated to it", current.Name, id)
+			}
+		}
+	}
+
+	if offered == 0 {
+		t.Error("no request was offered anything")
+	}
+	if used := entitlement.Status.Usage["seats"].Used; used != offered {
+		t.Errorf("%d seats are used but %d were offered", used, offered)
+	}
+}
+
+// TestAllocatorMigratesGrantRequests checks that grants allocated whole to a request before allocations
+// were recorded per request keep their request's capacity when the entitlement is next updated.
+func TestAllocatorMigratesGrantRequests(t *testing.T) {
+	entitlement := testEntitlement(testGrant("a", "seats", 5), testGrant("b", "seats", 3))
+	entitlement.Status.Allocations = nil
+	inUse := entitlement.Status.Grants["a"]
+	inUse.Status = licensingv1.GrantStatusInUse
+	inUse.Request = &kubernetes.NamespacedName{Namespace: "default", Name: "old"}
+	entitlement.Status.Grants["a"] = inUse
+
+	entitlements := newFakeEntitlements(entitlement)
+	allocator := &Allocator{
+		entitlementCache:  entitlements.cache(),
+		entitlementClient: entitlements,
+		locks:             map[string]*sync.Mutex{},
+	}
+
+	updated, err := allocator.Update("default", testKind, func(entitlement *licensingv1.Entitlement) (bool, error) {
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grant := updated.Status.Grants["a"]
+	if grant.Request != nil || grant.Status != licensingv1.GrantStatusInUse || grant.Available != 0 {
+		t.Errorf("grant a wasn't migrated: %+v", grant)
+	}
+
+	ra, ok := updated.Status.Allocations["old"]
+	if !ok || ra.Amount != 5 || len(ra.Grants) != 1 || ra.Grants[0].Grant != "a" {
+		t.Fatalf("allocation of request old wasn't recorded: %+v", updated.Status.Allocations)
+	}
+
+	if usage := updated.Status.Usage["seats"]; usage.Used != 5 || usage.Available != 3 {
+		t.Errorf("expected 5 seats used and 3 available, got %+v", usage)
+	}
+
+	if allocations := selectGrants(updated, testRequest("default", "new", "seats", 5)); allocations != nil {
+		t.Errorf("capacity held by request old was offered again: %+v", allocations)
+	}
+
+	// the request the grant was allocated to adopts the migrated record when it is next seen
+	if !heldBy(ra, testRequest("default", "old", "seats", 5)) {
+		t.Error("migrated record isn't held by its request")
+	}
+}
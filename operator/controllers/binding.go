@@ -0,0 +1,345 @@
+package controllers
+
+import (
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	wranglerCore "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	"github.com/rancher/wrangler/pkg/relatedresource"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	"sort"
+	"strings"
+)
+
+// LicenseNamespace, if set, is the only namespace whose EntitlementBindings are honoured, so that only those
+// who can install licenses there can share them. Empty honours bindings in any namespace.
+// The operator overrides this from its --license-namespace flag.
+var LicenseNamespace = ""
+
+// EntitlementResolver finds the entitlement a request draws on: the entitlement of its kind in its own
+// namespace if there is one, otherwise one in a namespace whose EntitlementBindings bind the request's
+// namespace. Bindings are considered in order of namespace and name, the first one bound to an existing
+// entitlement wins.
+type EntitlementResolver struct {
+	getEntitlement func(namespace string, name string) (*licensingv1.Entitlement, error)
+	listBindings   func(namespace string) ([]*licensingv1.EntitlementBinding, error)
+	getNamespace   func(name string) (*corev1.Namespace, error)
+}
+
+// NewEntitlementResolver resolves entitlements straight from the api server, for use where caches may not
+// have been started, e.g. in webhooks.
+func NewEntitlementResolver(
+	entitlementClient v1.EntitlementClient,
+	bindingClient v1.EntitlementBindingClient,
+	namespaceClient wranglerCore.NamespaceClient) *EntitlementResolver {
+	return &EntitlementResolver{
+		getEntitlement: func(namespace string, name string) (*licensingv1.Entitlement, error) {
+			return entitlementClient.Get(namespace, name, metav1.GetOptions{})
+		},
+		listBindings: func(namespace string) ([]*licensingv1.EntitlementBinding, error) {
+			list, err := bindingClient.List(namespace, metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+
+			bindings := make([]*licensingv1.EntitlementBinding, 0, len(list.Items))
+			for i := range list.Items {
+				bindings = append(bindings, &list.Items[i])
+			}
+			return bindings, nil
+		},
+		getNamespace: func(name string) (*corev1.Namespace, error) {
+			return namespaceClient.Get(name, metav1.GetOptions{})
+		},
+	}
+}
+
+func newCachedResolver(
+	entitlementCache v1.EntitlementCache,
+	bindingCache v1.EntitlementBindingCache,
+	namespaceCache wranglerCore.NamespaceCache) *EntitlementResolver {
+	return &EntitlementResolver{
+		getEntitlement: entitlementCache.Get,
+		listBindings: func(namespace string) ([]*licensingv1.EntitlementBinding, error) {
+			return bindingCache.List(namespace, labels.Everything())
+		},
+		getNamespace: namespaceCache.Get,
+	}
+}
+
+// Resolve returns the namespace of the entitlement of kind that requests in namespace draw on. If no
+// entitlement is found, that is the namespace itself.
+func (r *EntitlementResolver) Resolve(namespace string, kind string) (string, error) {
+	_, err := r.getEntitlement(namespace, kind)
+	if err == nil || !errors.IsNotFound(err) {
+		return namespace, err
+	}
+
+	bindings, err := r.listBindings(LicenseNamespace)
+	if err != nil {
+		return "", err
+	}
+	sortBindings(bindings)
+
+	var ns *corev1.Namespace
+	for _, b := range bindings {
+		if b.Namespace == namespace || !b.DeletionTimestamp.IsZero() || !sharesKind(b, kind) {
+			continue
+		}
+
+		if ns == nil {
+			if ns, err = r.getNamespace(namespace); err != nil {
+				return "", err
+			}
+		}
+
+		if bound, _ := binds(b, ns); !bound {
+			continue
+		}
+
+		_, err := r.getEntitlement(b.Namespace, kind)
+		if err == nil {
+			return b.Namespace, nil
+		}
+		if !errors.IsNotFound(err) {
+			return "", err
+		}
+	}
+
+	return namespace, nil
+}
+
+// BindingHandler keeps the status of EntitlementBindings up to date with the namespaces they bind, and
+// has requests of namespaces that are bound or unbound look for capacity again. A request holding
+// capacity of an entitlement its namespace is no longer bound to goes back to discover.
+type BindingHandler struct {
+	resolver       *EntitlementResolver
+	enqueue        func(namespace string, name string)
+	bindingClient  v1.EntitlementBindingClient
+	namespaceCache wranglerCore.NamespaceCache
+	requestCache   v1.RequestCache
+	requestClient  v1.RequestClient
+}
+
+func (h *BindingHandler) OnBindingChanged(key string, binding *licensingv1.EntitlementBinding) (*licensingv1.EntitlementBinding, error) {
+	if binding == nil || !binding.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	namespaces, ready, err := h.bound(binding)
+	if err != nil {
+		return nil, err
+	}
+
+	// namespaces bound before have to look again as well, as they may no longer be
+	if err = h.revisit(binding, union(binding.Status.Namespaces, namespaces)); err != nil {
+		return nil, err
+	}
+
+	return nil, retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := h.bindingClient.Get(binding.Namespace, binding.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		updated := latest.DeepCopy()
+		updated.Status.Namespaces = namespaces
+		updated.Status.ObservedGeneration = updated.Generation
+		ready.ObservedGeneration = updated.Generation
+		meta.SetStatusCondition(&updated.Status.Conditions, ready)
+
+		if equality.Semantic.DeepEqual(latest.Status, updated.Status) {
+			return nil
+		}
+
+		_, err = h.bindingClient.UpdateStatus(updated)
+		return err
+	})
+}
+
+// OnBindingRemove has the namespaces a deleted binding bound look again.
+func (h *BindingHandler) OnBindingRemove(key string, binding *licensingv1.EntitlementBinding) (*licensingv1.EntitlementBinding, error) {
+	if binding == nil {
+		return nil, nil
+	}
+
+	return binding, h.revisit(binding, binding.Status.Namespaces)
+}
+
+// bound returns the namespaces a binding binds, sorted, and its Ready condition.
+func (h *BindingHandler) bound(binding *licensingv1.EntitlementBinding) ([]string, metav1.Condition, error) {
+	ready := metav1.Condition{Type: licensingv1.ConditionReady}
+	if LicenseNamespace != "" && binding.Namespace != LicenseNamespace {
+		ready.Status, ready.Reason = metav1.ConditionFalse, licensingv1.ReasonBindingIgnored
+		ready.Message = fmt.Sprintf("only bindings in namespace %s are honoured", LicenseNamespace)
+		return nil, ready, nil
+	}
+
+	all, err := h.namespaceCache.List(labels.Everything())
+	if err != nil {
+		return nil, ready, err
+	}
+
+	var namespaces []string
+	for _, ns := range all {
+		if ns.Name == binding.Namespace {
+			continue
+		}
+
+		bound, err := binds(binding, ns)
+		if err != nil {
+			ready.Status, ready.Reason = metav1.ConditionFalse, licensingv1.ReasonInvalidSelector
+			ready.Message = err.Error()
+			return nil, ready, nil
+		}
+		if bound {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+	sort.Strings(namespaces)
+
+	kinds := "every entitlement"
+	if len(binding.Spec.Kinds) > 0 {
+		kinds = strings.Join(binding.Spec.Kinds, ", ")
+	}
+	ready.Status, ready.Reason = metav1.ConditionTrue, licensingv1.ReasonBound
+	ready.Message = fmt.Sprintf("%s shared with %d namespaces", kinds, len(namespaces))
+	return namespaces, ready, nil
+}
+
+// revisit has the requests of namespaces for entitlements the binding shares look for capacity again.
+// Waiting requests are requeued, requests holding capacity of the binding's namespace that they are no
+// longer bound to go back to discover.
+func (h *BindingHandler) revisit(binding *licensingv1.EntitlementBinding, namespaces []string) error {
+	var unbound []kubernetes.NamespacedName
+	for _, namespace := range namespaces {
+		requests, err := h.requestCache.List(namespace, labels.Everything())
+		if err != nil {
+			return err
+		}
+
+		for _, request := range requests {
+			if !request.DeletionTimestamp.IsZero() || !sharesKind(binding, request.Spec.Kind) {
+				continue
+			}
+
+			switch request.Status.Status {
+			case licensingv1.UsageRequestStatusDiscover:
+				h.enqueue(request.Namespace, request.Name)
+			case licensingv1.UsageRequestStatusOffer, licensingv1.UsageRequestStatusAcknowledged:
+				if entitlementNamespace(request) != binding.Namespace {
+					continue
+				}
+
+				resolved, err := h.resolver.Resolve(request.Namespace, request.Spec.Kind)
+				if err != nil {
+					return err
+				}
+				if resolved != binding.Namespace {
+					unbound = append(unbound, requestName(request))
+				}
+			}
+		}
+	}
+
+	if len(unbound) > 0 {
+		logrus.Infof("%d requests are no longer bound to entitlements in namespace %s", len(unbound), binding.Namespace)
+	}
+
+	// discover releases what they held
+	return ResetRequests(h.requestClient.Get, h.requestClient.UpdateStatus, unbound, licensingv1.ReasonBindingRemoved,
+		fmt.Sprintf("no longer bound to entitlements in namespace %s", binding.Namespace))
+}
+
+// resolveAllBindings has every binding look again when a namespace changes, as its labels may now match
+// the selector of a binding, or no longer.
+func resolveAllBindings(bindingCache v1.EntitlementBindingCache) relatedresource.Resolver {
+	return func(namespace string, name string, obj runtime.Object) ([]relatedresource.Key, error) {
+		bindings, err := bindingCache.List(LicenseNamespace, labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+
+		keys := make([]relatedresource.Key, 0, len(bindings))
+		for _, b := range bindings {
+			keys = append(keys, relatedresource.Key{Namespace: b.Namespace, Name: b.Name})
+		}
+		return keys, nil
+	}
+}
+
+// entitlementNamespace returns the namespace of the entitlement a request drew on, its own unless it was
+// bound to one in another namespace.
+func entitlementNamespace(request *licensingv1.Request) string {
+	if request.Status.EntitlementNamespace != "" {
+		return request.Status.EntitlementNamespace
+	}
+
+	return request.Namespace
+}
+
+// binds returns true if the binding binds the namespace, by name or by its selector.
+func binds(binding *licensingv1.EntitlementBinding, namespace *corev1.Namespace) (bool, error) {
+	for _, n := range binding.Spec.Namespaces {
+		if n == namespace.Name {
+			return true, nil
+		}
+	}
+
+	if binding.Spec.NamespaceSelector == nil {
+		return false, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(binding.Spec.NamespaceSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid namespace selector: %v", err)
+	}
+
+	return selector.Matches(labels.Set(namespace.Labels)), nil
+}
+
+// sharesKind returns true if the binding shares the entitlement of kind.
+func sharesKind(binding *licensingv1.EntitlementBinding, kind string) bool {
+	if len(binding.Spec.Kinds) == 0 {
+		return true
+	}
+
+	for _, k := range binding.Spec.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortBindings(bindings []*licensingv1.EntitlementBinding) {
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].Namespace != bindings[j].Namespace {
+			return bindings[i].Namespace < bindings[j].Namespace
+		}
+		return bindings[i].Name < bindings[j].Name
+	})
+}
+
+func union(a []string, b []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
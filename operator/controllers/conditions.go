@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"fmt"
+	v1 "github.com/ebauman/klicense/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExpiryWarning is how long before a license expires that its entitlement is marked Expiring.
+// The operator overrides this from its --expiry-warning flag.
+var ExpiryWarning = 30 * 24 * time.Hour
+
+// setRequestConditions derives the conditions of a request from its status. reason explains why
+// a request isn't offered anything; if empty it is worked out from the status.
+func setRequestConditions(request *v1.Request, reason string) {
+	status := &request.Status
+	status.ObservedGeneration = request.Generation
+
+	offered := metav1.Condition{Type: v1.ConditionOffered, ObservedGeneration: request.Generation}
+	ready := metav1.Condition{Type: v1.ConditionReady, ObservedGeneration: request.Generation}
+
+	switch status.Status {
+	case v1.UsageRequestStatusOffer:
+		offered.Status, offered.Reason = metav1.ConditionTrue, v1.ReasonOffered
+		ready.Status, ready.Reason = metav1.ConditionFalse, v1.ReasonAwaitingAck
+	case v1.UsageRequestStatusAcknowledged:
+		offered.Status, offered.Reason = metav1.ConditionTrue, v1.ReasonOffered
+		ready.Status, ready.Reason = metav1.ConditionTrue, v1.ReasonAcknowledged
+	default:
+		if reason == "" {
+			switch {
+			case status.Status == v1.UsageRequestStatusExpired:
+				reason = v1.ReasonLeaseExpired
+			case status.QueuePosition > 0:
+				reason = v1.ReasonQueued
+			default:
+				reason = v1.ReasonDiscovering
+			}
+		}
+
+		offered.Status, offered.Reason = metav1.ConditionFalse, reason
+		ready.Status, ready.Reason = metav1.ConditionFalse, reason
+	}
+
+	offered.Message = status.Message
+	ready.Message = status.Message
+
+	meta.SetStatusCondition(&status.Conditions, offered)
+	meta.SetStatusCondition(&status.Conditions, ready)
+}
+
+// setEntitlementConditions derives the conditions of an entitlement from its grants and queue.
+func setEntitlementConditions(entitlement *v1.Entitlement) {
+	status := &entitlement.Status
+	generation := entitlement.Generation
+	status.ObservedGeneration = generation
+
+	ready := metav1.Condition{Type: v1.ConditionReady, ObservedGeneration: generation}
+	if len(status.Grants) > 0 {
+		ready.Status, ready.Reason = metav1.ConditionTrue, v1.ReasonGrantsAvailable
+		ready.Message = fmt.Sprintf("%d grants from %d licenses", len(status.Grants), status.Licenses)
+	} else {
+		ready.Status, ready.Reason = metav1.ConditionFalse, v1.ReasonNoGrants
+		ready.Message = "no valid license grants this entitlement"
+	}
+
+	expiring := metav1.Condition{Type: v1.ConditionExpiring, ObservedGeneration: generation}
+	if expiry := status.EarliestExpiration; len(status.Grants) > 0 && time.Until(expiry.Time) < ExpiryWarning {
+		expiring.Status, expiring.Reason = metav1.ConditionTrue, v1.ReasonLicenseExpiring
+		expiring.Message = fmt.Sprintf("a license expires at %s", expiry.UTC().Format(time.RFC3339))
+	} else {
+		expiring.Status, expiring.Reason = metav1.ConditionFalse, v1.ReasonLicensesValid
+	}
+
+	degraded := metav1.Condition{Type: v1.ConditionDegraded, ObservedGeneration: generation}
+	if status.Waiting > 0 {
+		degraded.Status, degraded.Reason = metav1.ConditionTrue, v1.ReasonRequestsWaiting
+		degraded.Message = fmt.Sprintf("%d requests waiting for capacity", status.Waiting)
+	} else {
+		degraded.Status, degraded.Reason = metav1.ConditionFalse, v1.ReasonAllRequestsServed
+	}
+
+	meta.SetStatusCondition(&status.Conditions, ready)
+	meta.SetStatusCondition(&status.Conditions, expiring)
+	meta.SetStatusCondition(&status.Conditions, degraded)
+
+	// only entitlements with measured units, or allocated beyond license, can say whether they are used within license
+	if len(status.Measured) == 0 && len(status.Overage) == 0 {
+		meta.RemoveStatusCondition(&status.Conditions, v1.ConditionCompliant)
+		return
+	}
+
+	compliant := metav1.Condition{Type: v1.ConditionCompliant, ObservedGeneration: generation}
+	var over []string
+	for unit, mu := range status.Measured {
+		if mu.Overage > 0 {
+			over = append(over, fmt.Sprintf("%d %s measured, %d licensed", mu.Measured, unit, mu.Licensed))
+		}
+	}
+	for unit, o := range status.Overage {
+		if o.Amount == 0 {
+			// back within license, its window is only kept until it closes
+			continue
+		}
+
+		message := fmt.Sprintf("%d %s allocated beyond license", o.Amount, unit)
+		switch {
+		case o.Phase == v1.OveragePhaseClosed:
+			message += ", overage window closed"
+		case o.Until != nil:
+			message += ", overage window closes at " + o.Until.UTC().Format(time.RFC3339)
+		}
+		over = append(over, message)
+	}
+	sort.Strings(over)
+
+	if len(over) > 0 {
+		compliant.Status, compliant.Reason = metav1.ConditionFalse, v1.ReasonOverLicense
+		compliant.Message = strings.Join(over, ", ")
+	} else {
+		compliant.Status, compliant.Reason = metav1.ConditionTrue, v1.ReasonWithinLicense
+	}
+
+	meta.SetStatusCondition(&status.Conditions, compliant)
+}
+
+// nextConditionChange returns how long until the Expiring condition of an entitlement, one of its
+// grants, or the overage window of one of its units, next changes with the passing of time. ok is false
+// if nothing is due to change.
+func nextConditionChange(entitlement *v1.Entitlement) (time.Duration, bool) {
+	var next time.Duration
+	for _, g := range entitlement.Status.Grants {
+		for _, at := range []time.Time{g.NotAfter.Add(-ExpiryWarning), g.NotAfter.Time} {
+			if d := time.Until(at); d > 0 && (next == 0 || d < next) {
+				next = d
+			}
+		}
+	}
+	for _, o := range entitlement.Status.Overage {
+		if o.Until == nil {
+			continue
+		}
+
+		for _, at := range []time.Time{o.Until.Add(-OverageWarning), o.Until.Time} {
+			if d := time.Until(at); d > 0 && (next == 0 || d < next) {
+				next = d
+			}
+		}
+	}
+
+	return next, next > 0
+}
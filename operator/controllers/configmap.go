@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"context"
+	v1 "github.com/ebauman/klicense/api/v1"
+	license2 "github.com/ebauman/klicense/license"
+	"github.com/ebauman/klicense/remove"
+	wranglerCorev1 "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ConfigMapSource discovers licenses in ConfigMaps labeled with LicensingLabel.
+// Licenses are signed, so they don't need to be kept secret; this lets them be committed to git.
+type ConfigMapSource struct {
+	configMapController wranglerCorev1.ConfigMapController
+	handler             *ConfigMapHandler
+}
+
+func NewConfigMapSource(configMapController wranglerCorev1.ConfigMapController) *ConfigMapSource {
+	return &ConfigMapSource{
+		configMapController: configMapController,
+	}
+}
+
+func (c *ConfigMapSource) Register(ctx context.Context, projector *Projector) {
+	configMapHandler := &ConfigMapHandler{
+		projector: projector,
+	}
+	c.handler = configMapHandler
+
+	remove.RegisterScopedOnRemoveHandler(ctx, c.configMapController, "on-license-configmap-remove",
+		func(key string, obj runtime.Object) (bool, error) {
+			if obj == nil {
+				return false, nil
+			}
+
+			configMap, ok := obj.(*corev1.ConfigMap)
+			if !ok {
+				return false, nil
+			}
+
+			_, ok = configMap.Labels[LicensingLabel]
+			return ok, nil
+		},
+		wranglerCorev1.FromConfigMapHandlerToHandler(configMapHandler.OnRemove),
+	)
+
+	c.configMapController.OnChange(ctx, "configmap-on-change", configMapHandler.OnConfigMapChanged)
+}
+
+func (c *ConfigMapSource) Start(ctx context.Context) {}
+
+func (c *ConfigMapSource) Rebuild(namespace string) error {
+	configMaps, err := c.configMapController.Cache().List(namespace, labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, configMap := range configMaps {
+		// a bad configmap shouldn't keep the licenses in the others from coming back
+		if _, err := c.handler.OnConfigMapChanged("", configMap); err != nil {
+			logrus.Errorf("error projecting licenses from configmap %s/%s: %s", configMap.Namespace, configMap.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+type ConfigMapHandler struct {
+	projector *Projector
+}
+
+func (c *ConfigMapHandler) OnConfigMapChanged(key string, configMap *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	if configMap == nil {
+		return nil, nil
+	}
+
+	if !configMap.DeletionTimestamp.IsZero() {
+		// the onremove handler takes care of this
+		return nil, nil
+	}
+
+	if _, ok := configMap.Labels[LicensingLabel]; !ok {
+		return nil, nil
+	}
+
+	licenses, err := license2.ValidateConfigMap(configMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, c.projector.Project(configMapSource(configMap), configMap.Namespace, licenses)
+}
+
+func (c *ConfigMapHandler) OnRemove(key string, configMap *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	if configMap == nil {
+		return nil, nil
+	}
+
+	if err := c.projector.Remove(configMapSource(configMap), configMap.Namespace); err != nil {
+		return nil, err
+	}
+
+	return configMap, nil
+}
+
+func configMapSource(configMap *corev1.ConfigMap) v1.LicenseSource {
+	return v1.LicenseSource{
+		Type:      v1.LicenseSourceConfigMap,
+		Namespace: configMap.Namespace,
+		Name:      configMap.Name,
+	}
+}
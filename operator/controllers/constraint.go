@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	license2 "github.com/ebauman/klicense/license"
+	wranglerCore "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sort"
+	"strings"
+	"time"
+)
+
+// constraintRecheck is how often a request that no grant's constraints allow looks for capacity again,
+// as what the constraints depend on, e.g. the labels of its namespace, may have changed.
+const constraintRecheck = time.Minute
+
+// ConstraintChecker evaluates the constraints licenses carry against a request, its namespace and the
+// cluster, before the request is offered capacity. A grant is only offered to requests all of its
+// constraints hold for; a constraint that can't be evaluated doesn't hold.
+type ConstraintChecker struct {
+	namespaceCache wranglerCore.NamespaceCache
+	nodeCache      wranglerCore.NodeCache
+}
+
+// check evaluates the constraints of the grants of the request's unit. Returns the ids of the grants
+// whose constraints don't all hold, and what failed, ordered by grant.
+func (c *ConstraintChecker) check(entitlement *licensingv1.Entitlement, request *licensingv1.Request) (map[string]bool, []licensingv1.ConstraintFailure) {
+	ids := make([]string, 0, len(entitlement.Status.Grants))
+	for id, grant := range entitlement.Status.Grants {
+		if grant.Unit == request.Spec.Unit && len(grant.Constraints) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	sort.Strings(ids)
+
+	variables, err := c.variables(entitlement, request)
+
+	denied := map[string]bool{}
+	var failures []licensingv1.ConstraintFailure
+	for _, id := range ids {
+		for _, expression := range entitlement.Status.Grants[id].Constraints {
+			failure := licensingv1.ConstraintFailure{Grant: id, Expression: expression}
+			if err != nil {
+				failure.Error = err.Error()
+			} else if ok, evalErr := license2.EvaluateConstraint(expression, variables); evalErr != nil {
+				failure.Error = evalErr.Error()
+			} else if ok {
+				continue
+			}
+
+			denied[id] = true
+			failures = append(failures, failure)
+		}
+	}
+
+	return denied, failures
+}
+
+// variables returns the facts constraints are evaluated against, see license.CompileConstraint.
+func (c *ConstraintChecker) variables(entitlement *licensingv1.Entitlement, request *licensingv1.Request) (map[string]interface{}, error) {
+	namespace, err := c.namespaceCache.Get(request.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error getting namespace %s: %v", request.Namespace, err)
+	}
+
+	nodes, err := c.nodeCache.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("error listing nodes: %v", err)
+	}
+
+	var millis, bytes int64
+	for _, n := range nodes {
+		millis += n.Status.Allocatable.Cpu().MilliValue()
+		bytes += n.Status.Allocatable.Memory().Value()
+	}
+
+	// other requests of the namespace holding capacity of the entitlement
+	requests := 0
+	for _, ra := range entitlement.Status.Allocations {
+		if ra.Request.Namespace == request.Namespace && ra.Request.Name != request.Name {
+			requests++
+		}
+	}
+
+	return map[string]interface{}{
+		"request": map[string]interface{}{
+			"name":        request.Name,
+			"namespace":   request.Namespace,
+			"kind":        request.Spec.Kind,
+			"unit":        request.Spec.Unit,
+			"amount":      request.Spec.Amount,
+			"priority":    request.Spec.Priority,
+			"labels":      stringMap(request.Labels),
+			"annotations": stringMap(request.Annotations),
+		},
+		"ns": map[string]interface{}{
+			"name":        namespace.Name,
+			"labels":      stringMap(namespace.Labels),
+			"annotations": stringMap(namespace.Annotations),
+			"requests":    requests,
+		},
+		"cluster": map[string]interface{}{
+			"nodes":  len(nodes),
+			"cpu":    int((millis + 999) / 1000),
+			"memory": int((bytes + gib - 1) / gib),
+		},
+	}, nil
+}
+
+// withoutGrants returns a view of the entitlement leaving out the denied grants, to select grants from.
+// Allocations are still recorded on the entitlement itself.
+func withoutGrants(entitlement *licensingv1.Entitlement, denied map[string]bool) *licensingv1.Entitlement {
+	if len(denied) == 0 {
+		return entitlement
+	}
+
+	view := *entitlement
+	view.Status.Grants = make(map[string]licensingv1.Grant, len(entitlement.Status.Grants))
+	for id, grant := range entitlement.Status.Grants {
+		if !denied[id] {
+			view.Status.Grants[id] = grant
+		}
+	}
+
+	return &view
+}
+
+// hasGrants returns true if the entitlement has any grant of the unit.
+func hasGrants(entitlement *licensingv1.Entitlement, unit string) bool {
+	for _, grant := range entitlement.Status.Grants {
+		if grant.Unit == unit {
+			return true
+		}
+	}
+
+	return false
+}
+
+// usesGrants returns true if any of the allocations draws on one of the grants.
+func usesGrants(allocations []licensingv1.Allocation, grants map[string]bool) bool {
+	for _, a := range allocations {
+		if grants[a.Grant] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// constraintsMessage tells a request that no grant of its unit may be offered to it, and why.
+func constraintsMessage(request *licensingv1.Request, failures []licensingv1.ConstraintFailure) string {
+	reasons := make([]string, 0, len(failures))
+	for _, f := range failures {
+		reason := fmt.Sprintf("grant %s requires %s", f.Grant, f.Expression)
+		if f.Error != "" {
+			reason += ": " + f.Error
+		}
+		reasons = append(reasons, reason)
+	}
+
+	return fmt.Sprintf("no license for %s may be used by this request: %s", request.Spec.Unit, strings.Join(reasons, "; "))
+}
+
+// stringMap makes sure constraints see an empty map rather than null for unset labels and annotations.
+func stringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+
+	return m
+}
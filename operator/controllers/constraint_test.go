@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+func constrained(grant licensingv1.Grant, constraints ...string) licensingv1.Grant {
+	grant.Constraints = constraints
+	return grant
+}
+
+func testNode(name string, cpu string, memory string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(cpu),
+				corev1.ResourceMemory: resource.MustParse(memory),
+			},
+		},
+	}
+}
+
+func TestConstraintChecker(t *testing.T) {
+	namespaces := []*corev1.Namespace{{
+		ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{"env": "prod"}},
+	}}
+	nodes := []*corev1.Node{testNode("one", "2", "4Gi"), testNode("two", "1500m", "3Gi")}
+
+	tests := []struct {
+		name      string
+		grants    []licensingv1.Grant
+		held      []holder
+		namespace string
+		denied    map[string]bool
+		// grant and expression of each failure, and whether it failed to evaluate
+		failures []licensingv1.ConstraintFailure
+		errors   []bool
+	}{
+		{
+			name:   "grants without constraints aren't checked",
+			grants: []licensingv1.Grant{testGrant("a", "seats", 10)},
+		},
+		{
+			name:   "grants of other units aren't checked",
+			grants: []licensingv1.Grant{constrained(testGrant("a", "cores", 10), `ns.labels["env"] == "dev"`)},
+		},
+		{
+			name: "constraints on the request, its namespace and the cluster that hold",
+			grants: []licensingv1.Grant{constrained(testGrant("a", "seats", 10),
+				`request.amount <= 5 && request.unit == "seats"`,
+				`ns.labels["env"] == "prod"`,
+				`cluster.nodes == 2 && cluster.cpu == 4 && cluster.memory == 7`)},
+			denied: map[string]bool{},
+		},
+		{
+			name: "only grants whose constraints don't hold are denied",
+			grants: []licensingv1.Grant{
+				constrained(testGrant("a", "seats", 10), `ns.labels["env"] == "prod"`),
+				constrained(testGrant("b", "seats", 10), `ns.labels["env"] == "dev"`, `request.amount > 5`),
+			},
+			denied: map[string]bool{"b": true},
+			failures: []licensingv1.ConstraintFailure{
+				{Grant: "b", Expression: `ns.labels["env"] == "dev"`},
+				{Grant: "b", Expression: `request.amount > 5`},
+			},
+			errors: []bool{false, false},
+		},
+		{
+			name:   "other requests of the namespace holding capacity are counted",
+			grants: []licensingv1.Grant{constrained(testGrant("a", "seats", 10), `ns.requests < 2`)},
+			held: []holder{
+				{name: "one", grants: map[string]int{"a": 1}},
+				{name: "two", grants: map[string]int{"a": 1}},
+			},
+			denied:   map[string]bool{"a": true},
+			failures: []licensingv1.ConstraintFailure{{Grant: "a", Expression: `ns.requests < 2`}},
+			errors:   []bool{false},
+		},
+		{
+			name:     "a missing label doesn't hold",
+			grants:   []licensingv1.Grant{constrained(testGrant("a", "seats", 10), `ns.labels["team"] == "a"`)},
+			denied:   map[string]bool{"a": true},
+			failures: []licensingv1.ConstraintFailure{{Grant: "a", Expression: `ns.labels["team"] == "a"`}},
+			errors:   []bool{true},
+		},
+		{
+			name:     "an invalid constraint doesn't hold",
+			grants:   []licensingv1.Grant{constrained(testGrant("a", "seats", 10), `request.amount +`)},
+			denied:   map[string]bool{"a": true},
+			failures: []licensingv1.ConstraintFailure{{Grant: "a", Expression: `request.amount +`}},
+			errors:   []bool{true},
+		},
+		{
+			name:      "constraints don't hold if the namespace can't be looked up",
+			grants:    []licensingv1.Grant{constrained(testGrant("a", "seats", 10), `true`)},
+			namespace: "missing",
+			denied:    map[string]bool{"a": true},
+			failures:  []licensingv1.ConstraintFailure{{Grant: "a", Expression: `true`}},
+			errors:    []bool{true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checker := &ConstraintChecker{
+				namespaceCache: &fakeNamespaceCache{namespaces: namespaces},
+				nodeCache:      &fakeNodeCache{nodes: nodes},
+			}
+
+			namespace := test.namespace
+			if namespace == "" {
+				namespace = "default"
+			}
+
+			entitlement := holding(test.grants, test.held...)
+			denied, failures := checker.check(entitlement, testRequest(namespace, "request", "seats", 3))
+
+			if !reflect.DeepEqual(denied, test.denied) {
+				t.Errorf("expected %v denied, got %v", test.denied, denied)
+			}
+
+			if len(failures) != len(test.failures) {
+				t.Fatalf("expected failures %+v, got %+v", test.failures, failures)
+			}
+			for i, f := range failures {
+				if f.Grant != test.failures[i].Grant || f.Expression != test.failures[i].Expression {
+					t.Errorf("expected failure %+v, got %+v", test.failures[i], f)
+				}
+				if (f.Error != "") != test.errors[i] {
+					t.Errorf("failure %+v: expected an error to be %t", f, test.errors[i])
+				}
+			}
+		})
+	}
+}
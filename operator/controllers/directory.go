@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"context"
+	v1 "github.com/ebauman/klicense/api/v1"
+	license2 "github.com/ebauman/klicense/license"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DirectorySource discovers licenses in files in a local directory, such as a mounted volume.
+// Each file may hold a single license or a newline-delimited bundle of licenses.
+// Grants are created in a single namespace.
+type DirectorySource struct {
+	path      string
+	namespace string
+	resync    time.Duration
+
+	projector *Projector
+	// files that were projected on the previous scan, so that removed files can have their grants removed
+	known map[string]bool
+	// scans come from the watch loop and from rebuilds
+	mu sync.Mutex
+}
+
+func NewDirectorySource(path string, namespace string, resync time.Duration) *DirectorySource {
+	return &DirectorySource{
+		path:      path,
+		namespace: namespace,
+		resync:    resync,
+		known:     map[string]bool{},
+	}
+}
+
+func (d *DirectorySource) Register(ctx context.Context, projector *Projector) {
+	d.projector = projector
+}
+
+func (d *DirectorySource) Start(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("error creating watcher for license directory, falling back to polling: %s", err.Error())
+	} else if err = watcher.Add(d.path); err != nil {
+		logrus.Errorf("error watching license directory %s, falling back to polling: %s", d.path, err.Error())
+		_ = watcher.Close()
+		watcher = nil
+	}
+
+	go d.run(ctx, watcher)
+}
+
+func (d *DirectorySource) run(ctx context.Context, watcher *fsnotify.Watcher) {
+	var events chan fsnotify.Event
+	if watcher != nil {
+		defer watcher.Close()
+		events = watcher.Events
+	}
+
+	ticker := time.NewTicker(d.resync)
+	defer ticker.Stop()
+
+	d.scan()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+			// mounted volumes (e.g. secrets and configmaps) are updated through a series of
+			// symlink swaps, so rescan the whole directory rather than reacting to single files
+			d.scan()
+		case <-ticker.C:
+			d.scan()
+		}
+	}
+}
+
+func (d *DirectorySource) Rebuild(namespace string) error {
+	if namespace == d.namespace {
+		d.scan()
+	}
+
+	return nil
+}
+
+func (d *DirectorySource) scan() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		logrus.Errorf("error reading license directory %s: %s", d.path, err.Error())
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, e := range entries {
+		file := filepath.Join(d.path, e.Name())
+
+		// skip hidden entries, this includes the ..data directories kubelet uses for mounted volumes
+		if e.Name()[0] == '.' {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			logrus.Errorf("error reading license file %s: %s", file, err.Error())
+			continue
+		}
+
+		var licenses []*license2.License
+		for _, entry := range license2.SplitBundle(data) {
+			license, err := license2.Validate(entry)
+			if err != nil {
+				logrus.Errorf("invalid license in file %s", file)
+				continue
+			}
+			licenses = append(licenses, license)
+		}
+
+		seen[file] = true
+		if err = d.projector.Project(d.source(file), d.namespace, licenses); err != nil {
+			logrus.Errorf("error projecting licenses from file %s: %s", file, err.Error())
+		}
+	}
+
+	for file := range d.known {
+		if seen[file] {
+			continue
+		}
+
+		if err = d.projector.Remove(d.source(file), d.namespace); err != nil {
+			logrus.Errorf("error removing licenses from file %s: %s", file, err.Error())
+			seen[file] = true // try again next scan
+		}
+	}
+
+	d.known = seen
+}
+
+func (d *DirectorySource) source(file string) v1.LicenseSource {
+	return v1.LicenseSource{
+		Type:      v1.LicenseSourceDirectory,
+		Namespace: d.namespace,
+		Name:      file,
+	}
+}
@@ -1,31 +1,154 @@
 package controllers
 
 import (
+	"fmt"
 	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
 	license2 "github.com/ebauman/klicense/license"
 	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
 	wranglerCore "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	"github.com/rancher/wrangler/pkg/kv"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/tools/record"
+	"sort"
 	"strings"
 	"time"
 )
 
 type EntitlementHandler struct {
+	allocator *Allocator
+	namespaceClient wranglerCore.NamespaceClient
+	enqueue func(namespace string, name string)
+	enqueueAfter func(namespace string, name string, duration time.Duration)
 	entitlementClient v1.EntitlementClient
 	entitlementCache v1.EntitlementCache
 	requestClient v1.RequestClient
 	requestCache v1.RequestCache
 	secretCache  wranglerCore.SecretCache
+	configMapCache wranglerCore.ConfigMapCache
+	recorder record.EventRecorder
 }
 
 func (h *EntitlementHandler) OnEntitlementChanged(key string, entitlement *licensingv1.Entitlement) (*licensingv1.Entitlement, error) {
 	if entitlement == nil {
+		// entitlements are derived from licenses, so one that was deleted is rebuilt.
+		// if no license grants it any more, it stays gone. rebuilding a namespace takes a while,
+		// so it is left to the namespace controller rather than holding up this worker
+		namespace, _ := kv.Split(key, "/")
+		get := func(name string) (*corev1.Namespace, error) {
+			return h.namespaceClient.Get(name, metav1.GetOptions{})
+		}
+		if _, err := licensingv1.RequestRebuild(get, h.namespaceClient.Update, namespace); err != nil {
+			if errors.IsNotFound(err) {
+				// the namespace is gone, and the entitlement with it
+				return nil, nil
+			}
+			logrus.Errorf("error requesting rebuild of namespace %s: %s", namespace, err.Error())
+			return nil, err
+		}
 		return nil, nil
 	}
 
+	var affected []kubernetes.NamespacedName
+	var reports []overageReport
+	updated, err := h.allocator.Update(entitlement.Namespace, entitlement.Name, func(entitlement *licensingv1.Entitlement) (bool, error) {
+		original := entitlement.DeepCopy()
+		affected, reports = nil, nil
+
+		for id, g := range entitlement.Status.Grants {
+			license, found, err := lookupLicense(h.secretCache, h.configMapCache, g)
+			if err != nil {
+				// something bad happened, and it wasn't us not finding the source
+				logrus.Errorf("error looking up license for grant %s: %s", g.Id, err.Error())
+				return false, err
+			}
+
+			if !found {
+				affected = append(affected, ProcessGrantDeletion(id, entitlement)...)
+				continue
+			}
+
+			// if the license is not expired, then that's all we need to check
+			if license.NotAfter.Before(time.Now()) || license.NotBefore.After(time.Now()) {
+				logrus.Info("license expired or not yet valid")
+				affected = append(affected, ProcessGrantDeletion(id, entitlement)...)
+				continue
+			}
+
+			// if we get here the license is valid and non-expired.
+			// now we just update the grant
+			// this is to mostly prevent someone from manually editing the entitlement and changing the amounts
+			// in the case of an updated license value, the license source will handle that
+			g.NotBefore = metav1.NewTime(license.NotBefore)
+			g.NotAfter = metav1.NewTime(license.NotAfter)
+			g.Amount = license.Grants[fmt.Sprintf("%s/%s", entitlement.Name, g.Unit)]
+			g.OveragePolicy = licenseOverage(license)
+			g.Constraints = license.Constraints
+			entitlement.Status.Grants[id] = g
+		}
+
+		pruneQueue(h.requestCache, entitlement)
+		summarize(entitlement)
+		reports = reportOverage(entitlement)
+
+		return !equality.Semantic.DeepEqual(original.Status, entitlement.Status), nil
+	})
+	if err != nil {
+		logrus.Error(err, "error updating entitlement")
+		return nil, err
+	}
+
+	if err = ResetRequests(h.requestClient.Get, h.requestClient.UpdateStatus, affected, licensingv1.ReasonGrantDeleted, "prior grant deleted"); err != nil {
+		return nil, err
+	}
+
+	for _, r := range reports {
+		logrus.Warnf("entitlement %s/%s over license: %s", updated.Namespace, updated.Name, r.message)
+		h.recorder.Event(updated, corev1.EventTypeWarning, r.reason, r.message)
+	}
+
+	// licenses expire, overage windows close, and their conditions change, with nothing else changing
+	if next, ok := nextConditionChange(updated); ok {
+		h.enqueueAfter(updated.Namespace, updated.Name, next)
+	}
+
+	// capacity may have been freed, added or renewed, and positions in the queue may have moved.
+	// have every waiting request look again
+	for _, q := range updated.Status.Queue {
+		h.enqueue(q.Request.Namespace, q.Request.Name)
+	}
+
+	return nil, nil
+}
+
+// pruneQueue removes requests from the queue that no longer exist or are no longer waiting, either to
+// discover or, while holding capacity, for more.
+// Returns the requests removed.
+func pruneQueue(requestCache v1.RequestCache, entitlement *licensingv1.Entitlement) []kubernetes.NamespacedName {
+	var pruned []kubernetes.NamespacedName
+	queue := append([]licensingv1.QueuedRequest{}, entitlement.Status.Queue...)
+	for _, q := range queue {
+		request, err := requestCache.Get(q.Request.Namespace, q.Request.Name)
+		if err != nil && !errors.IsNotFound(err) {
+			continue
+		}
+
+		if errors.IsNotFound(err) || request.UID != q.RequestUID ||
+			(request.Status.Status != licensingv1.UsageRequestStatusDiscover && !growing(entitlement, request)) {
+			leaveQueue(entitlement, q.Request)
+			pruned = append(pruned, q.Request)
+		}
+	}
+
+	return pruned
+}
+
+// summarize counts the licenses, units and earliest expiration of the entitlement's grants.
+func summarize(entitlement *licensingv1.Entitlement) {
 	licenses := map[string]bool{}
 	unitMap := map[string]bool{}
 	var earliestExpiration time.Time
@@ -42,85 +165,72 @@ func (h *EntitlementHandler) OnEntitlementChanged(key string, entitlement *licen
 		}
 
 		unitMap[g.Unit] = true
+	}
+
+	recalculate(entitlement)
+	entitlement.Status.Licenses = len(licenses)
+	entitlement.Status.EarliestExpiration = metav1.NewTime(earliestExpiration)
+	var units []string
+	for k := range unitMap {
+		units = append(units, k)
+	}
+	sort.Strings(units)
+	entitlement.Status.Units = strings.Join(units, ",")
+
+	setEntitlementConditions(entitlement)
+}
 
-		cachedSecret, err := h.secretCache.Get(g.LicenseSecret.Namespace, g.LicenseSecret.Name)
+// lookupLicense finds the license backing a grant at its source.
+// found is false if the source no longer exists, is no longer a license source, or no longer
+// holds a valid copy of the license.
+func lookupLicense(secretCache wranglerCore.SecretCache, configMapCache wranglerCore.ConfigMapCache, g licensingv1.Grant) (*license2.License, bool, error) {
+	source := GrantSource(g)
+	switch source.Type {
+	case licensingv1.LicenseSourceSecret:
+		cachedSecret, err := secretCache.Get(source.Namespace, source.Name)
 		if errors.IsNotFound(err) {
-			err = h.processGrantDeletion(g.Id, entitlement)
-			if err != nil {
-				logrus.Errorf("couldn't remove grant from entitlement: %s", err.Error())
-				return nil, err
-			}
-			err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
-				_, err = h.entitlementClient.UpdateStatus(entitlement)
-				return err
-			})
-			if err != nil {
-				logrus.Errorf("error updating entitlement: %s", err.Error())
-				return nil, err
-			}
-			return nil, nil
+			return nil, false, nil
 		}
-
 		if err != nil {
-			// something bad happened, and it wasn't us not finding the secret
-			logrus.Errorf("error getting secret from kubernetes: %s", err.Error())
-			return nil, err
+			return nil, false, err
 		}
 
-		licenseSecret := cachedSecret.DeepCopy()
-
-		if _, ok := licenseSecret.Labels[LicensingLabel]; !ok {
-			logrus.Error(err, "license secret not labeled as such, bailing")
-			return nil, err
+		if _, ok := cachedSecret.Labels[LicensingLabel]; !ok {
+			// the label was taken off, and with it the secret source's interest in the secret
+			logrus.Infof("license secret %s/%s not labeled as such", source.Namespace, source.Name)
+			return nil, false, nil
 		}
 
-		license, err := license2.ValidateSecret(licenseSecret)
-		if err != nil {
-			logrus.Error("error validating license secret")
-			return nil, err
+		return foundLicense(license2.FindInSecret(cachedSecret, g.Id))
+	case licensingv1.LicenseSourceConfigMap:
+		if configMapCache == nil {
+			// configmap source is disabled, nothing will prune these grants
+			return nil, false, nil
 		}
 
-		// if the license is not expired, then that's all we need to check
-		if license.NotAfter.Before(time.Now()) || license.NotBefore.After(time.Now()) {
-			logrus.Info("license expired or not yet valid")
-			err = h.processGrantDeletion(g.Id, entitlement)
-			if err != nil {
-				logrus.Error(err, "couldn't remove grant from entitlement")
-			}
+		cachedConfigMap, err := configMapCache.Get(source.Namespace, source.Name)
+		if errors.IsNotFound(err) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
 		}
 
-		// if we get here the license is valid and non-expired.
-		// now we just update the grant
-		// this is to mostly prevent someone from manually editing the entitlement and changing the amounts
-		// in the case of an updated license value, the secret controller will handle that
-		g.NotBefore = metav1.NewTime(license.NotBefore)
-		g.NotAfter = metav1.NewTime(license.NotAfter)
-		g.Amount = license.Grants[entitlement.Name]
+		return foundLicense(license2.FindInConfigMap(cachedConfigMap, g.Id))
+	default:
+		// directory and http sources prune their own grants, so all that can be
+		// checked here is that the license recorded on the grant is genuine
+		return foundLicense(license2.Validate([]byte(g.License)))
 	}
+}
 
-	entitlement.Status.Licenses = len(licenses)
-	entitlement.Status.EarliestExpiration = metav1.NewTime(earliestExpiration)
-	var units []string
-	for k := range unitMap {
-		units = append(units, k)
-	}
-	entitlement.Status.Units = strings.Join(units, ",")
-
-
-	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		_, err := h.entitlementClient.UpdateStatus(entitlement)
-		return err
-	})
-
+// foundLicense treats a license that can't be found or verified as gone. Retrying won't change that,
+// only a change to its source will.
+func foundLicense(license *license2.License, err error) (*license2.License, bool, error) {
 	if err != nil {
-		logrus.Error(err, "error updating entitlement")
-		return nil, err
+		logrus.Infof("license no longer valid at its source: %s", err.Error())
+		return nil, false, nil
 	}
 
-	return nil, nil
+	return license, true, nil
 }
-
-func (h *EntitlementHandler) processGrantDeletion(key string, entitlement *licensingv1.Entitlement) error {
-	return ProcessGrantDeletion(h.requestCache.Get, h.requestClient.UpdateStatus, key, entitlement)
-}
-
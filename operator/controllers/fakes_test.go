@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	wranglerCore "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strconv"
+	"sync"
+)
+
+// The fakes implement only what the controllers under test use. The interfaces they embed are nil, so
+// anything else panics.
+
+// fakeEntitlements stores entitlements the way the api server does, rejecting writes of stale copies.
+// Its cache serves the copy from before the last write, so cached reads lag behind as they do for real.
+type fakeEntitlements struct {
+	v1.EntitlementClient
+
+	lock    sync.Mutex
+	version int
+	objects map[string]*licensingv1.Entitlement
+	cached  map[string]*licensingv1.Entitlement
+}
+
+func newFakeEntitlements(entitlements ...*licensingv1.Entitlement) *fakeEntitlements {
+	f := &fakeEntitlements{
+		objects: map[string]*licensingv1.Entitlement{},
+		cached:  map[string]*licensingv1.Entitlement{},
+	}
+	for _, e := range entitlements {
+		f.version++
+		e = e.DeepCopy()
+		e.ResourceVersion = strconv.Itoa(f.version)
+		f.objects[e.Namespace+"/"+e.Name] = e
+		f.cached[e.Namespace+"/"+e.Name] = e
+	}
+
+	return f
+}
+
+func (f *fakeEntitlements) Get(namespace string, name string, opts metav1.GetOptions) (*licensingv1.Entitlement, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	e, ok := f.objects[namespace+"/"+name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "entitlements"}, name)
+	}
+
+	return e.DeepCopy(), nil
+}
+
+func (f *fakeEntitlements) Update(entitlement *licensingv1.Entitlement) (*licensingv1.Entitlement, error) {
+	return f.write(entitlement)
+}
+
+func (f *fakeEntitlements) UpdateStatus(entitlement *licensingv1.Entitlement) (*licensingv1.Entitlement, error) {
+	return f.write(entitlement)
+}
+
+func (f *fakeEntitlements) write(entitlement *licensingv1.Entitlement) (*licensingv1.Entitlement, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := entitlement.Namespace + "/" + entitlement.Name
+	current, ok := f.objects[key]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "entitlements"}, entitlement.Name)
+	}
+	if current.ResourceVersion != entitlement.ResourceVersion {
+		return nil, errors.NewConflict(schema.GroupResource{Resource: "entitlements"}, entitlement.Name, nil)
+	}
+
+	f.version++
+	updated := entitlement.DeepCopy()
+	updated.ResourceVersion = strconv.Itoa(f.version)
+	f.cached[key] = current
+	f.objects[key] = updated
+
+	return updated.DeepCopy(), nil
+}
+
+func (f *fakeEntitlements) get(namespace string, name string) *licensingv1.Entitlement {
+	e, _ := f.Get(namespace, name, metav1.GetOptions{})
+	return e
+}
+
+func (f *fakeEntitlements) cache() v1.EntitlementCache {
+	return &fakeEntitlementCache{store: f}
+}
+
+type fakeEntitlementCache struct {
+	v1.EntitlementCache
+	store *fakeEntitlements
+}
+
+func (c *fakeEntitlementCache) Get(namespace string, name string) (*licensingv1.Entitlement, error) {
+	c.store.lock.Lock()
+	defer c.store.lock.Unlock()
+
+	e, ok := c.store.cached[namespace+"/"+name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "entitlements"}, name)
+	}
+
+	return e, nil
+}
+
+func (c *fakeEntitlementCache) List(namespace string, selector labels.Selector) ([]*licensingv1.Entitlement, error) {
+	c.store.lock.Lock()
+	defer c.store.lock.Unlock()
+
+	var entitlements []*licensingv1.Entitlement
+	for _, e := range c.store.cached {
+		if namespace == "" || e.Namespace == namespace {
+			entitlements = append(entitlements, e)
+		}
+	}
+
+	return entitlements, nil
+}
+
+// fakeRequests stores requests, rejecting writes of stale copies. Its cache is always up to date.
+type fakeRequests struct {
+	v1.RequestClient
+
+	lock    sync.Mutex
+	version int
+	objects map[string]*licensingv1.Request
+}
+
+func newFakeRequests(requests ...*licensingv1.Request) *fakeRequests {
+	f := &fakeRequests{objects: map[string]*licensingv1.Request{}}
+	for _, r := range requests {
+		f.version++
+		r = r.DeepCopy()
+		r.ResourceVersion = strconv.Itoa(f.version)
+		f.objects[r.Namespace+"/"+r.Name] = r
+	}
+
+	return f
+}
+
+func (f *fakeRequests) Get(namespace string, name string, opts metav1.GetOptions) (*licensingv1.Request, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	r, ok := f.objects[namespace+"/"+name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "requests"}, name)
+	}
+
+	return r.DeepCopy(), nil
+}
+
+func (f *fakeRequests) UpdateStatus(request *licensingv1.Request) (*licensingv1.Request, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := request.Namespace + "/" + request.Name
+	current, ok := f.objects[key]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "requests"}, request.Name)
+	}
+	if current.ResourceVersion != request.ResourceVersion {
+		return nil, errors.NewConflict(schema.GroupResource{Resource: "requests"}, request.Name, nil)
+	}
+
+	f.version++
+	updated := request.DeepCopy()
+	updated.ResourceVersion = strconv.Itoa(f.version)
+	f.objects[key] = updated
+
+	return updated.DeepCopy(), nil
+}
+
+func (f *fakeRequests) get(namespace string, name string) *licensingv1.Request {
+	r, _ := f.Get(namespace, name, metav1.GetOptions{})
+	return r
+}
+
+func (f *fakeRequests) cache() v1.RequestCache {
+	return &fakeRequestCache{store: f}
+}
+
+type fakeRequestCache struct {
+	v1.RequestCache
+	store *fakeRequests
+}
+
+func (c *fakeRequestCache) Get(namespace string, name string) (*licensingv1.Request, error) {
+	return c.store.Get(namespace, name, metav1.GetOptions{})
+}
+
+type fakeQuotaCache struct {
+	v1.LicenseQuotaCache
+	quotas []*licensingv1.LicenseQuota
+}
+
+func (c *fakeQuotaCache) List(namespace string, selector labels.Selector) ([]*licensingv1.LicenseQuota, error) {
+	var quotas []*licensingv1.LicenseQuota
+	for _, q := range c.quotas {
+		if (namespace == "" || q.Namespace == namespace) && selector.Matches(labels.Set(q.Labels)) {
+			quotas = append(quotas, q)
+		}
+	}
+
+	return quotas, nil
+}
+
+type fakeNamespaceCache struct {
+	wranglerCore.NamespaceCache
+	namespaces []*corev1.Namespace
+}
+
+func (c *fakeNamespaceCache) Get(name string) (*corev1.Namespace, error) {
+	for _, ns := range c.namespaces {
+		if ns.Name == name {
+			return ns, nil
+		}
+	}
+
+	return nil, errors.NewNotFound(schema.GroupResource{Resource: "namespaces"}, name)
+}
+
+type fakeNodeCache struct {
+	wranglerCore.NodeCache
+	nodes []*corev1.Node
+}
+
+func (c *fakeNodeCache) List(selector labels.Selector) ([]*corev1.Node, error) {
+	return c.nodes, nil
+}
@@ -2,49 +2,79 @@ package controllers
 
 import (
 	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
 )
 
-type requestCacheClient interface {
-	Get(namespace string, name string) (*v1.Request, error)
-	UpdateStatus(*v1.Request) (*v1.Request, error)
-}
+type requestGetter func(namespace string, name string, opts metav1.GetOptions) (*v1.Request, error)
 
-func ProcessGrantDeletion(requestCacheGet func (namespace string, name string) (*v1.Request, error),
-	requestUpdateStatus func (request *v1.Request) (*v1.Request, error),
-	key string, entitlement *v1.Entitlement) error {
-	// when a grant is deleted we both need to removeNamespacedName it from the entitlement
-	// but also return corresponding requestCache to "Pending" for evaluation by the request controller
-	// (so we don't break anything if there is another license that can be used)
-
-	if entitlement.Status.Grants[key].Status == v1.GrantStatusInUse {
-		// now we need to notify the request, place it into request mode for now
-		if grant, ok := entitlement.Status.Grants[key]; ok {
-			cachedRequest, err := requestCacheGet(entitlement.Namespace, grant.Request.Name)
-			request := cachedRequest.DeepCopy()
-			if errors.IsNotFound(err) {
-				// request doesn't exist, just delete it and move on!
-				delete(entitlement.Status.Grants, key)
-				return nil
-			}
+type requestStatusUpdater func(request *v1.Request) (*v1.Request, error)
+
+// ProcessGrantDeletion removes a grant from the entitlement. When a grant is deleted, every request
+// drawing on it has its whole allocation released, including capacity on other grants, so it can be
+// allocated afresh (so we don't break anything if there is another license that can be used).
+// The affected requests are returned so they can be returned to Discover with ResetRequests once
+// the entitlement has been written.
+func ProcessGrantDeletion(key string, entitlement *v1.Entitlement) []kubernetes.NamespacedName {
+	var affected []kubernetes.NamespacedName
+	for name, ra := range entitlement.Status.Allocations {
+		if !holdsGrant(ra, key) {
+			continue
+		}
+
+		affected = append(affected, ra.Request)
+		delete(entitlement.Status.Allocations, name)
+	}
 
+	delete(entitlement.Status.Grants, key)
+	recalculate(entitlement)
+
+	return affected
+}
+
+// ResetRequests places requests back into Discover for evaluation by the request controller.
+// reason is recorded on the request's conditions, message explains it.
+func ResetRequests(requestGet requestGetter, requestUpdateStatus requestStatusUpdater,
+	requests []kubernetes.NamespacedName, reason string, message string) error {
+	for _, r := range requests {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			request, err := requestGet(r.Namespace, r.Name, metav1.GetOptions{})
 			if err != nil {
-				return err // something else went wrong, err out
+				return err
 			}
 
-			// no err here, we have a valid request
 			request.Status.Status = v1.UsageRequestStatusDiscover
 			request.Status.Grant = ""
-			request.Status.Message = "prior grant deleted"
+			request.Status.Allocations = nil
+			request.Status.Message = message
+			setRequestConditions(request, reason)
 
 			_, err = requestUpdateStatus(request)
-			if err != nil {
-				return err
-			}
+			return err
+		})
+		if errors.IsNotFound(err) {
+			// request doesn't exist, nothing to tell
+			continue
 		}
-	}
 
-	delete(entitlement.Status.Grants, key)
+		if err != nil {
+			logrus.Errorf("error resetting request %s: %s", r.String(), err.Error())
+			return err
+		}
+	}
 
 	return nil
 }
+
+func holdsGrant(ra v1.RequestAllocation, grant string) bool {
+	for _, a := range ra.Grants {
+		if a.Grant == grant {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	v1 "github.com/ebauman/klicense/api/v1"
+	license2 "github.com/ebauman/klicense/license"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxLicenseResponseSize bounds how much of an HTTP response is read when fetching licenses
+const maxLicenseResponseSize = 4 << 20
+
+// HTTPSource discovers licenses by polling an HTTP(S) URL. The response body may hold
+// a single license or a newline-delimited bundle of licenses. Grants are created in a single namespace.
+type HTTPSource struct {
+	url       string
+	namespace string
+	interval  time.Duration
+	client    *http.Client
+
+	projector *Projector
+}
+
+func NewHTTPSource(url string, namespace string, interval time.Duration) *HTTPSource {
+	return &HTTPSource{
+		url:       url,
+		namespace: namespace,
+		interval:  interval,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+func (h *HTTPSource) Register(ctx context.Context, projector *Projector) {
+	h.projector = projector
+}
+
+func (h *HTTPSource) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		h.poll(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.poll(ctx)
+			}
+		}
+	}()
+}
+
+func (h *HTTPSource) Rebuild(namespace string) error {
+	if namespace == h.namespace {
+		h.poll(context.Background())
+	}
+
+	return nil
+}
+
+func (h *HTTPSource) poll(ctx context.Context) {
+	data, err := h.fetch(ctx)
+	if err != nil {
+		// keep whatever grants we had; a flaky license server shouldn't unlicense the cluster
+		logrus.Errorf("error fetching licenses from %s: %s", h.url, err.Error())
+		return
+	}
+
+	var licenses []*license2.License
+	for _, entry := range license2.SplitBundle(data) {
+		license, err := license2.Validate(entry)
+		if err != nil {
+			logrus.Errorf("invalid license served by %s", h.url)
+			continue
+		}
+		licenses = append(licenses, license)
+	}
+
+	if err = h.projector.Project(h.source(), h.namespace, licenses); err != nil {
+		logrus.Errorf("error projecting licenses from %s: %s", h.url, err.Error())
+	}
+}
+
+func (h *HTTPSource) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxLicenseResponseSize))
+}
+
+func (h *HTTPSource) source() v1.LicenseSource {
+	return v1.LicenseSource{
+		Type:      v1.LicenseSourceHTTP,
+		Namespace: h.namespace,
+		Name:      h.url,
+	}
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// leaseExpiry returns when the request's lease lapses. ok is false if the request holds its capacity
+// without a lease, either because it has no lease duration or because it has never been renewed.
+func leaseExpiry(request *licensingv1.Request) (expiry time.Time, ok bool) {
+	if request.Spec.LeaseDurationSeconds <= 0 || request.Status.RenewTime == nil {
+		return time.Time{}, false
+	}
+
+	return request.Status.RenewTime.Add(time.Duration(request.Spec.LeaseDurationSeconds) * time.Second), true
+}
+
+// checkLease reclaims the capacity of a request whose lease has lapsed, marking the request expired.
+// A request with a live lease is checked again when the lease would lapse.
+// Returns true if the request expired.
+func (r *RequestHandler) checkLease(request *licensingv1.Request) (bool, error) {
+	expiry, ok := leaseExpiry(request)
+	if !ok {
+		return false, nil
+	}
+
+	if remaining := time.Until(expiry); remaining > 0 {
+		r.enqueueAfter(request.Namespace, request.Name, remaining)
+		return false, nil
+	}
+
+	logrus.Infof("lease of request %s/%s lapsed at %s, reclaiming its capacity",
+		request.Namespace, request.Name, expiry.Format(time.RFC3339))
+
+	// releasing changes the entitlement, which has any queued requests look again
+	_, err := r.allocator.Update(entitlementNamespace(request), request.Spec.Kind, func(entitlement *licensingv1.Entitlement) (bool, error) {
+		ra, ok := heldAllocation(entitlement, request)
+		if !ok || !heldBy(ra, request) {
+			return false, nil
+		}
+
+		return releaseGrants(entitlement, requestName(request)), nil
+	})
+	if err != nil {
+		logrus.Error(err, "error releasing grants")
+		return false, err
+	}
+
+	err = r.updateStatus(request, licensingv1.ReasonLeaseExpired, func(status *licensingv1.RequestStatus) {
+		status.Status = licensingv1.UsageRequestStatusExpired
+		status.Grant = ""
+		status.LicenseSecret = ""
+		status.License = ""
+		status.Allocations = nil
+		status.Message = fmt.Sprintf("lease expired at %s", expiry.Format(time.RFC3339))
+	})
+	if err != nil {
+		logrus.Error(err, "error updating request")
+		return false, err
+	}
+
+	return true, nil
+}
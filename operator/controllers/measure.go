@@ -0,0 +1,330 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MeasureAnnotation on an entitlement has units of it measured from the cluster, rather than trusting
+// the amounts requests report. Its value is a semicolon-separated list of unit=measure, e.g.
+// "nodes=nodes;cores=cpu;workers=pods:app=worker", where measure is one of:
+//
+//   - nodes, the number of nodes
+//   - cpu, the allocatable cpu of all nodes, in cores
+//   - memory, the allocatable memory of all nodes, in GiB
+//   - pods:<selector>, the number of running pods in any namespace matching the label selector
+const MeasureAnnotation = "licensing.cattle.io/measure"
+
+const (
+	MeasureNodes  = "nodes"
+	MeasureCPU    = "cpu"
+	MeasureMemory = "memory"
+	MeasurePods   = "pods"
+)
+
+const gib = 1 << 30
+
+// parseMeasures returns the measure of each unit in the value of a MeasureAnnotation.
+func parseMeasures(value string) (map[string]string, error) {
+	measures := map[string]string{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid measure %q, must be unit=measure", entry)
+		}
+		unit, measure := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		kind, selector := splitMeasure(measure)
+		switch kind {
+		case MeasureNodes, MeasureCPU, MeasureMemory:
+		case MeasurePods:
+			if _, err := labels.Parse(selector); err != nil {
+				return nil, fmt.Errorf("invalid pod selector in measure %q: %v", entry, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown measure %q of unit %s, must be one of %s, %s, %s or %s:<selector>",
+				measure, unit, MeasureNodes, MeasureCPU, MeasureMemory, MeasurePods)
+		}
+
+		measures[unit] = measure
+	}
+
+	return measures, nil
+}
+
+// splitMeasure splits a measure into its kind and, for pods, its selector.
+func splitMeasure(measure string) (string, string) {
+	parts := strings.SplitN(measure, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// Meter periodically measures units of entitlements from the cluster, as asked for by their
+// MeasureAnnotation, and compares them to what licenses grant. An entitlement using more than it is
+// licensed for is reported as not Compliant, with an event, and in the klicense_overage_units metric.
+// Nothing is blocked; what is measured is already running.
+type Meter struct {
+	allocator        *Allocator
+	entitlementCache v1.EntitlementCache
+	kube             clientset.Interface
+	recorder         record.EventRecorder
+	interval         time.Duration
+}
+
+func NewMeter(
+	allocator *Allocator,
+	entitlementController v1.EntitlementController,
+	kube clientset.Interface,
+	recorder record.EventRecorder,
+	interval time.Duration) *Meter {
+	return &Meter{
+		allocator:        allocator,
+		entitlementCache: entitlementController.Cache(),
+		kube:             kube,
+		recorder:         recorder,
+		interval:         interval,
+	}
+}
+
+// Start measures every interval until ctx is done. An interval of zero disables measuring.
+// Caches must have been started.
+func (m *Meter) Start(ctx context.Context) {
+	if m.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := m.Measure(ctx); err != nil {
+				logrus.Errorf("error measuring units: %s", err.Error())
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Measure measures the units of every entitlement with a MeasureAnnotation once. Entitlements that are
+// no longer measured have what was measured before cleared.
+func (m *Meter) Measure(ctx context.Context) error {
+	entitlements, err := m.entitlementCache.List("", labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	inv := &inventory{ctx: ctx, kube: m.kube, pods: map[string]int{}}
+	for _, e := range entitlements {
+		value, ok := e.Annotations[MeasureAnnotation]
+		if !ok {
+			if len(e.Status.Measured) > 0 {
+				if err := m.measureEntitlement(e, nil, inv); err != nil {
+					logrus.Errorf("error clearing measured units of entitlement %s/%s: %s", e.Namespace, e.Name, err.Error())
+				}
+			}
+			continue
+		}
+
+		measures, err := parseMeasures(value)
+		if err != nil {
+			logrus.Errorf("error parsing %s of entitlement %s/%s: %s", MeasureAnnotation, e.Namespace, e.Name, err.Error())
+			continue
+		}
+
+		if err := m.measureEntitlement(e, measures, inv); err != nil {
+			logrus.Errorf("error measuring entitlement %s/%s: %s", e.Namespace, e.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (m *Meter) measureEntitlement(entitlement *licensingv1.Entitlement, measures map[string]string, inv *inventory) error {
+	measured := map[string]int{}
+	for unit, measure := range measures {
+		amount, err := inv.measure(measure)
+		if err != nil {
+			return err
+		}
+		measured[unit] = amount
+	}
+
+	var exceeded, recovered []string
+	var dropped []string
+	updated, err := m.allocator.Update(entitlement.Namespace, entitlement.Name, func(entitlement *licensingv1.Entitlement) (bool, error) {
+		exceeded, recovered, dropped = nil, nil, nil
+
+		licensed := map[string]int{}
+		for _, g := range entitlement.Status.Grants {
+			licensed[g.Unit] += g.Amount
+		}
+
+		now := metav1.Now()
+		result := map[string]licensingv1.MeasuredUnit{}
+		for unit, amount := range measured {
+			previous := entitlement.Status.Measured[unit]
+			mu := licensingv1.MeasuredUnit{
+				Measure:  measures[unit],
+				Measured: amount,
+				Licensed: licensed[unit],
+			}
+
+			if amount > mu.Licensed {
+				mu.Overage = amount - mu.Licensed
+				mu.OverageSince = previous.OverageSince
+				if mu.OverageSince == nil {
+					mu.OverageSince = &now
+					exceeded = append(exceeded, fmt.Sprintf("%d %s measured as %s, licenses grant %d",
+						amount, unit, mu.Measure, mu.Licensed))
+				}
+			} else if previous.OverageSince != nil {
+				recovered = append(recovered, fmt.Sprintf("%d %s measured, within the %d licensed", amount, unit, mu.Licensed))
+			}
+
+			result[unit] = mu
+		}
+
+		// units that are no longer measured
+		for unit := range entitlement.Status.Measured {
+			if _, ok := result[unit]; !ok {
+				dropped = append(dropped, unit)
+			}
+		}
+		if len(result) == 0 {
+			result = nil
+		}
+
+		if equality.Semantic.DeepEqual(entitlement.Status.Measured, result) {
+			return false, nil
+		}
+
+		entitlement.Status.Measured = result
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(exceeded)
+	sort.Strings(recovered)
+	for _, message := range exceeded {
+		logrus.Warnf("entitlement %s/%s over license: %s", updated.Namespace, updated.Name, message)
+		m.recorder.Event(updated, corev1.EventTypeWarning, licensingv1.ReasonOverLicense, message)
+	}
+	for _, message := range recovered {
+		m.recorder.Event(updated, corev1.EventTypeNormal, licensingv1.ReasonWithinLicense, message)
+	}
+
+	for unit, mu := range updated.Status.Measured {
+		measuredUnits.WithLabelValues(updated.Namespace, updated.Name, unit).Set(float64(mu.Measured))
+		licensedUnits.WithLabelValues(updated.Namespace, updated.Name, unit).Set(float64(mu.Licensed))
+		overageUnits.WithLabelValues(updated.Namespace, updated.Name, unit).Set(float64(mu.Overage))
+	}
+	for _, unit := range dropped {
+		measuredUnits.DeleteLabelValues(updated.Namespace, updated.Name, unit)
+		licensedUnits.DeleteLabelValues(updated.Namespace, updated.Name, unit)
+		overageUnits.DeleteLabelValues(updated.Namespace, updated.Name, unit)
+	}
+
+	return nil
+}
+
+// inventory measures the cluster, listing each kind of object at most once per pass.
+type inventory struct {
+	ctx   context.Context
+	kube  clientset.Interface
+	nodes []corev1.Node
+	pods  map[string]int
+}
+
+func (i *inventory) measure(measure string) (int, error) {
+	kind, selector := splitMeasure(measure)
+	if kind == MeasurePods {
+		return i.countPods(selector)
+	}
+
+	nodes, err := i.listNodes()
+	if err != nil {
+		return 0, err
+	}
+
+	switch kind {
+	case MeasureNodes:
+		return len(nodes), nil
+	case MeasureCPU:
+		var millis int64
+		for _, n := range nodes {
+			millis += n.Status.Allocatable.Cpu().MilliValue()
+		}
+		return int((millis + 999) / 1000), nil
+	case MeasureMemory:
+		var bytes int64
+		for _, n := range nodes {
+			bytes += n.Status.Allocatable.Memory().Value()
+		}
+		return int((bytes + gib - 1) / gib), nil
+	}
+
+	return 0, fmt.Errorf("unknown measure %s", measure)
+}
+
+func (i *inventory) listNodes() ([]corev1.Node, error) {
+	if i.nodes != nil {
+		return i.nodes, nil
+	}
+
+	list, err := i.kube.CoreV1().Nodes().List(i.ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	i.nodes = list.Items
+	return i.nodes, nil
+}
+
+func (i *inventory) countPods(selector string) (int, error) {
+	if count, ok := i.pods[selector]; ok {
+		return count, nil
+	}
+
+	list, err := i.kube.CoreV1().Pods("").List(i.ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, p := range list.Items {
+		if p.Status.Phase != corev1.PodSucceeded && p.Status.Phase != corev1.PodFailed {
+			count++
+		}
+	}
+
+	i.pods[selector] = count
+	return count, nil
+}
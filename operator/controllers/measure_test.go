@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"context"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/record"
+	"sync"
+	"testing"
+)
+
+// TestMeasureClearsUnmeasuredEntitlements checks that removing the MeasureAnnotation of an entitlement
+// clears what was measured, its Compliant condition and its metrics.
+func TestMeasureClearsUnmeasuredEntitlements(t *testing.T) {
+	entitlement := testEntitlement(testGrant("a", "nodes", 3))
+	entitlement.Status.Measured = map[string]licensingv1.MeasuredUnit{
+		"nodes": {Measure: MeasureNodes, Measured: 5, Licensed: 3, Overage: 2},
+	}
+	setEntitlementConditions(entitlement)
+	if meta.FindStatusCondition(entitlement.Status.Conditions, licensingv1.ConditionCompliant) == nil {
+		t.Fatal("measured entitlement has no Compliant condition")
+	}
+	measuredUnits.WithLabelValues(entitlement.Namespace, entitlement.Name, "nodes").Set(5)
+	licensedUnits.WithLabelValues(entitlement.Namespace, entitlement.Name, "nodes").Set(3)
+	overageUnits.WithLabelValues(entitlement.Namespace, entitlement.Name, "nodes").Set(2)
+
+	entitlements := newFakeEntitlements(entitlement)
+	meter := &Meter{
+		allocator: &Allocator{
+			entitlementCache:  entitlements.cache(),
+			entitlementClient: entitlements,
+			locks:             map[string]*sync.Mutex{},
+		},
+		entitlementCache: entitlements.cache(),
+		recorder:         record.NewFakeRecorder(10),
+	}
+
+	if err := meter.Measure(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := entitlements.get(entitlement.Namespace, entitlement.Name)
+	if len(updated.Status.Measured) != 0 {
+		t.Errorf("measured units weren't cleared: %+v", updated.Status.Measured)
+	}
+	if meta.FindStatusCondition(updated.Status.Conditions, licensingv1.ConditionCompliant) != nil {
+		t.Error("Compliant condition wasn't removed")
+	}
+	if measuredUnits.DeleteLabelValues(entitlement.Namespace, entitlement.Name, "nodes") ||
+		licensedUnits.DeleteLabelValues(entitlement.Namespace, entitlement.Name, "nodes") ||
+		overageUnits.DeleteLabelValues(entitlement.Namespace, entitlement.Name, "nodes") {
+		t.Error("metrics of the unit weren't deleted")
+	}
+}
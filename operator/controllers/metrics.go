@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sweepsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "klicense",
+		Name:      "consistency_sweeps_total",
+		Help:      "Number of consistency sweeps run.",
+	})
+
+	repairsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "klicense",
+		Name:      "consistency_repairs_total",
+		Help:      "Number of inconsistencies repaired by consistency sweeps, by reason.",
+	}, []string{"reason"})
+
+	measuredUnits = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "klicense",
+		Name:      "measured_units",
+		Help:      "Usage of a unit of an entitlement as measured from the cluster.",
+	}, []string{"namespace", "entitlement", "unit"})
+
+	licensedUnits = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "klicense",
+		Name:      "licensed_units",
+		Help:      "Amount of a measured unit of an entitlement granted by its licenses.",
+	}, []string{"namespace", "entitlement", "unit"})
+
+	overageUnits = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "klicense",
+		Name:      "overage_units",
+		Help:      "How much more of a unit of an entitlement is measured than is licensed.",
+	}, []string{"namespace", "entitlement", "unit"})
+)
+
+func init() {
+	prometheus.MustRegister(sweepsTotal, repairsTotal, measuredUnits, licensedUnits, overageUnits)
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"time"
+)
+
+// OfferExpiredAnnotation records on a request when an offer to it went unacknowledged.
+const OfferExpiredAnnotation = "licensing.cattle.io/offer-expired"
+
+// DefaultOfferTimeout is how long a client has to acknowledge an offer before its capacity is offered
+// to someone else. Zero waits forever. The operator overrides this from its --offer-timeout flag.
+var DefaultOfferTimeout = 2 * time.Minute
+
+// offered takes back an offer the client hasn't acknowledged in time, e.g. because it crashed or couldn't
+// verify the license, so the capacity goes to the next waiting request. An offer still within its time
+// is checked again when it would run out.
+func (r *RequestHandler) offered(request *licensingv1.Request) (*licensingv1.Request, error) {
+	if DefaultOfferTimeout <= 0 || request.Status.OfferTime == nil {
+		return nil, nil
+	}
+
+	deadline := request.Status.OfferTime.Add(DefaultOfferTimeout)
+	if remaining := time.Until(deadline); remaining > 0 {
+		r.enqueueAfter(request.Namespace, request.Name, remaining)
+		return nil, nil
+	}
+
+	logrus.Infof("offer to request %s/%s was not acknowledged within %s, taking it back",
+		request.Namespace, request.Name, DefaultOfferTimeout)
+
+	// releasing changes the entitlement, which has any queued requests look again
+	_, err := r.allocator.Update(entitlementNamespace(request), request.Spec.Kind, func(entitlement *licensingv1.Entitlement) (bool, error) {
+		ra, ok := heldAllocation(entitlement, request)
+		if !ok || !heldBy(ra, request) || ra.Status != licensingv1.GrantStatusPending {
+			return false, nil
+		}
+
+		return releaseGrants(entitlement, requestName(request)), nil
+	})
+	if err != nil {
+		logrus.Error(err, "error releasing grants")
+		return nil, err
+	}
+
+	if err = r.annotateOfferExpired(request, deadline); err != nil {
+		logrus.Error(err, "error annotating request")
+		return nil, err
+	}
+
+	err = r.updateStatus(request, licensingv1.ReasonOfferExpired, func(status *licensingv1.RequestStatus) {
+		if status.Status != licensingv1.UsageRequestStatusOffer {
+			// acknowledged after all, acknowledged() takes the capacity back if it's still there
+			return
+		}
+
+		status.Status = licensingv1.UsageRequestStatusExpired
+		status.Grant = ""
+		status.LicenseSecret = ""
+		status.License = ""
+		status.Allocations = nil
+		status.OfferTime = nil
+		status.Message = fmt.Sprintf("offer was not acknowledged within %s", DefaultOfferTimeout)
+	})
+	if err != nil {
+		logrus.Error(err, "error updating request")
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (r *RequestHandler) annotateOfferExpired(request *licensingv1.Request, deadline time.Time) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := r.requestClient.Get(request.Namespace, request.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		latest = latest.DeepCopy()
+		if latest.Annotations == nil {
+			latest.Annotations = map[string]string{}
+		}
+		latest.Annotations[OfferExpiredAnnotation] = deadline.Format(time.RFC3339)
+
+		_, err = r.requestClient.Update(latest)
+		return err
+	})
+}
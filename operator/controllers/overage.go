@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"fmt"
+	v1 "github.com/ebauman/klicense/api/v1"
+	license2 "github.com/ebauman/klicense/license"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+	"time"
+)
+
+// Annotations that tighten the overage policy of a single entitlement. Overage is only allowed by the
+// policy carried in its licenses: at most percent of each grant may be allocated beyond its amount, for
+// up to days after more than is licensed was first allocated. The annotations can lower either, never
+// raise them. Zero days sets no limit of its own.
+const (
+	OveragePercentAnnotation = "licensing.cattle.io/overage-percent"
+	OverageDaysAnnotation    = "licensing.cattle.io/overage-days"
+)
+
+// OverageWarning is how long before an overage window closes that it is reported as closing.
+// The operator overrides this from its --overage-warning flag.
+var OverageWarning = 7 * 24 * time.Hour
+
+// licenseOverage returns the overage policy carried in a license, or nil if it has none.
+func licenseOverage(license *license2.License) *v1.OveragePolicy {
+	if license.Overage == nil || license.Overage.Percent <= 0 {
+		return nil
+	}
+
+	return &v1.OveragePolicy{
+		Percent: license.Overage.Percent,
+		Days:    license.Overage.Days,
+	}
+}
+
+// overagePolicy returns the overage policy of a grant: that of its license, tightened by its entitlement's
+// annotations where set.
+func overagePolicy(entitlement *v1.Entitlement, grant v1.Grant) v1.OveragePolicy {
+	var policy v1.OveragePolicy
+	if grant.OveragePolicy != nil {
+		policy = *grant.OveragePolicy
+	}
+
+	if value, ok := entitlement.Annotations[OveragePercentAnnotation]; ok {
+		if percent, err := strconv.Atoi(value); err == nil && percent >= 0 {
+			if percent < policy.Percent {
+				policy.Percent = percent
+			}
+		} else {
+			logrus.Warnf("entitlement %s/%s has invalid %s %q, must be a number of at least 0",
+				entitlement.Namespace, entitlement.Name, OveragePercentAnnotation, value)
+		}
+	}
+
+	if value, ok := entitlement.Annotations[OverageDaysAnnotation]; ok {
+		if days, err := strconv.Atoi(value); err == nil && days >= 0 {
+			// zero days is no limit, so any other limit is tighter
+			if days > 0 && (policy.Days == 0 || days < policy.Days) {
+				policy.Days = days
+			}
+		} else {
+			logrus.Warnf("entitlement %s/%s has invalid %s %q, must be a number of at least 0",
+				entitlement.Namespace, entitlement.Name, OverageDaysAnnotation, value)
+		}
+	}
+
+	return policy
+}
+
+// overageAllowance returns how much of a grant may be allocated beyond its amount.
+func overageAllowance(entitlement *v1.Entitlement, grant v1.Grant) int {
+	return grant.Amount * overagePolicy(entitlement, grant).Percent / 100
+}
+
+// overageDays returns how long the overage window of a unit lasts: the shortest window of the grants of
+// the unit that allow overage, or zero if none of them closes.
+func overageDays(entitlement *v1.Entitlement, unit string) int {
+	days := 0
+	for _, grant := range entitlement.Status.Grants {
+		if grant.Unit != unit || overageAllowance(entitlement, grant) == 0 {
+			continue
+		}
+
+		if d := overagePolicy(entitlement, grant).Days; d > 0 && (days == 0 || d < days) {
+			days = d
+		}
+	}
+
+	return days
+}
+
+// overageOpen returns true unless the overage window of a unit has closed.
+func overageOpen(entitlement *v1.Entitlement, unit string, now time.Time) bool {
+	o, ok := entitlement.Status.Overage[unit]
+	return !ok || o.Until == nil || now.Before(o.Until.Time)
+}
+
+// selectOverage picks grants of the request's unit to satisfy it with, allowing them to be allocated
+// beyond their amount as far as their overage policy allows. The part of each allocation beyond what
+// the grant licenses is recorded as its Overage. Returns nil if the request can't be satisfied even so,
+// or the overage window of the unit has closed.
+func selectOverage(entitlement *v1.Entitlement, request *v1.Request, now time.Time) []v1.Allocation {
+	if !overageOpen(entitlement, request.Spec.Unit, now) {
+		return nil
+	}
+
+	var candidates []v1.Grant
+	for _, grant := range entitlement.Status.Grants {
+		if grant.Unit != request.Spec.Unit {
+			continue
+		}
+
+		headroom := grant.Amount + overageAllowance(entitlement, grant) - grant.Allocated
+		if headroom <= 0 {
+			continue
+		}
+
+		// strategies choose by what is available, which here includes the overage
+		grant.Available = headroom
+		candidates = append(candidates, grant)
+	}
+
+	allocations := strategyFor(entitlement).Select(candidates, request.Spec.Amount)
+	for i, a := range allocations {
+		if licensed := entitlement.Status.Grants[a.Grant].Available; a.Amount > licensed {
+			allocations[i].Overage = a.Amount - licensed
+		}
+	}
+
+	return allocations
+}
+
+// overageMessage tells a request offered allocations how much of them is beyond what is licensed.
+func overageMessage(allocations []v1.Allocation, unit string) string {
+	overage := 0
+	for _, a := range allocations {
+		overage += a.Overage
+	}
+
+	if overage == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d %s offered beyond what is licensed, as allowed by the overage policy", overage, unit)
+}
+
+// covers returns true if a grant still has the capacity for an allocation made from it, counting
+// overage only if the allocation was made with it.
+func covers(entitlement *v1.Entitlement, grant v1.Grant, a v1.Allocation) bool {
+	if a.Overage == 0 {
+		return grant.Available >= a.Amount
+	}
+
+	return grant.Amount+overageAllowance(entitlement, grant)-grant.Allocated >= a.Amount
+}
+
+// trackOverage records when each unit of an entitlement went beyond what is licensed, and when its
+// overage window closes. A unit back within license keeps its window until it closes, so going over again
+// carries on in the same window rather than opening a new one. Once the window has closed, or if it never
+// does, a unit back within license is no longer tracked, and starts a new window the next time it goes over.
+func trackOverage(entitlement *v1.Entitlement, allowed map[string]int, now time.Time) {
+	overage := map[string]v1.UnitOverage{}
+	for unit, u := range entitlement.Status.Usage {
+		o, ok := entitlement.Status.Overage[unit]
+		if u.Overage == 0 && (!ok || o.Until == nil || !now.Before(o.Until.Time)) {
+			continue
+		}
+
+		if !ok {
+			o.Since = metav1.NewTime(now).Rfc3339Copy()
+			if days := overageDays(entitlement, unit); days > 0 {
+				until := metav1.NewTime(now.Add(time.Duration(days) * 24 * time.Hour)).Rfc3339Copy()
+				o.Until = &until
+			}
+		}
+
+		o.Amount = u.Overage
+		o.Allowed = allowed[unit]
+		o.Phase = overagePhase(o, now)
+		overage[unit] = o
+	}
+
+	if len(overage) == 0 {
+		overage = nil
+	}
+	entitlement.Status.Overage = overage
+}
+
+func overagePhase(o v1.UnitOverage, now time.Time) v1.OveragePhase {
+	switch {
+	case o.Until == nil:
+		return v1.OveragePhaseOpen
+	case !now.Before(o.Until.Time):
+		return v1.OveragePhaseClosed
+	case now.After(o.Until.Add(-OverageWarning)):
+		return v1.OveragePhaseClosing
+	}
+
+	return v1.OveragePhaseOpen
+}
+
+// overageReport is an event to report about the overage of a unit.
+type overageReport struct {
+	reason  string
+	message string
+}
+
+// reportOverage returns an event for every unit whose overage phase changed since it was last reported,
+// and marks the phase reported.
+func reportOverage(entitlement *v1.Entitlement) []overageReport {
+	var reports []overageReport
+	for unit, o := range entitlement.Status.Overage {
+		// a unit back within license has nothing to report until it goes over again
+		if o.Phase == o.Reported || o.Amount == 0 {
+			continue
+		}
+
+		until := "the window never closes"
+		if o.Until != nil {
+			until = "the window closes at " + o.Until.UTC().Format(time.RFC3339)
+		}
+
+		switch o.Phase {
+		case v1.OveragePhaseOpen:
+			reports = append(reports, overageReport{v1.ReasonOverageStarted,
+				fmt.Sprintf("%d %s allocated beyond what is licensed, %d allowed by the overage policy, %s",
+					o.Amount, unit, o.Allowed, until)})
+		case v1.OveragePhaseClosing:
+			reports = append(reports, overageReport{v1.ReasonOverageClosing,
+				fmt.Sprintf("%d %s allocated beyond what is licensed, %s", o.Amount, unit, until)})
+		case v1.OveragePhaseClosed:
+			reports = append(reports, overageReport{v1.ReasonOverageClosed,
+				fmt.Sprintf("%d %s allocated beyond what is licensed and the overage window has closed, "+
+					"nothing more is allocated beyond what is licensed until usage is back within license", o.Amount, unit)})
+		}
+
+		o.Reported = o.Phase
+		entitlement.Status.Overage[unit] = o
+	}
+
+	return reports
+}
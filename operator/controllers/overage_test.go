@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func withOverage(grant licensingv1.Grant, percent int, days int) licensingv1.Grant {
+	grant.OveragePolicy = &licensingv1.OveragePolicy{Percent: percent, Days: days}
+	return grant
+}
+
+func TestOveragePolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		license     *licensingv1.OveragePolicy
+		annotations map[string]string
+		expected    licensingv1.OveragePolicy
+	}{
+		{
+			name:     "the license's policy applies without annotations",
+			license:  &licensingv1.OveragePolicy{Percent: 20, Days: 30},
+			expected: licensingv1.OveragePolicy{Percent: 20, Days: 30},
+		},
+		{
+			name:        "annotations lower the license's policy",
+			license:     &licensingv1.OveragePolicy{Percent: 20, Days: 30},
+			annotations: map[string]string{OveragePercentAnnotation: "10", OverageDaysAnnotation: "7"},
+			expected:    licensingv1.OveragePolicy{Percent: 10, Days: 7},
+		},
+		{
+			name:        "annotations don't raise the license's policy",
+			license:     &licensingv1.OveragePolicy{Percent: 20, Days: 30},
+			annotations: map[string]string{OveragePercentAnnotation: "50", OverageDaysAnnotation: "60"},
+			expected:    licensingv1.OveragePolicy{Percent: 20, Days: 30},
+		},
+		{
+			name:        "annotations don't allow overage a license doesn't",
+			annotations: map[string]string{OveragePercentAnnotation: "50", OverageDaysAnnotation: "7"},
+			expected:    licensingv1.OveragePolicy{Percent: 0, Days: 7},
+		},
+		{
+			name:        "zero days doesn't remove the license's limit",
+			license:     &licensingv1.OveragePolicy{Percent: 20, Days: 30},
+			annotations: map[string]string{OverageDaysAnnotation: "0"},
+			expected:    licensingv1.OveragePolicy{Percent: 20, Days: 30},
+		},
+		{
+			name:        "days limit a license whose window never closes",
+			license:     &licensingv1.OveragePolicy{Percent: 20},
+			annotations: map[string]string{OverageDaysAnnotation: "14"},
+			expected:    licensingv1.OveragePolicy{Percent: 20, Days: 14},
+		},
+		{
+			name:        "invalid annotations are ignored",
+			license:     &licensingv1.OveragePolicy{Percent: 20, Days: 30},
+			annotations: map[string]string{OveragePercentAnnotation: "-5", OverageDaysAnnotation: "soon"},
+			expected:    licensingv1.OveragePolicy{Percent: 20, Days: 30},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grant := testGrant("a", "seats", 10)
+			grant.OveragePolicy = test.license
+			entitlement := testEntitlement(grant)
+			entitlement.Annotations = test.annotations
+
+			if policy := overagePolicy(entitlement, grant); policy != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, policy)
+			}
+		})
+	}
+}
+
+func TestSelectOverage(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		grants      []licensingv1.Grant
+		held        map[string]int
+		annotations map[string]string
+		closed      bool
+		amount      int
+		expected    map[string]int
+		overage     int
+	}{
+		{
+			name:     "grants are allocated beyond their amount as far as their policy allows",
+			grants:   []licensingv1.Grant{withOverage(testGrant("a", "seats", 10), 20, 0)},
+			held:     map[string]int{"a": 10},
+			amount:   2,
+			expected: map[string]int{"a": 2},
+			overage:  2,
+		},
+		{
+			name:     "only the part beyond what is licensed is overage",
+			grants:   []licensingv1.Grant{withOverage(testGrant("a", "seats", 10), 20, 0)},
+			held:     map[string]int{"a": 8},
+			amount:   3,
+			expected: map[string]int{"a": 3},
+			overage:  1,
+		},
+		{
+			name:   "nothing is allocated beyond what the policy allows",
+			grants: []licensingv1.Grant{withOverage(testGrant("a", "seats", 10), 20, 0)},
+			held:   map[string]int{"a": 10},
+			amount: 3,
+		},
+		{
+			name:   "grants without a policy allow no overage",
+			grants: []licensingv1.Grant{testGrant("a", "seats", 10)},
+			held:   map[string]int{"a": 10},
+			amount: 1,
+		},
+		{
+			name:        "annotations allow less overage",
+			grants:      []licensingv1.Grant{withOverage(testGrant("a", "seats", 10), 20, 0)},
+			held:        map[string]int{"a": 10},
+			annotations: map[string]string{OveragePercentAnnotation: "10"},
+			amount:      2,
+		},
+		{
+			name:        "annotations don't allow more overage",
+			grants:      []licensingv1.Grant{testGrant("a", "seats", 10)},
+			held:        map[string]int{"a": 10},
+			annotations: map[string]string{OveragePercentAnnotation: "50"},
+			amount:      1,
+		},
+		{
+			name:   "nothing is allocated beyond license once the window has closed",
+			grants: []licensingv1.Grant{withOverage(testGrant("a", "seats", 10), 20, 7)},
+			held:   map[string]int{"a": 10},
+			closed: true,
+			amount: 1,
+		},
+		{
+			name:   "grants of other units are ignored",
+			grants: []licensingv1.Grant{withOverage(testGrant("a", "cores", 10), 20, 0)},
+			amount: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var holders []holder
+			for grant, amount := range test.held {
+				holders = append(holders, holder{name: "holder-" + grant, grants: map[string]int{grant: amount}})
+			}
+			entitlement := holding(test.grants, holders...)
+			entitlement.Annotations = test.annotations
+			if test.closed {
+				until := metav1.NewTime(now.Add(-time.Hour))
+				entitlement.Status.Overage = map[string]licensingv1.UnitOverage{
+					"seats": {Until: &until, Phase: licensingv1.OveragePhaseClosed},
+				}
+			}
+
+			allocations := selectOverage(entitlement, testRequest("default", "request", "seats", test.amount), now)
+			if got := allocated(allocations); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+
+			overage := 0
+			for _, a := range allocations {
+				overage += a.Overage
+			}
+			if overage != test.overage {
+				t.Errorf("expected %d overage, got %d", test.overage, overage)
+			}
+		})
+	}
+}
+
+// TestTrackOverageFlapping checks that a unit going back within license and over again stays in the
+// overage window it opened, until the window closes.
+func TestTrackOverageFlapping(t *testing.T) {
+	start := time.Now()
+	entitlement := testEntitlement(withOverage(testGrant("a", "seats", 10), 20, 7))
+	track := func(overage int, at time.Time) (licensingv1.UnitOverage, bool) {
+		entitlement.Status.Usage = map[string]licensingv1.UnitUsage{
+			"seats": {Amount: 10, Used: 10 + overage, Overage: overage},
+		}
+		trackOverage(entitlement, map[string]int{"seats": 2}, at)
+		o, ok := entitlement.Status.Overage["seats"]
+		return o, ok
+	}
+
+	opened, ok := track(2, start)
+	if !ok || opened.Until == nil {
+		t.Fatalf("expected an overage window to open, got %+v", entitlement.Status.Overage)
+	}
+
+	steps := []struct {
+		name    string
+		overage int
+		at      time.Time
+	}{
+		{name: "back within license", overage: 0, at: start.Add(time.Hour)},
+		{name: "over again", overage: 1, at: start.Add(2 * time.Hour)},
+		{name: "back within license again", overage: 0, at: start.Add(3 * time.Hour)},
+	}
+	for _, step := range steps {
+		o, ok := track(step.overage, step.at)
+		if !ok || !o.Since.Equal(&opened.Since) || !o.Until.Equal(opened.Until) {
+			t.Errorf("%s: expected the window opened at %s to be kept, got %+v", step.name, opened.Since, o)
+		}
+		if o.Amount != step.overage {
+			t.Errorf("%s: expected overage of %d, got %d", step.name, step.overage, o.Amount)
+		}
+	}
+
+	closed := opened.Until.Add(time.Hour)
+	if o, ok := track(0, closed); ok {
+		t.Errorf("expected a unit within license to stop being tracked once its window closed, got %+v", o)
+	}
+
+	reopened, ok := track(1, closed.Add(time.Hour))
+	if !ok || !reopened.Since.After(opened.Until.Time) {
+		t.Errorf("expected going over after the window closed to open a new one, got %+v", reopened)
+	}
+}
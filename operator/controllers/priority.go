@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	"sort"
+	"strconv"
+)
+
+// PreemptionAnnotation enables ("true") or disables ("false") preemption for a single entitlement.
+const PreemptionAnnotation = "licensing.cattle.io/preemption"
+
+// DefaultPreemption is used for entitlements without the PreemptionAnnotation.
+// The operator overrides this from its --preemption flag.
+var DefaultPreemption = false
+
+func preemptionEnabled(entitlement *v1.Entitlement) bool {
+	if value, ok := entitlement.Annotations[PreemptionAnnotation]; ok {
+		if enabled, err := strconv.ParseBool(value); err == nil {
+			return enabled
+		}
+	}
+
+	return DefaultPreemption
+}
+
+// preempt evicts lower priority requests from the entitlement until the request can be satisfied.
+// Victims are taken lowest priority first, and the fewest needed are evicted. If the request can't be
+// satisfied even by evicting every lower priority request, nothing is evicted.
+// Grants in denied are never allocated to the request.
+// Returns the allocations for the request and the evicted requests.
+func preempt(entitlement *v1.Entitlement, request *v1.Request, denied map[string]bool) ([]v1.Allocation, []kubernetes.NamespacedName) {
+	var candidates []v1.RequestAllocation
+	for _, ra := range entitlement.Status.Allocations {
+		if ra.Request == requestName(request) {
+			continue
+		}
+
+		if ra.Unit != request.Spec.Unit || ra.Priority >= request.Spec.Priority {
+			continue
+		}
+
+		candidates = append(candidates, ra)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority < candidates[j].Priority
+		}
+		return candidates[i].Request.Name < candidates[j].Request.Name
+	})
+
+	// work out the victims on a copy, so nothing changes if preemption doesn't help
+	trial := entitlement.DeepCopy()
+	var victims []kubernetes.NamespacedName
+	for _, ra := range candidates {
+		releaseGrants(trial, ra.Request)
+		victims = append(victims, ra.Request)
+
+		if allocations := selectGrants(withoutGrants(trial, denied), request); allocations != nil {
+			trial.DeepCopyInto(entitlement)
+			return allocations, victims
+		}
+	}
+
+	return nil, nil
+}
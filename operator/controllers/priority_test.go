@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"reflect"
+	"testing"
+)
+
+type holder struct {
+	name     string
+	unit     string
+	priority int
+	grants   map[string]int
+}
+
+// holding returns an entitlement whose grants are held by the holders.
+func holding(grants []licensingv1.Grant, holders ...holder) *licensingv1.Entitlement {
+	entitlement := testEntitlement(grants...)
+	for _, h := range holders {
+		unit := h.unit
+		if unit == "" {
+			unit = "seats"
+		}
+
+		var allocations []licensingv1.Allocation
+		amount := 0
+		for grant, a := range h.grants {
+			allocations = append(allocations, licensingv1.Allocation{Grant: grant, Amount: a})
+			amount += a
+		}
+
+		request := testRequest("default", h.name, unit, amount)
+		request.Spec.Priority = h.priority
+		allocate(entitlement, request, licensingv1.GrantStatusInUse, allocations)
+	}
+
+	return entitlement
+}
+
+func TestPreempt(t *testing.T) {
+	tests := []struct {
+		name     string
+		grants   []licensingv1.Grant
+		holders  []holder
+		denied   map[string]bool
+		priority int
+		amount   int
+		victims  []string
+		expected map[string]int
+	}{
+		{
+			name:   "only as many requests as needed are evicted, lowest priority first",
+			grants: []licensingv1.Grant{testGrant("a", "seats", 10)},
+			holders: []holder{
+				{name: "low", priority: 0, grants: map[string]int{"a": 4}},
+				{name: "medium", priority: 1, grants: map[string]int{"a": 4}},
+				{name: "high", priority: 5, grants: map[string]int{"a": 2}},
+			},
+			priority: 3,
+			amount:   3,
+			victims:  []string{"low"},
+			expected: map[string]int{"a": 3},
+		},
+		{
+			name:   "several requests are evicted if one isn't enough",
+			grants: []licensingv1.Grant{testGrant("a", "seats", 10)},
+			holders: []holder{
+				{name: "low", priority: 0, grants: map[string]int{"a": 4}},
+				{name: "medium", priority: 1, grants: map[string]int{"a": 4}},
+				{name: "high", priority: 5, grants: map[string]int{"a": 2}},
+			},
+			priority: 3,
+			amount:   6,
+			victims:  []string{"low", "medium"},
+			expected: map[string]int{"a": 6},
+		},
+		{
+			name:   "nothing is evicted if evicting every lower priority request isn't enough",
+			grants: []licensingv1.Grant{testGrant("a", "seats", 10)},
+			holders: []holder{
+				{name: "low", priority: 0, grants: map[string]int{"a": 4}},
+				{name: "medium", priority: 1, grants: map[string]int{"a": 4}},
+				{name: "high", priority: 5, grants: map[string]int{"a": 2}},
+			},
+			priority: 3,
+			amount:   9,
+		},
+		{
+			name:   "requests of the same priority aren't evicted",
+			grants: []licensingv1.Grant{testGrant("a", "seats", 8)},
+			holders: []holder{
+				{name: "low", priority: 0, grants: map[string]int{"a": 4}},
+				{name: "same", priority: 3, grants: map[string]int{"a": 4}},
+			},
+			priority: 3,
+			amount:   5,
+		},
+		{
+			name:   "requests of other units aren't evicted",
+			grants: []licensingv1.Grant{testGrant("a", "seats", 4), testGrant("b", "cores", 4)},
+			holders: []holder{
+				{name: "cores", unit: "cores", priority: 0, grants: map[string]int{"b": 4}},
+			},
+			priority: 3,
+			amount:   1,
+		},
+		{
+			name:   "capacity of denied grants isn't offered, however much is freed",
+			grants: []licensingv1.Grant{testGrant("a", "seats", 4), testGrant("b", "seats", 4)},
+			holders: []holder{
+				{name: "low", priority: 0, grants: map[string]int{"b": 4}},
+				{name: "medium", priority: 1, grants: map[string]int{"a": 4}},
+			},
+			denied:   map[string]bool{"b": true},
+			priority: 3,
+			amount:   4,
+			victims:  []string{"low", "medium"},
+			expected: map[string]int{"a": 4},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entitlement := holding(test.grants, test.holders...)
+			original := entitlement.DeepCopy()
+
+			request := testRequest("default", "request", "seats", test.amount)
+			request.Spec.Priority = test.priority
+			allocations, victims := preempt(entitlement, request, test.denied)
+
+			var names []string
+			for _, v := range victims {
+				names = append(names, v.Name)
+			}
+			if !reflect.DeepEqual(names, test.victims) {
+				t.Errorf("expected victims %v, got %v", test.victims, names)
+			}
+			if got := allocated(allocations); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected allocations %v, got %v", test.expected, got)
+			}
+
+			if victims == nil {
+				if !reflect.DeepEqual(entitlement, original) {
+					t.Error("entitlement changed although nothing was preempted")
+				}
+				return
+			}
+
+			for _, v := range victims {
+				if _, ok := entitlement.Status.Allocations[v.Name]; ok {
+					t.Errorf("victim %s still holds capacity", v.Name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	license2 "github.com/ebauman/klicense/license"
+	cattleLicensingv1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"strings"
+	"time"
+)
+
+// Projector turns the licenses discovered by a LicenseSource into grants on Entitlements.
+// Every source feeds the same Projector, so grants look the same regardless of where the license came from.
+type Projector struct {
+	allocator         *Allocator
+	entitlementCache  cattleLicensingv1.EntitlementCache
+	requestClient     cattleLicensingv1.RequestClient
+}
+
+func NewProjector(
+	allocator *Allocator,
+	entitlementController cattleLicensingv1.EntitlementController,
+	requestController cattleLicensingv1.RequestController) *Projector {
+	return &Projector{
+		allocator:        allocator,
+		entitlementCache: entitlementController.Cache(),
+		requestClient:    requestController,
+	}
+}
+
+// Project sets the grants backed by source to exactly those in licenses.
+// Grants for licenses that are no longer present at the source are removed.
+func (p *Projector) Project(source v1.LicenseSource, namespace string, licenses []*license2.License) error {
+	for _, license := range licenses {
+		if err := p.addGrants(source, namespace, license); err != nil {
+			return err
+		}
+	}
+
+	// licenses may have been removed from the source without the source itself being deleted,
+	// so clean up any grants that still point at this source but are no longer backed by it
+	return p.pruneGrants(source, namespace, licenses)
+}
+
+// Remove removes every grant backed by source.
+func (p *Projector) Remove(source v1.LicenseSource, namespace string) error {
+	return p.Project(source, namespace, nil)
+}
+
+func (p *Projector) addGrants(source v1.LicenseSource, namespace string, license *license2.License) error {
+	if license.NotAfter.Before(time.Now()) || license.NotBefore.After(time.Now()) {
+		// license is expired, don't add it to the entitlement.
+		logrus.Infof("license %s expired or not yet valid", license.Id)
+		return nil
+	}
+
+	// if we have a valid license at this point, convert its contents into grants
+	for k, v := range license.Grants {
+		// first, make sure there is an entitlement in the cluster
+		var url = strings.Split(k, "/")
+		if err := p.allocator.Ensure(namespace, url[0]); err != nil {
+			logrus.Errorf("error creating entitlement: %s", err.Error())
+			return err
+		}
+
+		grant := v1.Grant{
+			Amount:    v,
+			Id:        license.Id,
+			Unit:      url[1],
+			Status:    v1.GrantStatusFree,
+			NotBefore: metav1.NewTime(license.NotBefore),
+			NotAfter:  metav1.NewTime(license.NotAfter),
+			Source:    source,
+			License:   license.Raw,
+			// the grant's amount isn't the limit if the license allows overage
+			OveragePolicy: licenseOverage(license),
+			Constraints:   license.Constraints,
+		}
+		if source.Type == v1.LicenseSourceSecret {
+			grant.LicenseSecret = kubernetes.NamespacedName{
+				Name:      source.Name,
+				Namespace: source.Namespace,
+			}
+		}
+
+		_, err := p.allocator.Update(namespace, url[0], func(entitlement *v1.Entitlement) (bool, error) {
+			if entitlement.Status.Grants == nil {
+				entitlement.Status.Grants = make(map[string]v1.Grant, 0)
+			}
+			entitlement.Status.Grants[license.Id] = grant
+			// capacity already allocated from this grant is kept, since allocations are recorded separately
+			recalculate(entitlement)
+			return true, nil
+		})
+		if err != nil {
+			logrus.Errorf("error updating entitlement status: %s", err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Projector) pruneGrants(source v1.LicenseSource, namespace string, licenses []*license2.License) error {
+	current := map[string]bool{}
+	for _, l := range licenses {
+		current[l.Id] = true
+	}
+
+	entitlements, err := p.entitlementCache.List(namespace, labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, cachedEntitlement := range entitlements {
+		var affected []kubernetes.NamespacedName
+		_, err = p.allocator.Update(namespace, cachedEntitlement.Name, func(entitlement *v1.Entitlement) (bool, error) {
+			affected = nil
+			changed := false
+			for id, grant := range entitlement.Status.Grants {
+				if GrantSource(grant) != source {
+					continue
+				}
+
+				if current[id] {
+					continue
+				}
+
+				affected = append(affected, ProcessGrantDeletion(id, entitlement)...)
+				changed = true
+			}
+
+			return changed, nil
+		})
+		if err != nil {
+			logrus.Errorf("error updating entitlement: %s", err.Error())
+			return err
+		}
+
+		if err = ResetRequests(p.requestClient.Get, p.requestClient.UpdateStatus, affected, v1.ReasonGrantDeleted, "prior grant deleted"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GrantSource returns the source of a grant. Grants created before sources were
+// recorded only carry the license secret.
+func GrantSource(grant v1.Grant) v1.LicenseSource {
+	if grant.Source.Type != "" {
+		return grant.Source
+	}
+
+	return v1.LicenseSource{
+		Type:      v1.LicenseSourceSecret,
+		Namespace: grant.LicenseSecret.Namespace,
+		Name:      grant.LicenseSecret.Name,
+	}
+}
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"fmt"
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"time"
+)
+
+// joinQueue places the request in the entitlement's wait queue, or updates its entry if it is already queued.
+// Requests are served highest priority first, then in the order they joined. Returns true if the queue changed.
+func joinQueue(entitlement *v1.Entitlement, request *v1.Request, now time.Time) bool {
+	entry := v1.QueuedRequest{
+		Request:    requestName(request),
+		RequestUID: request.UID,
+		Unit:       request.Spec.Unit,
+		Amount:     request.Spec.Amount,
+		Priority:   request.Spec.Priority,
+		Since:      metav1.NewTime(now),
+	}
+
+	for i, q := range entitlement.Status.Queue {
+		if q.Request != entry.Request {
+			continue
+		}
+
+		// keep our place in the queue unless this is a different request of the same name
+		if q.RequestUID == request.UID {
+			entry.Since = q.Since
+		}
+
+		if q == entry {
+			return false
+		}
+
+		entitlement.Status.Queue[i] = entry
+		sortQueue(entitlement)
+		return true
+	}
+
+	entitlement.Status.Queue = append(entitlement.Status.Queue, entry)
+	sortQueue(entitlement)
+	return true
+}
+
+// leaveQueue removes the request from the entitlement's wait queue. Returns true if it was queued.
+func leaveQueue(entitlement *v1.Entitlement, request kubernetes.NamespacedName) bool {
+	for i, q := range entitlement.Status.Queue {
+		if q.Request == request {
+			entitlement.Status.Queue = append(entitlement.Status.Queue[:i], entitlement.Status.Queue[i+1:]...)
+			entitlement.Status.Waiting = len(entitlement.Status.Queue)
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortQueue(entitlement *v1.Entitlement) {
+	queue := entitlement.Status.Queue
+	sort.SliceStable(queue, func(i, j int) bool {
+		if queue[i].Priority != queue[j].Priority {
+			return queue[i].Priority > queue[j].Priority
+		}
+		if !queue[i].Since.Equal(&queue[j].Since) {
+			return queue[i].Since.Before(&queue[j].Since)
+		}
+		if queue[i].Request.Name != queue[j].Request.Name {
+			return queue[i].Request.Name < queue[j].Request.Name
+		}
+		return queue[i].Request.Namespace < queue[j].Request.Namespace
+	})
+	entitlement.Status.Waiting = len(queue)
+}
+
+// queuePosition returns the place of the request in the queue for its unit, starting at 1, or 0 if it isn't queued.
+func queuePosition(entitlement *v1.Entitlement, request *v1.Request) int {
+	position := 0
+	for _, q := range entitlement.Status.Queue {
+		if q.Unit != request.Spec.Unit {
+			continue
+		}
+
+		position++
+		if q.Request == requestName(request) {
+			return position
+		}
+	}
+
+	return 0
+}
+
+// serveQueue allocates capacity to the requests queued ahead of request, in order. A request at the head of
+// the queue that can't be served yet blocks those behind it, so that small requests can't starve large ones,
+// unless it asks for more than the entitlement holds and could never be served.
+// admit returns the view of the entitlement a queued request may be allocated from, leaving out grants whose
+// constraints don't hold for it, or nil if it may not be served at all, e.g. as that would exceed its quota;
+// such a request doesn't block the queue.
+// Returns the requests that were served, and whether request itself is blocked.
+func serveQueue(entitlement *v1.Entitlement, request *v1.Request,
+	admit func(*v1.Entitlement, *v1.Request) *v1.Entitlement) ([]*v1.Request, bool) {
+	var served []*v1.Request
+
+	// allocating changes the queue, so walk a copy of it
+	queue := append([]v1.QueuedRequest{}, entitlement.Status.Queue...)
+	for _, q := range queue {
+		if q.Unit != request.Spec.Unit {
+			continue
+		}
+
+		if q.Request == requestName(request) {
+			break
+		}
+
+		ahead := queuedRequest(q)
+		allowed := admit(entitlement, ahead)
+		if allowed == nil {
+			continue
+		}
+
+		// a request that holds capacity and is waiting for more was queued for the difference
+		if ra, ok := heldAllocation(entitlement, ahead); ok && heldBy(ra, ahead) && ra.Unit == ahead.Spec.Unit {
+			grown := ahead.DeepCopy()
+			grown.Spec.Amount += ra.Amount
+			if resize(entitlement, allowed, grown, ra) != nil {
+				served = append(served, grown)
+				continue
+			}
+		} else if allocations := selectGrants(allowed, ahead); allocations != nil {
+			allocate(entitlement, ahead, v1.GrantStatusPending, allocations)
+			served = append(served, ahead)
+			continue
+		}
+
+		if q.Amount <= entitlement.Status.Usage[q.Unit].Amount {
+			return served, true
+		}
+	}
+
+	return served, false
+}
+
+// queuedRequest rebuilds enough of a request from its queue entry to allocate for it.
+func queuedRequest(q v1.QueuedRequest) *v1.Request {
+	request := &v1.Request{}
+	request.Name = q.Request.Name
+	request.Namespace = q.Request.Namespace
+	request.UID = q.RequestUID
+	request.Spec.Unit = q.Unit
+	request.Spec.Amount = q.Amount
+	request.Spec.Priority = q.Priority
+
+	return request
+}
+
+// waitingMessage explains why a queued request is waiting.
+func waitingMessage(entitlement *v1.Entitlement, request *v1.Request, position int, blocked bool) string {
+	usage := entitlement.Status.Usage[request.Spec.Unit]
+	switch {
+	case request.Spec.Amount > usage.Amount:
+		return fmt.Sprintf("queued at position %d: requested %d %s but only %d are licensed",
+			position, request.Spec.Amount, request.Spec.Unit, usage.Amount)
+	case blocked:
+		return fmt.Sprintf("queued at position %d: waiting for requests ahead in the queue to be served", position)
+	default:
+		return fmt.Sprintf("queued at position %d: requested %d %s, %d of %d available",
+			position, request.Spec.Amount, request.Spec.Unit, usage.Available, usage.Amount)
+	}
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type queued struct {
+	name     string
+	unit     string
+	amount   int
+	priority int
+}
+
+func TestServeQueue(t *testing.T) {
+	admitAll := func(entitlement *licensingv1.Entitlement, request *licensingv1.Request) *licensingv1.Entitlement {
+		return entitlement
+	}
+
+	tests := []struct {
+		name    string
+		held    int
+		queue   []queued
+		admit   func(*licensingv1.Entitlement, *licensingv1.Request) *licensingv1.Entitlement
+		served  []string
+		blocked bool
+	}{
+		{
+			name:   "requests ahead are served in order",
+			queue:  []queued{{name: "q1", amount: 3}, {name: "q2", amount: 4}, {name: "request", amount: 2}},
+			served: []string{"q1", "q2"},
+		},
+		{
+			name:   "requests behind aren't served",
+			queue:  []queued{{name: "request", amount: 2}, {name: "q1", amount: 3}},
+			served: nil,
+		},
+		{
+			name:   "higher priority requests are ahead, however late they joined",
+			held:   6,
+			queue:  []queued{{name: "q1", amount: 3}, {name: "request", amount: 2}, {name: "q2", amount: 4, priority: 1}},
+			served: []string{"q2"},
+			// q1 can't be served with what q2 left, so the request waits behind it
+			blocked: true,
+		},
+		{
+			name:    "a request ahead that can't be served yet blocks the queue",
+			held:    8,
+			queue:   []queued{{name: "q1", amount: 5}, {name: "request", amount: 1}},
+			served:  nil,
+			blocked: true,
+		},
+		{
+			name:   "a request ahead that could never be served doesn't block the queue",
+			queue:  []queued{{name: "q1", amount: 20}, {name: "request", amount: 1}},
+			served: nil,
+		},
+		{
+			name:  "a request ahead that isn't admitted doesn't block the queue",
+			held:  8,
+			queue: []queued{{name: "q1", amount: 5}, {name: "request", amount: 1}},
+			admit: func(entitlement *licensingv1.Entitlement, request *licensingv1.Request) *licensingv1.Entitlement {
+				if request.Name == "q1" {
+					return nil
+				}
+				return entitlement
+			},
+			served: nil,
+		},
+		{
+			name:   "a queued request holding capacity is served the difference",
+			held:   8,
+			queue:  []queued{{name: "holder", amount: 2}, {name: "request", amount: 1}},
+			served: []string{"holder"},
+		},
+		{
+			name:    "a queued request holding capacity waits for the difference",
+			held:    8,
+			queue:   []queued{{name: "holder", amount: 3}, {name: "request", amount: 1}},
+			served:  nil,
+			blocked: true,
+		},
+		{
+			name:   "requests for other units are left alone",
+			held:   8,
+			queue:  []queued{{name: "q1", unit: "cores", amount: 5}, {name: "request", amount: 1}},
+			served: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entitlement := testEntitlement(testGrant("a", "seats", 10), testGrant("c", "cores", 1))
+			if test.held > 0 {
+				entitlement = holding([]licensingv1.Grant{testGrant("a", "seats", 10), testGrant("c", "cores", 1)},
+					holder{name: "holder", grants: map[string]int{"a": test.held}})
+			}
+
+			var request *licensingv1.Request
+			joined := time.Now()
+			for i, q := range test.queue {
+				unit := q.unit
+				if unit == "" {
+					unit = "seats"
+				}
+
+				r := testRequest("default", q.name, unit, q.amount)
+				r.Spec.Priority = q.priority
+				joinQueue(entitlement, r, joined.Add(time.Duration(i)*time.Second))
+				if q.name == "request" {
+					request = r
+				}
+			}
+
+			admit := test.admit
+			if admit == nil {
+				admit = admitAll
+			}
+
+			served, blocked := serveQueue(entitlement, request, admit)
+
+			var names []string
+			for _, s := range served {
+				names = append(names, s.Name)
+				if _, ok := entitlement.Status.Allocations[s.Name]; !ok {
+					t.Errorf("served request %s holds nothing", s.Name)
+				}
+				if queuePosition(entitlement, s) != 0 {
+					t.Errorf("served request %s is still queued", s.Name)
+				}
+			}
+			if !reflect.DeepEqual(names, test.served) {
+				t.Errorf("expected %v to be served, got %v", test.served, names)
+			}
+			if blocked != test.blocked {
+				t.Errorf("expected blocked to be %t", test.blocked)
+			}
+		})
+	}
+}
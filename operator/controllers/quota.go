@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	"github.com/rancher/wrangler/pkg/relatedresource"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	"sort"
+)
+
+// QuotaChecker enforces LicenseQuotas: the requests a quota applies to may together hold no more of a unit
+// than the quota allows, whichever namespace the entitlement they draw on is in.
+type QuotaChecker struct {
+	listQuotas func(namespace string) ([]*licensingv1.LicenseQuota, error)
+	getRequest func(namespace string, name string) (*licensingv1.Request, error)
+}
+
+// NewQuotaChecker checks quotas straight from the api server, for use where caches may not have been
+// started, e.g. in webhooks.
+func NewQuotaChecker(quotaClient v1.LicenseQuotaClient, requestClient v1.RequestClient) *QuotaChecker {
+	return &QuotaChecker{
+		listQuotas: func(namespace string) ([]*licensingv1.LicenseQuota, error) {
+			list, err := quotaClient.List(namespace, metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+
+			quotas := make([]*licensingv1.LicenseQuota, 0, len(list.Items))
+			for i := range list.Items {
+				quotas = append(quotas, &list.Items[i])
+			}
+			return quotas, nil
+		},
+		getRequest: func(namespace string, name string) (*licensingv1.Request, error) {
+			return requestClient.Get(namespace, name, metav1.GetOptions{})
+		},
+	}
+}
+
+func newCachedQuotaChecker(quotaCache v1.LicenseQuotaCache, requestCache v1.RequestCache) *QuotaChecker {
+	return &QuotaChecker{
+		listQuotas: func(namespace string) ([]*licensingv1.LicenseQuota, error) {
+			return quotaCache.List(namespace, labels.Everything())
+		},
+		getRequest: requestCache.Get,
+	}
+}
+
+// Exceeded returns why the request may not be allocated the capacity it asks for without exceeding a quota
+// of its namespace, or an empty string if it may. What the request itself holds doesn't count, as
+// allocating replaces it.
+func (c *QuotaChecker) Exceeded(entitlement *licensingv1.Entitlement, request *licensingv1.Request) (string, error) {
+	quotas, err := c.listQuotas(request.Namespace)
+	if err != nil {
+		return "", err
+	}
+	sortQuotas(quotas)
+
+	for _, quota := range quotas {
+		hard, ok := quota.Spec.Hard[request.Spec.Unit]
+		if !ok || quota.Spec.Kind != entitlement.Name || !quota.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		selector, err := quotaSelector(quota)
+		if err != nil {
+			logrus.Warnf("ignoring quota %s/%s: %v", quota.Namespace, quota.Name, err)
+			continue
+		}
+		if !selector.Matches(labels.Set(request.Labels)) {
+			continue
+		}
+
+		used := c.used(entitlement, quota, selector, request)[request.Spec.Unit]
+		if used+request.Spec.Amount > hard {
+			return fmt.Sprintf("quota %s allows %d %s, %d are held and %d requested",
+				quota.Name, hard, request.Spec.Unit, used, request.Spec.Amount), nil
+		}
+	}
+
+	return "", nil
+}
+
+// used returns how much of the quota's unit the requests it applies to hold of the entitlement, leaving
+// out the request given, if any.
+func (c *QuotaChecker) used(entitlement *licensingv1.Entitlement, quota *licensingv1.LicenseQuota,
+	selector labels.Selector, request *licensingv1.Request) map[string]int {
+	used := map[string]int{}
+	for _, ra := range entitlement.Status.Allocations {
+		if ra.Request.Namespace != quota.Namespace {
+			continue
+		}
+		if _, ok := quota.Spec.Hard[ra.Unit]; !ok {
+			continue
+		}
+		if request != nil && ra.Request == requestName(request) {
+			continue
+		}
+
+		if !selector.Empty() {
+			held, err := c.getRequest(ra.Request.Namespace, ra.Request.Name)
+			if err != nil || !selector.Matches(labels.Set(held.Labels)) {
+				continue
+			}
+		}
+
+		used[ra.Unit] += ra.Amount
+	}
+
+	return used
+}
+
+// QuotaHandler keeps the status of LicenseQuotas up to date with what the requests they apply to hold,
+// and has waiting requests of their namespace look again when a quota changes.
+type QuotaHandler struct {
+	checker          *QuotaChecker
+	resolver         *EntitlementResolver
+	enqueue          func(namespace string, name string)
+	entitlementCache v1.EntitlementCache
+	quotaClient      v1.LicenseQuotaClient
+	requestCache     v1.RequestCache
+}
+
+func (h *QuotaHandler) OnQuotaChanged(key string, quota *licensingv1.LicenseQuota) (*licensingv1.LicenseQuota, error) {
+	if quota == nil || !quota.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	used, err := h.used(quota)
+	if err != nil {
+		return nil, err
+	}
+
+	// a quota that was raised may let waiting requests through
+	if quota.Generation != quota.Status.ObservedGeneration {
+		if err := h.requeue(quota); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := h.quotaClient.Get(quota.Namespace, quota.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		updated := latest.DeepCopy()
+		updated.Status.Hard = latest.Spec.Hard
+		updated.Status.Used = used
+		updated.Status.ObservedGeneration = updated.Generation
+
+		if equality.Semantic.DeepEqual(latest.Status, updated.Status) {
+			return nil
+		}
+
+		_, err = h.quotaClient.UpdateStatus(updated)
+		return err
+	})
+}
+
+// used returns how much of each unit of the quota the requests it applies to hold. Every unit of the quota
+// is reported, even if nothing of it is held.
+func (h *QuotaHandler) used(quota *licensingv1.LicenseQuota) (map[string]int, error) {
+	used := map[string]int{}
+	for unit := range quota.Spec.Hard {
+		used[unit] = 0
+	}
+
+	selector, err := quotaSelector(quota)
+	if err != nil {
+		logrus.Warnf("ignoring quota %s/%s: %v", quota.Namespace, quota.Name, err)
+		return used, nil
+	}
+
+	namespace, err := h.resolver.Resolve(quota.Namespace, quota.Spec.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	entitlement, err := h.entitlementCache.Get(namespace, quota.Spec.Kind)
+	if errors.IsNotFound(err) {
+		// no entitlement, so nothing is held
+		return used, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for unit, amount := range h.checker.used(entitlement, quota, selector, nil) {
+		used[unit] = amount
+	}
+
+	return used, nil
+}
+
+// requeue has the waiting requests the quota may apply to look for capacity again.
+func (h *QuotaHandler) requeue(quota *licensingv1.LicenseQuota) error {
+	requests, err := h.requestCache.List(quota.Namespace, labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, request := range requests {
+		if request.Spec.Kind == quota.Spec.Kind && request.Status.Status == licensingv1.UsageRequestStatusDiscover {
+			h.enqueue(request.Namespace, request.Name)
+		}
+	}
+
+	return nil
+}
+
+// resolveQuotas has the quotas for an entitlement look again when it changes, as what the requests they
+// apply to hold may have changed. Quotas of any namespace may apply, as entitlements can be bound to others.
+func resolveQuotas(quotaCache v1.LicenseQuotaCache) relatedresource.Resolver {
+	return func(namespace string, name string, obj runtime.Object) ([]relatedresource.Key, error) {
+		quotas, err := quotaCache.List("", labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []relatedresource.Key
+		for _, q := range quotas {
+			if q.Spec.Kind == name {
+				keys = append(keys, relatedresource.Key{Namespace: q.Namespace, Name: q.Name})
+			}
+		}
+		return keys, nil
+	}
+}
+
+// quotaSelector returns the selector of the requests a quota applies to, everything if it has none.
+func quotaSelector(quota *licensingv1.LicenseQuota) (labels.Selector, error) {
+	if quota.Spec.Selector == nil {
+		return labels.Everything(), nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(quota.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %v", err)
+	}
+
+	return selector, nil
+}
+
+func sortQuotas(quotas []*licensingv1.LicenseQuota) {
+	sort.Slice(quotas, func(i, j int) bool {
+		return quotas[i].Name < quotas[j].Name
+	})
+}
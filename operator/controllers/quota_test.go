@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func testQuota(name string, kind string, hard map[string]int, selector map[string]string) *licensingv1.LicenseQuota {
+	quota := &licensingv1.LicenseQuota{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+	}
+	quota.Spec.Kind = kind
+	quota.Spec.Hard = hard
+	if selector != nil {
+		quota.Spec.Selector = &metav1.LabelSelector{MatchLabels: selector}
+	}
+
+	return quota
+}
+
+func TestQuotaChecker(t *testing.T) {
+	team := map[string]string{"team": "a"}
+
+	// held by each request, and the labels of the request
+	type held struct {
+		namespace string
+		name      string
+		amount    int
+		labels    map[string]string
+	}
+
+	tests := []struct {
+		name     string
+		quotas   []*licensingv1.LicenseQuota
+		held     []held
+		amount   int
+		labels   map[string]string
+		exceeded bool
+	}{
+		{
+			name:   "requests without a quota aren't limited",
+			held:   []held{{name: "one", amount: 8}},
+			amount: 2,
+		},
+		{
+			name:   "what the namespace holds and the request asks for may reach the quota",
+			quotas: []*licensingv1.LicenseQuota{testQuota("seats", testKind, map[string]int{"seats": 5}, nil)},
+			held:   []held{{name: "one", amount: 3}},
+			amount: 2,
+		},
+		{
+			name:     "what the namespace holds and the request asks for may not exceed the quota",
+			quotas:   []*licensingv1.LicenseQuota{testQuota("seats", testKind, map[string]int{"seats": 5}, nil)},
+			held:     []held{{name: "one", amount: 3}},
+			amount:   3,
+			exceeded: true,
+		},
+		{
+			name:   "what the request itself holds doesn't count",
+			quotas: []*licensingv1.LicenseQuota{testQuota("seats", testKind, map[string]int{"seats": 5}, nil)},
+			held:   []held{{name: "request", amount: 4}},
+			amount: 5,
+		},
+		{
+			name:   "what other namespaces hold doesn't count",
+			quotas: []*licensingv1.LicenseQuota{testQuota("seats", testKind, map[string]int{"seats": 5}, nil)},
+			held:   []held{{namespace: "other", name: "one", amount: 4}},
+			amount: 5,
+		},
+		{
+			name:   "quotas of other entitlements don't apply",
+			quotas: []*licensingv1.LicenseQuota{testQuota("seats", "other.example.com", map[string]int{"seats": 1}, nil)},
+			amount: 5,
+		},
+		{
+			name:   "quotas of other units don't apply",
+			quotas: []*licensingv1.LicenseQuota{testQuota("cores", testKind, map[string]int{"cores": 1}, nil)},
+			amount: 5,
+		},
+		{
+			name:   "quotas with a selector don't apply to requests it doesn't select",
+			quotas: []*licensingv1.LicenseQuota{testQuota("team", testKind, map[string]int{"seats": 1}, team)},
+			amount: 5,
+		},
+		{
+			name:     "quotas with a selector only count what the requests they select hold",
+			quotas:   []*licensingv1.LicenseQuota{testQuota("team", testKind, map[string]int{"seats": 5}, team)},
+			held:     []held{{name: "one", amount: 3, labels: team}, {name: "two", amount: 6}},
+			amount:   3,
+			labels:   team,
+			exceeded: true,
+		},
+		{
+			name: "every quota that applies has to allow the request",
+			quotas: []*licensingv1.LicenseQuota{
+				testQuota("namespace", testKind, map[string]int{"seats": 20}, nil),
+				testQuota("team", testKind, map[string]int{"seats": 2}, team),
+			},
+			amount:   3,
+			labels:   team,
+			exceeded: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entitlement := testEntitlement(testGrant("a", "seats", 20), testGrant("b", "cores", 20))
+
+			var requests []*licensingv1.Request
+			for _, h := range test.held {
+				namespace := h.namespace
+				if namespace == "" {
+					namespace = "default"
+				}
+
+				request := testRequest(namespace, h.name, "seats", h.amount)
+				request.Labels = h.labels
+				allocate(entitlement, request, licensingv1.GrantStatusInUse,
+					[]licensingv1.Allocation{{Grant: "a", Amount: h.amount}})
+				requests = append(requests, request)
+			}
+
+			checker := newCachedQuotaChecker(&fakeQuotaCache{quotas: test.quotas}, newFakeRequests(requests...).cache())
+
+			request := testRequest("default", "request", "seats", test.amount)
+			request.Labels = test.labels
+			quota, err := checker.Exceeded(entitlement, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (quota != "") != test.exceeded {
+				t.Errorf("expected exceeded to be %t, got %q", test.exceeded, quota)
+			}
+		})
+	}
+}
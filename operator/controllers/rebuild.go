@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	wranglerCore "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+	"sync"
+)
+
+// Rebuilder treats entitlements as derived state: it recreates them from every license source,
+// then restores the allocations of requests that were offered or hold capacity.
+type Rebuilder struct {
+	sources       []LicenseSource
+	allocator     *Allocator
+	requestCache  v1.RequestCache
+	requestClient v1.RequestClient
+	// one rebuild at a time
+	mu sync.Mutex
+}
+
+func NewRebuilder(sources []LicenseSource, allocator *Allocator, requestController v1.RequestController) *Rebuilder {
+	return &Rebuilder{
+		sources:       sources,
+		allocator:     allocator,
+		requestCache:  requestController.Cache(),
+		requestClient: requestController,
+	}
+}
+
+// Rebuild recreates the entitlements of a namespace from its licenses, and restores the allocations
+// recorded on the requests drawing on them, including those of namespaces bound to them. Requests whose
+// capacity can't be restored go back to discover.
+func (r *Rebuilder) Rebuild(namespace string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	logrus.Infof("rebuilding entitlements in namespace %s", namespace)
+
+	for _, s := range r.sources {
+		if err := s.Rebuild(namespace); err != nil {
+			return err
+		}
+	}
+
+	return r.restoreAllocations(namespace)
+}
+
+func (r *Rebuilder) restoreAllocations(namespace string) error {
+	requests, err := r.requestCache.List("", labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	var lost []kubernetes.NamespacedName
+	for _, request := range requests {
+		if !request.DeletionTimestamp.IsZero() || entitlementNamespace(request) != namespace {
+			continue
+		}
+
+		var status licensingv1.GrantStatus
+		switch request.Status.Status {
+		case licensingv1.UsageRequestStatusOffer:
+			status = licensingv1.GrantStatusPending
+		case licensingv1.UsageRequestStatusAcknowledged:
+			status = licensingv1.GrantStatusInUse
+		default:
+			continue
+		}
+
+		restored := false
+		_, err := r.allocator.Update(namespace, request.Spec.Kind, func(entitlement *licensingv1.Entitlement) (bool, error) {
+			restored = false
+			if ra, ok := heldAllocation(entitlement, request); ok && heldBy(ra, request) {
+				restored = true
+				return false, nil
+			}
+
+			allocations := requestAllocations(request)
+			for _, a := range allocations {
+				grant, ok := entitlement.Status.Grants[a.Grant]
+				if !ok || !covers(entitlement, grant, a) {
+					return false, nil
+				}
+			}
+
+			allocate(entitlement, request, status, allocations)
+			restored = true
+			return true, nil
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		if !restored {
+			lost = append(lost, requestName(request))
+		}
+	}
+
+	return ResetRequests(r.requestClient.Get, r.requestClient.UpdateStatus, lost, licensingv1.ReasonAllocationLost,
+		"allocation lost when entitlement was rebuilt")
+}
+
+// NamespaceHandler rebuilds the entitlements of namespaces annotated with licensingv1.RebuildAnnotation.
+type NamespaceHandler struct {
+	rebuilder       *Rebuilder
+	namespaceClient wranglerCore.NamespaceClient
+}
+
+func (h *NamespaceHandler) OnNamespaceChanged(key string, namespace *corev1.Namespace) (*corev1.Namespace, error) {
+	if namespace == nil || !namespace.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	requested, ok := namespace.Annotations[licensingv1.RebuildAnnotation]
+	if !ok || namespace.Annotations[licensingv1.RebuiltAnnotation] == requested {
+		return nil, nil
+	}
+
+	if err := h.rebuilder.Rebuild(namespace.Name); err != nil {
+		logrus.Errorf("error rebuilding entitlements in namespace %s: %s", namespace.Name, err.Error())
+		return nil, err
+	}
+
+	// let whoever asked know we're done
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := h.namespaceClient.Get(namespace.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		latest = latest.DeepCopy()
+		if latest.Annotations == nil {
+			latest.Annotations = map[string]string{}
+		}
+		latest.Annotations[licensingv1.RebuiltAnnotation] = requested
+		_, err = h.namespaceClient.Update(latest)
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("error annotating namespace %s: %s", namespace.Name, err.Error())
+		return nil, err
+	}
+
+	return nil, nil
+}
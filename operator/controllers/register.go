@@ -2,31 +2,133 @@ package controllers
 
 import (
 	"context"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
 	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	"github.com/ebauman/klicense/remove"
+	wranglerApps "github.com/rancher/wrangler-api/pkg/generated/controllers/apps/v1"
 	wranglerCore "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	"github.com/rancher/wrangler/pkg/relatedresource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 )
 
 func Register(
 	ctx context.Context,
+	allocator *Allocator,
+	rebuilder *Rebuilder,
 	entitlementController v1.EntitlementController,
 	requestController v1.RequestController,
-	secretController wranglerCore.SecretController) {
+	bindingController v1.EntitlementBindingController,
+	quotaController v1.LicenseQuotaController,
+	secretController wranglerCore.SecretController,
+	configMapCache wranglerCore.ConfigMapCache,
+	namespaceController wranglerCore.NamespaceController,
+	podClient wranglerCore.PodClient,
+	nodeCache wranglerCore.NodeCache,
+	deploymentController wranglerApps.DeploymentController,
+	statefulSetController wranglerApps.StatefulSetController,
+	recorder record.EventRecorder) {
 
 	entitlementHandler := &EntitlementHandler{
+		allocator:         allocator,
+		namespaceClient:   namespaceController,
+		enqueue:           requestController.Enqueue,
+		enqueueAfter:      entitlementController.EnqueueAfter,
 		entitlementClient: entitlementController,
 		entitlementCache:  entitlementController.Cache(),
 		requestClient:     requestController,
 		requestCache:      requestController.Cache(),
 		secretCache:       secretController.Cache(),
+		configMapCache:    configMapCache,
+		recorder:          recorder,
 	}
 
+	resolver := newCachedResolver(entitlementController.Cache(), bindingController.Cache(), namespaceController.Cache())
+
+	quotas := newCachedQuotaChecker(quotaController.Cache(), requestController.Cache())
+
 	requestHandler := &RequestHandler{
+		allocator:         allocator,
+		enqueue:           requestController.Enqueue,
+		enqueueAfter:      requestController.EnqueueAfter,
 		requestCache:      requestController.Cache(),
 		requestClient:     requestController,
 		entitlementCache:  entitlementController.Cache(),
 		entitlementClient: entitlementController,
+		constraints: &ConstraintChecker{
+			namespaceCache: namespaceController.Cache(),
+			nodeCache:      nodeCache,
+		},
+		quotas:   quotas,
+		resolver: resolver,
+	}
+
+	bindingHandler := &BindingHandler{
+		resolver:       resolver,
+		enqueue:        requestController.Enqueue,
+		bindingClient:  bindingController,
+		namespaceCache: namespaceController.Cache(),
+		requestCache:   requestController.Cache(),
+		requestClient:  requestController,
+	}
+
+	quotaHandler := &QuotaHandler{
+		checker:          quotas,
+		resolver:         resolver,
+		enqueue:          requestController.Enqueue,
+		entitlementCache: entitlementController.Cache(),
+		quotaClient:      quotaController,
+		requestCache:     requestController.Cache(),
+	}
+
+	namespaceHandler := &NamespaceHandler{
+		rebuilder:       rebuilder,
+		namespaceClient: namespaceController,
+	}
+
+	workloadHandler := &WorkloadHandler{
+		enqueueAfter:  requestController.EnqueueAfter,
+		requestClient: requestController,
+		podClient:     podClient,
+	}
+
+	replicaHandler := &ReplicaHandler{
+		requestCache:  requestController.Cache(),
+		requestClient: requestController,
+		recorder:      recorder,
 	}
 
 	entitlementController.OnChange(ctx, "entitlement-handler", entitlementHandler.OnEntitlementChanged)
+	namespaceController.OnChange(ctx, "namespace-rebuild", namespaceHandler.OnNamespaceChanged)
 	requestController.OnChange(ctx, "request-handler", requestHandler.OnRequestChanged)
+	requestController.OnChange(ctx, "request-workload", workloadHandler.OnRequestChanged)
+	requestController.OnChange(ctx, "request-replicas", replicaHandler.OnRequestChanged)
+	deploymentController.OnChange(ctx, "deployment-replicas", replicaHandler.OnDeploymentChanged)
+	statefulSetController.OnChange(ctx, "statefulset-replicas", replicaHandler.OnStatefulSetChanged)
+	bindingController.OnChange(ctx, "binding-handler", bindingHandler.OnBindingChanged)
+	bindingController.OnRemove(ctx, "binding-remove", bindingHandler.OnBindingRemove)
+	quotaController.OnChange(ctx, "quota-handler", quotaHandler.OnQuotaChanged)
+
+	// namespaces bound by a selector change with their labels
+	relatedresource.Watch(ctx, "namespace-binding", resolveAllBindings(bindingController.Cache()),
+		bindingController, namespaceController)
+
+	// what the requests a quota applies to hold changes with the entitlement they draw on
+	relatedresource.Watch(ctx, "entitlement-quota", resolveQuotas(quotaController.Cache()),
+		quotaController, entitlementController)
+
+	// a request for replicas that is deleted while its workload is still licensed is made again
+	relatedresource.Watch(ctx, "deployment-replicas-request",
+		relatedresource.OwnerResolver(true, "apps/v1", "Deployment"), deploymentController, requestController)
+	relatedresource.Watch(ctx, "statefulset-replicas-request",
+		relatedresource.OwnerResolver(true, "apps/v1", "StatefulSet"), statefulSetController, requestController)
+
+	// every request may hold capacity, so all of them get a finalizer
+	remove.RegisterScopedOnRemoveHandler(ctx, requestController, "on-request-remove",
+		func(key string, obj runtime.Object) (bool, error) {
+			_, ok := obj.(*licensingv1.Request)
+			return ok, nil
+		},
+		v1.FromRequestHandlerToHandler(requestHandler.OnRequestRemove),
+		)
 }
\ No newline at end of file
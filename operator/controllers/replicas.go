@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"strings"
+)
+
+// ReplicaWorkloadAnnotation marks a request made for the replicas of a workload, and holds the kind
+// and name of the workload, e.g. Deployment/web.
+const ReplicaWorkloadAnnotation = "licensing.cattle.io/workload"
+
+// ReplicaRequestName returns the name of the request holding the license of a workload's replicas.
+func ReplicaRequestName(kind string, name string) string {
+	return strings.ToLower(kind) + "-" + name
+}
+
+// ReplicaHandler keeps a request for every Deployment and StatefulSet licensed by its replicas, sized
+// to its replica count and owned by it. Scaling up beyond what is licensed is denied at admission;
+// the request follows the replica count the workload was admitted with. Admission fails open, so a
+// workload whose request can't be offered what its replicas need, e.g. because it was scaled while the
+// operator was down, is told so with a ReplicasUnlicensed event.
+type ReplicaHandler struct {
+	requestCache  v1.RequestCache
+	requestClient v1.RequestClient
+	recorder      record.EventRecorder
+}
+
+func (h *ReplicaHandler) OnDeploymentChanged(key string, deployment *appsv1.Deployment) (*appsv1.Deployment, error) {
+	if deployment == nil {
+		return nil, nil
+	}
+
+	return nil, h.sync(deployment, "Deployment", deployment.Spec.Replicas)
+}
+
+func (h *ReplicaHandler) OnStatefulSetChanged(key string, statefulSet *appsv1.StatefulSet) (*appsv1.StatefulSet, error) {
+	if statefulSet == nil {
+		return nil, nil
+	}
+
+	return nil, h.sync(statefulSet, "StatefulSet", statefulSet.Spec.Replicas)
+}
+
+// OnRequestChanged acknowledges offers made to requests for replicas, as the workload was already admitted
+// with its replica count, has a request whose lease expired look for capacity again, and reports requests
+// that can't be offered anything on their workload.
+func (h *ReplicaHandler) OnRequestChanged(key string, request *licensingv1.Request) (*licensingv1.Request, error) {
+	if request == nil || !request.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	if _, ok := request.Annotations[ReplicaWorkloadAnnotation]; !ok {
+		return nil, nil
+	}
+
+	var next licensingv1.UsageRequestStatus
+	switch request.Status.Status {
+	case licensingv1.UsageRequestStatusOffer:
+		next = licensingv1.UsageRequestStatusAcknowledged
+	case licensingv1.UsageRequestStatusExpired, "":
+		next = licensingv1.UsageRequestStatusDiscover
+	case licensingv1.UsageRequestStatusDiscover:
+		h.reportUnlicensed(request)
+		return nil, nil
+	default:
+		return nil, nil
+	}
+
+	return nil, retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := h.requestClient.Get(request.Namespace, request.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if latest.Status.Status != request.Status.Status {
+			return nil
+		}
+
+		latest = latest.DeepCopy()
+		latest.Status.Status = next
+		_, err = h.requestClient.UpdateStatus(latest)
+		return err
+	})
+}
+
+// reportUnlicensed records an event on the workload of a request for replicas that the operator looked
+// at and couldn't offer what it asks for.
+func (h *ReplicaHandler) reportUnlicensed(request *licensingv1.Request) {
+	offered := meta.FindStatusCondition(request.Status.Conditions, licensingv1.ConditionOffered)
+	if offered == nil || offered.Status != metav1.ConditionFalse || offered.Reason == licensingv1.ReasonDiscovering {
+		return
+	}
+
+	owner := metav1.GetControllerOf(request)
+	if owner == nil {
+		return
+	}
+
+	message := fmt.Sprintf("replicas need %d %s of %s, which can't be licensed: %s",
+		request.Spec.Amount, request.Spec.Unit, request.Spec.Kind, offered.Reason)
+	if offered.Message != "" {
+		message += ", " + offered.Message
+	}
+
+	h.recorder.Event(&corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Name:       owner.Name,
+		Namespace:  request.Namespace,
+		UID:        owner.UID,
+	}, corev1.EventTypeWarning, licensingv1.ReasonReplicasUnlicensed, message)
+}
+
+func (h *ReplicaHandler) sync(workload metav1.Object, kind string, replicas *int32) error {
+	name := ReplicaRequestName(kind, workload.GetName())
+	workloadRef := kind + "/" + workload.GetName()
+
+	existing, err := h.requestCache.Get(workload.GetNamespace(), name)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && existing.Annotations[ReplicaWorkloadAnnotation] != workloadRef {
+		logrus.Warnf("request %s/%s exists and wasn't made for %s, not licensing its replicas",
+			workload.GetNamespace(), name, workloadRef)
+		return nil
+	}
+	if errors.IsNotFound(err) {
+		existing = nil
+	}
+	if existing != nil && !existing.DeletionTimestamp.IsZero() {
+		// made again once it is gone
+		return nil
+	}
+
+	annotations := workload.GetAnnotations()
+	licensed := annotations[WorkloadEnforceAnnotation] == EnforceReplicas && workload.GetDeletionTimestamp().IsZero()
+
+	count := int32(1)
+	if replicas != nil {
+		count = *replicas
+	}
+
+	// a workload no longer licensed by its replicas, or scaled to zero, holds nothing
+	if !licensed || count == 0 {
+		if existing == nil {
+			return nil
+		}
+		return h.delete(existing)
+	}
+
+	spec, err := WorkloadSpec(annotations)
+	if err != nil {
+		logrus.Errorf("error licensing replicas of %s %s/%s: %s", kind, workload.GetNamespace(), workload.GetName(), err.Error())
+		return nil
+	}
+	spec.Amount *= int(count)
+
+	if existing == nil {
+		return h.create(workload, kind, name, spec)
+	}
+
+	if existing.Spec.Kind != spec.Kind || existing.Spec.Unit != spec.Unit {
+		// kind and unit can't change, it is made again once it is gone
+		return h.delete(existing)
+	}
+
+	if existing.Spec == spec {
+		return nil
+	}
+
+	logrus.Infof("%s %s/%s scaled to %d replicas, licensing %d %s", kind, workload.GetNamespace(), workload.GetName(),
+		count, spec.Amount, spec.Unit)
+
+	// a request holding capacity is resized in place, keeping what it holds and taking or giving back
+	// only the difference. one still waiting looks again for the new amount, keeping its place in the queue
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := h.requestClient.Get(existing.Namespace, existing.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		latest = latest.DeepCopy()
+		latest.Spec = spec
+		_, err = h.requestClient.Update(latest)
+		return err
+	})
+}
+
+func (h *ReplicaHandler) create(workload metav1.Object, kind string, name string, spec licensingv1.RequestSpec) error {
+	controller := true
+	// OnRequestChanged has it discover
+	_, err := h.requestClient.Create(&licensingv1.Request{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   workload.GetNamespace(),
+			Annotations: map[string]string{ReplicaWorkloadAnnotation: kind + "/" + workload.GetName()},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: appsv1.SchemeGroupVersion.String(),
+				Kind:       kind,
+				Name:       workload.GetName(),
+				UID:        workload.GetUID(),
+				Controller: &controller,
+			}},
+		},
+		Spec: spec,
+	})
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error creating request for %s %s/%s: %v", kind, workload.GetNamespace(), workload.GetName(), err)
+	}
+
+	return nil
+}
+
+func (h *ReplicaHandler) delete(request *licensingv1.Request) error {
+	err := h.requestClient.Delete(request.Namespace, request.Name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &request.UID},
+	})
+	if errors.IsNotFound(err) || errors.IsConflict(err) {
+		return nil
+	}
+
+	return err
+}
@@ -1,17 +1,29 @@
 package controllers
 
 import (
+	"fmt"
 	licensingv1 "github.com/ebauman/klicense/api/v1"
 	"github.com/ebauman/klicense/kubernetes"
 	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"time"
 )
 
 type RequestHandler struct {
+	allocator *Allocator
+	enqueue func(namespace string, name string)
+	enqueueAfter func(namespace string, name string, duration time.Duration)
 	requestCache v1.RequestCache
 	requestClient v1.RequestClient
 	entitlementCache v1.EntitlementCache
 	entitlementClient v1.EntitlementClient
+	constraints *ConstraintChecker
+	quotas *QuotaChecker
+	resolver *EntitlementResolver
 }
 
 func (r *RequestHandler) OnRequestChanged(key string, request *licensingv1.Request) (*licensingv1.Request, error) {
@@ -19,111 +31,428 @@ func (r *RequestHandler) OnRequestChanged(key string, request *licensingv1.Reque
 		return nil, nil
 	}
 	if !request.DeletionTimestamp.IsZero() {
-		// request is to be deleted
-		// we can free up the grant
-		cachedEntitlement, err := r.entitlementCache.Get(request.Namespace, request.Spec.Kind)
-		entitlement := cachedEntitlement.DeepCopy()
-		if err != nil {
-			logrus.Error(err, "unable to fetch entitlement")
-			return nil, err
-		}
+		// OnRequestRemove returns what the request holds
+		return nil, nil
+	}
 
-		if eStat, ok := entitlement.Status.Grants[request.Status.Grant]; ok {
-			eStat.Status = licensingv1.GrantStatusFree
-			eStat.Request = kubernetes.NamespacedName{}
-		}
+	// Offer is the status _we_ put the request into,
+	// the only action it needs from us is to give up if the client never answers
+	switch request.Status.Status {
+	case licensingv1.UsageRequestStatusDiscover:
+		return r.discover(request)
+	case licensingv1.UsageRequestStatusOffer:
+		return r.offered(request)
+	case licensingv1.UsageRequestStatusAcknowledged:
+		return r.acknowledged(request)
+	}
 
-		_, err = r.entitlementClient.UpdateStatus(entitlement)
-		if err != nil {
-			return nil, err
-		}
+	return nil, nil
+}
 
+// OnRequestRemove returns everything a deleted request holds to its grants and takes it out of the queue.
+// Requests carry a finalizer until this has run, so capacity can't be left allocated to requests that are gone.
+func (r *RequestHandler) OnRequestRemove(key string, request *licensingv1.Request) (*licensingv1.Request, error) {
+	if request == nil {
 		return nil, nil
 	}
 
-	// we only take action on Request and Acknowledged
-	// because Offer is the status _we_ put the request into,
-	// it requires no action from us
-	switch request.Status.Status {
-	case licensingv1.UsageRequestStatusDiscover:
-		// client is requesting usage of an entitlement. can we give it to them?
-		// 1 - there must be a grant available
-		// 2 - the grant must meet the usage requirements for the client
-		// (ignoring things like invalid grants since other controllers handle that)
-		entitlement, err := r.entitlementCache.Get(request.Namespace, request.Spec.Kind)
-		if err != nil {
-			logrus.Error(err, "unable to fetch entitlement")
+	if err := r.release(request, entitlementNamespace(request)); err != nil {
+		logrus.Error(err, "unable to release grants")
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// release returns everything the request holds of its entitlement in namespace to its grants, and takes
+// it out of the queue.
+func (r *RequestHandler) release(request *licensingv1.Request, namespace string) error {
+	// releasing changes the entitlement, which has any queued requests look again
+	_, err := r.allocator.Update(namespace, request.Spec.Kind, func(entitlement *licensingv1.Entitlement) (bool, error) {
+		released := releaseGrants(entitlement, requestName(request))
+		return leaveQueue(entitlement, requestName(request)) || released, nil
+	})
+	if errors.IsNotFound(err) {
+		// no entitlement, so nothing is held
+		return nil
+	}
+
+	return err
+}
+
+func (r *RequestHandler) discover(request *licensingv1.Request) (*licensingv1.Request, error) {
+	// client is requesting usage of an entitlement. can we give it to them?
+	// 1 - there must be one or more grants with capacity remaining
+	// 2 - together the remaining capacity must meet the usage requirements for the client
+	// (ignoring things like invalid grants since other controllers handle that)
+	namespace, err := r.resolver.Resolve(request.Namespace, request.Spec.Kind)
+	if err != nil {
+		logrus.Error(err, "error resolving entitlement")
+		return nil, err
+	}
+
+	// a request no longer bound to the entitlement it drew on gives up what it held there
+	if previous := entitlementNamespace(request); previous != namespace {
+		logrus.Infof("request %s/%s now draws on entitlement %s in namespace %s, releasing what it held in namespace %s",
+			request.Namespace, request.Name, request.Spec.Kind, namespace, previous)
+		if err := r.release(request, previous); err != nil {
+			logrus.Error(err, "unable to release grants")
 			return nil, err
 		}
+	}
 
-		// if we have a valid entitlement at this point, let's check if the requested
-		// entitlement has a grant they can use
-		for _, grant := range entitlement.Status.Grants {
-			// if the grant is used, continue
-			if grant.Status != licensingv1.GrantStatusFree {
-				continue
-			}
+	var allocations []licensingv1.Allocation
+	var victims []kubernetes.NamespacedName
+	var served []*licensingv1.Request
+	var failures []licensingv1.ConstraintFailure
+	var constrained, overQuota bool
+	var position int
+	var message string
+	_, err = r.allocator.Update(namespace, request.Spec.Kind, func(entitlement *licensingv1.Entitlement) (bool, error) {
+		victims, served, constrained, overQuota, position, message = nil, nil, false, false, 0, ""
 
-			if grant.Unit != request.Spec.Unit {
-				continue
-			}
+		// grants whose license constraints don't hold for the request are never offered to it
+		var denied map[string]bool
+		denied, failures = r.constraints.check(entitlement, request)
+		allowed := withoutGrants(entitlement, denied)
 
-			if grant.Amount < request.Spec.Amount {
-				continue
-			}
+		// if we already allocated for this request, but didn't get as far as telling it, offer the same again
+		if allocations = existingAllocation(entitlement, request); allocations != nil && !usesGrants(allocations, denied) {
+			allocate(entitlement, request, licensingv1.GrantStatusPending, allocations)
+			return true, nil
+		}
+
+		// a request back in discover may still hold capacity from a previous offer, e.g. when one of
+		// several grants it was using was deleted. release it all so it can be allocated afresh
+		changed := releaseGrants(entitlement, requestName(request))
 
-			// if we get here, we have a grant that matches the request
-			// let's offer it to the client
-			request.Status.Status = licensingv1.UsageRequestStatusOffer
-			request.Status.Grant = grant.Id
-			request.Status.LicenseSecret = grant.LicenseSecret.Name
+		// waiting is pointless if no grant of the unit may ever be offered to the request
+		if len(denied) > 0 && !hasGrants(allowed, request.Spec.Unit) {
+			constrained = true
+			message = constraintsMessage(request, failures)
+			return leaveQueue(entitlement, requestName(request)) || changed, nil
+		}
+
+		// join the queue, so that requests ahead of this one are served first
+		changed = joinQueue(entitlement, request, time.Now()) || changed
+
+		var blocked bool
+		served, blocked = serveQueue(entitlement, request, r.admitQueued)
+		if len(served) > 0 {
+			changed = true
+		}
 
-			_, err := r.requestClient.UpdateStatus(request)
+		// a request that would take its namespace beyond its quota waits until less is held there,
+		// without holding up the queue
+		if !blocked {
+			quota, err := r.quotas.Exceeded(entitlement, request)
 			if err != nil {
-				logrus.Error(err, "error updating request")
-				return nil, err
+				return false, err
 			}
+			if quota != "" {
+				overQuota = true
+				position = queuePosition(entitlement, request)
+				message = fmt.Sprintf("queued at position %d: %s", position, quota)
+				return changed, nil
+			}
+		}
 
-			grant.Status = licensingv1.GrantStatusPending
-			_, err = r.entitlementClient.UpdateStatus(entitlement)
-			if err != nil {
-				logrus.Error(err, "error updating entitlement")
-				return nil, err
+		if !blocked {
+			// serving the queue changed what is available
+			allowed = withoutGrants(entitlement, denied)
+			allocations = selectGrants(allowed, request)
+			if allocations == nil && preemptionEnabled(entitlement) {
+				allocations, victims = preempt(entitlement, request, denied)
 			}
+		}
+
+		if allocations == nil {
+			position = queuePosition(entitlement, request)
+			message = waitingMessage(allowed, request, position, blocked)
+			return changed, nil
+		}
+
+		// reserve the capacity first, so it can't be offered to anyone else
+		allocate(entitlement, request, licensingv1.GrantStatusPending, allocations)
+		return true, nil
+	})
+	if err != nil {
+		logrus.Error(err, "error allocating grants")
+		return nil, err
+	}
+
+	// requests served from the queue are reprocessed, which offers them what we allocated
+	for _, s := range served {
+		r.enqueue(s.Namespace, s.Name)
+	}
 
-			break // once we've found our grant, don't continue
+	if len(victims) > 0 {
+		logrus.Infof("request %s/%s preempted %d lower priority requests", request.Namespace, request.Name, len(victims))
+		err = ResetRequests(r.requestClient.Get, r.requestClient.UpdateStatus, victims, licensingv1.ReasonPreempted,
+			fmt.Sprintf("preempted by higher priority request %s/%s", request.Namespace, request.Name))
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		// if we get to this point, there is no matching grant currently
-		// update the request and say that
-		request.Status.Message = "no matching grant found for specified amount and type"
-		_, err = r.requestClient.UpdateStatus(request)
+	if constrained {
+		// what the constraints depend on may change, so they are evaluated again later
+		err = r.updateStatus(request, licensingv1.ReasonConstraintsNotMet, func(status *licensingv1.RequestStatus) {
+			status.QueuePosition = 0
+			status.ConstraintFailures = failures
+			status.EntitlementNamespace = namespace
+			status.Message = message
+		})
 		if err != nil {
 			logrus.Error(err, "error updating request")
 			return nil, err
 		}
-	case licensingv1.UsageRequestStatusAcknowledged:
-		cachedEntitlement, err := r.entitlementCache.Get(request.Namespace, request.Spec.Kind)
-		entitlement := cachedEntitlement.DeepCopy()
+
+		r.enqueueAfter(request.Namespace, request.Name, constraintRecheck)
+		return nil, nil
+	}
+
+	if allocations == nil {
+		// there is no matching set of grants currently, or none the request may take
+		// the request waits in the queue until capacity frees up
+		reason := ""
+		if overQuota {
+			reason = licensingv1.ReasonQuotaExceeded
+		}
+
+		err = r.updateStatus(request, reason, func(status *licensingv1.RequestStatus) {
+			status.QueuePosition = position
+			status.ConstraintFailures = failures
+			status.EntitlementNamespace = namespace
+			status.Message = message
+		})
 		if err != nil {
-			logrus.Error(err, "unable to fetch entitlement")
+			logrus.Error(err, "error updating request")
 			return nil, err
 		}
 
-		if grant, ok := entitlement.Status.Grants[request.Status.Grant]; ok {
-			grant.Status = licensingv1.GrantStatusInUse
-			grant.Request = kubernetes.NamespacedName{
-				Name:      request.Name,
-				Namespace: request.Namespace,
+		return nil, nil
+	}
+
+	// then offer them to the client
+	err = r.updateStatus(request, "", func(status *licensingv1.RequestStatus) {
+		status.Status = licensingv1.UsageRequestStatusOffer
+		status.Allocations = allocations
+		status.Grant = allocations[0].Grant
+		status.LicenseSecret = allocations[0].LicenseSecret
+		status.License = allocations[0].License
+		status.QueuePosition = 0
+		now := metav1.Now()
+		status.OfferTime = &now
+		status.ConstraintFailures = failures
+		status.EntitlementNamespace = namespace
+		status.Message = overageMessage(allocations, request.Spec.Unit)
+	})
+	if err != nil {
+		// the allocation is recorded, so it will be offered again when the request is retried
+		logrus.Error(err, "error updating request")
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// admitQueued returns the view of the entitlement a queued request may be allocated from, see serveQueue.
+// The queue only records enough of a request to allocate for it, so the request itself is looked up.
+func (r *RequestHandler) admitQueued(entitlement *licensingv1.Entitlement, queued *licensingv1.Request) *licensingv1.Entitlement {
+	request := queued
+	if cached, err := r.requestCache.Get(queued.Namespace, queued.Name); err == nil && cached.UID == queued.UID {
+		request = cached
+	}
+
+	if quota, err := r.quotas.Exceeded(entitlement, request); err != nil || quota != "" {
+		return nil
+	}
+
+	denied, _ := r.constraints.check(entitlement, request)
+	allowed := withoutGrants(entitlement, denied)
+	if !hasGrants(allowed, queued.Spec.Unit) {
+		return nil
+	}
+
+	return allowed
+}
+
+func (r *RequestHandler) acknowledged(request *licensingv1.Request) (*licensingv1.Request, error) {
+	// a client that stopped renewing its lease has gone away, its capacity goes back to the grants
+	if expired, err := r.checkLease(request); err != nil || expired {
+		return nil, err
+	}
+
+	// why the request has to discover again, if it does
+	var reason, message string
+	// what the request holds, and its place in the queue while it waits for more
+	var held []licensingv1.Allocation
+	var served []*licensingv1.Request
+	var position int
+	_, err := r.allocator.Update(entitlementNamespace(request), request.Spec.Kind, func(entitlement *licensingv1.Entitlement) (bool, error) {
+		reason, message, held, served, position = "", "", nil, nil, 0
+		if ra, ok := heldAllocation(entitlement, request); ok && heldBy(ra, request) {
+			changed := false
+			if ra.Status != licensingv1.GrantStatusInUse || ra.RequestUID != request.UID {
+				// a migrated record is adopted by the request it was made for
+				ra.RequestUID = request.UID
+				ra.Status = licensingv1.GrantStatusInUse
+				entitlement.Status.Allocations[allocationKey(entitlement, requestName(request))] = ra
+				recalculate(entitlement)
+				changed = true
+			}
+
+			if ra.Amount == request.Spec.Amount {
+				held = heldAllocations(entitlement, ra)
+				return leaveQueue(entitlement, requestName(request)) || changed, nil
+			}
+
+			// the amount changed, e.g. the workload was scaled. the request keeps what it holds, and only
+			// takes or gives back the difference
+			before := entitlement.Status.DeepCopy()
+			var err error
+			held, served, position, message, err = r.resize(entitlement, request, ra)
+			return changed || !equality.Semantic.DeepEqual(*before, entitlement.Status), err
+		}
+
+		// the allocation record is gone, e.g. the entitlement was recreated. only take the capacity back
+		// if it is still there, otherwise the request has to discover again
+		allocations := requestAllocations(request)
+		for _, a := range allocations {
+			grant, ok := entitlement.Status.Grants[a.Grant]
+			if !ok || !covers(entitlement, grant, a) {
+				reason, message = licensingv1.ReasonAllocationLost, "allocation lost"
+				return false, nil
 			}
 		}
 
-		_, err = r.entitlementClient.UpdateStatus(entitlement)
+		// the allocations are read from the request, so they are only taken back if they would be offered
+		quota, err := r.quotas.Exceeded(entitlement, request)
 		if err != nil {
-			logrus.Error(err, "error updating entitlement")
-			return nil, err
+			return false, err
 		}
+		if quota != "" {
+			reason, message = licensingv1.ReasonQuotaExceeded, "allocation lost: "+quota
+			return false, nil
+		}
+
+		if denied, failures := r.constraints.check(entitlement, request); usesGrants(allocations, denied) {
+			reason, message = licensingv1.ReasonConstraintsNotMet, constraintsMessage(request, failures)
+			return false, nil
+		}
+
+		allocate(entitlement, request, licensingv1.GrantStatusInUse, allocations)
+		return true, nil
+	})
+	if err != nil {
+		logrus.Error(err, "error updating entitlement")
+		return nil, err
+	}
+
+	if reason != "" {
+		err = ResetRequests(r.requestClient.Get, r.requestClient.UpdateStatus,
+			[]kubernetes.NamespacedName{requestName(request)}, reason, message)
+		return nil, err
+	}
+
+	for _, s := range served {
+		r.enqueue(s.Namespace, s.Name)
+	}
+
+	// the client acknowledged, so the request is ready
+	err = r.updateStatus(request, "", func(status *licensingv1.RequestStatus) {
+		if held == nil {
+			return
+		}
+
+		status.Allocations = held
+		status.Grant = held[0].Grant
+		status.LicenseSecret = held[0].LicenseSecret
+		status.License = held[0].License
+		status.QueuePosition = position
+		status.Message = message
+		if position == 0 {
+			status.Message = overageMessage(held, request.Spec.Unit)
+		}
+	})
+	if err != nil {
+		logrus.Error(err, "error updating request")
+		return nil, err
 	}
 
 	return nil, nil
-}
\ No newline at end of file
+}
+
+// resize changes what an acknowledged request holds to the amount it now asks for. Giving back always works.
+// Growing keeps the request's place behind the requests queued ahead of it: it waits in the queue for the
+// difference, holding what it has, until it can be served. Returns what the request holds, the requests
+// served from the queue, and its position and why it is waiting, if it is.
+func (r *RequestHandler) resize(entitlement *licensingv1.Entitlement, request *licensingv1.Request,
+	ra licensingv1.RequestAllocation) ([]licensingv1.Allocation, []*licensingv1.Request, int, string, error) {
+	if request.Spec.Amount < ra.Amount {
+		return resize(entitlement, entitlement, request, ra), nil, 0, "", nil
+	}
+
+	// grants whose license constraints don't hold for the request are never offered to it
+	denied, _ := r.constraints.check(entitlement, request)
+
+	difference := request.DeepCopy()
+	difference.Spec.Amount -= ra.Amount
+	joinQueue(entitlement, difference, time.Now())
+
+	served, blocked := serveQueue(entitlement, request, r.admitQueued)
+	held := heldAllocations(entitlement, ra)
+	position := queuePosition(entitlement, request)
+	if blocked {
+		return held, served, position, waitingFor(difference, position,
+			"waiting for requests ahead in the queue to be served"), nil
+	}
+
+	quota, err := r.quotas.Exceeded(entitlement, request)
+	if err != nil {
+		return nil, nil, 0, "", err
+	}
+	if quota != "" {
+		return held, served, position, waitingFor(difference, position, quota), nil
+	}
+
+	if grown := resize(entitlement, withoutGrants(entitlement, denied), request, ra); grown != nil {
+		return grown, served, 0, "", nil
+	}
+
+	usage := entitlement.Status.Usage[request.Spec.Unit]
+	return held, served, position, waitingFor(difference, position,
+		fmt.Sprintf("%d of %d available", usage.Available, usage.Amount)), nil
+}
+
+// waitingFor explains why a request holding capacity is still waiting for more.
+func waitingFor(difference *licensingv1.Request, position int, why string) string {
+	return fmt.Sprintf("queued at position %d for %d more %s: %s", position, difference.Spec.Amount,
+		difference.Spec.Unit, why)
+}
+
+// updateStatus applies mutate to the latest copy of the request, derives its conditions, and writes its status
+// if anything changed. reason is passed on to setRequestConditions.
+func (r *RequestHandler) updateStatus(request *licensingv1.Request, reason string, mutate func(status *licensingv1.RequestStatus)) error {
+	current := request
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := current.DeepCopy()
+		mutate(&latest.Status)
+		setRequestConditions(latest, reason)
+
+		if equality.Semantic.DeepEqual(current.Status, latest.Status) {
+			return nil
+		}
+
+		_, err := r.requestClient.UpdateStatus(latest)
+		if err == nil {
+			return nil
+		}
+
+		if fresh, getErr := r.requestClient.Get(request.Namespace, request.Name, metav1.GetOptions{}); getErr == nil {
+			current = fresh
+		}
+		return err
+	})
+}
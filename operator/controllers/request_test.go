@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestAcknowledgedWithoutRecord checks that an acknowledged request whose allocation record is gone only
+// takes back the allocations it carries if it would be offered them.
+func TestAcknowledgedWithoutRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		grant  licensingv1.Grant
+		held   int
+		quotas []*licensingv1.LicenseQuota
+		// the reason the request discovers again for, empty if it keeps its allocations
+		reason string
+	}{
+		{
+			name:  "allocations that are still there are taken back",
+			grant: testGrant("a", "seats", 10),
+		},
+		{
+			name:   "allocations no longer there are lost",
+			grant:  testGrant("a", "seats", 10),
+			held:   8,
+			reason: licensingv1.ReasonAllocationLost,
+		},
+		{
+			name:   "allocations beyond the namespace's quota are lost",
+			grant:  testGrant("a", "seats", 10),
+			quotas: []*licensingv1.LicenseQuota{testQuota("seats", testKind, map[string]int{"seats": 2}, nil)},
+			reason: licensingv1.ReasonQuotaExceeded,
+		},
+		{
+			name:   "allocations of grants whose constraints don't hold are lost",
+			grant:  constrained(testGrant("a", "seats", 10), `ns.labels["env"] == "prod"`),
+			reason: licensingv1.ReasonConstraintsNotMet,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entitlement := testEntitlement(test.grant)
+			if test.held > 0 {
+				entitlement = holding([]licensingv1.Grant{test.grant}, holder{name: "holder", grants: map[string]int{"a": test.held}})
+			}
+
+			request := testRequest("default", "request", "seats", 3)
+			request.Status.Status = licensingv1.UsageRequestStatusAcknowledged
+			request.Status.Allocations = []licensingv1.Allocation{{Grant: "a", Amount: 3}}
+
+			entitlements := newFakeEntitlements(entitlement)
+			requests := newFakeRequests(request)
+			handler := newTestRequestHandler(entitlements, requests, test.quotas...)
+			handler.constraints.namespaceCache = &fakeNamespaceCache{namespaces: []*corev1.Namespace{{
+				ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{"env": "dev"}},
+			}}}
+
+			if _, err := handler.OnRequestChanged("default/request", requests.get("default", "request")); err != nil {
+				t.Fatal(err)
+			}
+
+			updated := requests.get("default", "request")
+			ra, held := heldAllocation(entitlements.get("default", testKind), request)
+
+			if test.reason == "" {
+				if !held || ra.Status != licensingv1.GrantStatusInUse || ra.Amount != 3 {
+					t.Errorf("allocations weren't taken back: %+v", ra)
+				}
+				if updated.Status.Status != licensingv1.UsageRequestStatusAcknowledged {
+					t.Errorf("expected the request to stay acknowledged, got %s", updated.Status.Status)
+				}
+				return
+			}
+
+			if held {
+				t.Errorf("allocations were taken back: %+v", ra)
+			}
+			if updated.Status.Status != licensingv1.UsageRequestStatusDiscover || len(updated.Status.Allocations) > 0 {
+				t.Errorf("expected the request to discover again, got %s %+v", updated.Status.Status, updated.Status.Allocations)
+			}
+			if offered := meta.FindStatusCondition(updated.Status.Conditions, licensingv1.ConditionOffered); offered == nil ||
+				offered.Reason != test.reason {
+				t.Errorf("expected reason %s, got %+v", test.reason, offered)
+			}
+		})
+	}
+}
+
+// TestResize checks that an acknowledged request whose amount changed keeps what it holds, and only takes
+// or gives back the difference.
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int
+		// a request queued ahead, for this many seats
+		waiting int
+		// what the request holds of each grant afterwards
+		expected map[string]int
+		// its place in the queue afterwards, if it is still waiting for more
+		position int
+	}{
+		{
+			name:     "scaling down gives back the difference",
+			amount:   2,
+			expected: map[string]int{"a": 2},
+		},
+		{
+			name:     "scaling down keeps what is held, whatever is waiting",
+			amount:   2,
+			waiting:  9,
+			expected: map[string]int{"a": 2},
+		},
+		{
+			name:     "scaling up takes the difference",
+			amount:   7,
+			expected: map[string]int{"a": 4, "b": 3},
+		},
+		{
+			name:     "scaling up waits behind requests queued ahead, holding what it has",
+			amount:   6,
+			waiting:  9,
+			expected: map[string]int{"a": 4},
+			position: 2,
+		},
+		{
+			name:     "scaling up beyond what is free waits, holding what it has",
+			amount:   11,
+			expected: map[string]int{"a": 4},
+			position: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grants := []licensingv1.Grant{testGrant("a", "seats", 5), testGrant("b", "seats", 5)}
+			entitlement := holding(grants, holder{name: "request", grants: map[string]int{"a": 4}})
+
+			request := testRequest("default", "request", "seats", test.amount)
+			request.Status.Status = licensingv1.UsageRequestStatusAcknowledged
+			request.Status.Allocations = []licensingv1.Allocation{{Grant: "a", Amount: 4}}
+
+			known := []*licensingv1.Request{request}
+			if test.waiting > 0 {
+				waiter := testRequest("default", "waiter", "seats", test.waiting)
+				joinQueue(entitlement, waiter, time.Now().Add(-time.Minute))
+				known = append(known, waiter)
+			}
+
+			entitlements := newFakeEntitlements(entitlement)
+			requests := newFakeRequests(known...)
+			handler := newTestRequestHandler(entitlements, requests)
+
+			if _, err := handler.OnRequestChanged("default/request", requests.get("default", "request")); err != nil {
+				t.Fatal(err)
+			}
+
+			updated := requests.get("default", "request")
+			if updated.Status.Status != licensingv1.UsageRequestStatusAcknowledged {
+				t.Errorf("expected the request to stay acknowledged, got %s", updated.Status.Status)
+			}
+
+			after := entitlements.get("default", testKind)
+			ra, _ := heldAllocation(after, request)
+			held := map[string]int{}
+			for _, a := range ra.Grants {
+				held[a.Grant] += a.Amount
+			}
+			if !reflect.DeepEqual(held, test.expected) {
+				t.Errorf("expected the request to hold %v, got %v", test.expected, held)
+			}
+
+			offered := map[string]int{}
+			for _, a := range updated.Status.Allocations {
+				offered[a.Grant] += a.Amount
+			}
+			if !reflect.DeepEqual(offered, test.expected) {
+				t.Errorf("expected the request's allocations to be %v, got %v", test.expected, offered)
+			}
+
+			if position := queuePosition(after, request); position != test.position {
+				t.Errorf("expected queue position %d, got %d", test.position, position)
+			}
+			if updated.Status.QueuePosition != test.position {
+				t.Errorf("expected the request to report queue position %d, got %d", test.position, updated.Status.QueuePosition)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	v1 "github.com/ebauman/klicense/api/v1"
+)
+
+// resize changes what a request holds to the amount it now asks for, keeping what it already holds and only
+// taking or returning the difference. Growing takes the difference from allowed, the view of the entitlement
+// the request may be allocated from. Returns the allocations the request now holds, or nil if it can't
+// grow yet or a grant it holds no longer exists.
+func resize(entitlement *v1.Entitlement, allowed *v1.Entitlement, request *v1.Request, ra v1.RequestAllocation) []v1.Allocation {
+	held := heldAllocations(entitlement, ra)
+	if held == nil {
+		return nil
+	}
+
+	var allocations []v1.Allocation
+	if request.Spec.Amount <= ra.Amount {
+		allocations = shrinkAllocations(held, request.Spec.Amount)
+	} else {
+		difference := request.DeepCopy()
+		difference.Spec.Amount -= ra.Amount
+		added := selectGrants(allowed, difference)
+		if added == nil {
+			return nil
+		}
+		allocations = mergeAllocations(held, added)
+	}
+
+	allocate(entitlement, request, ra.Status, allocations)
+	return allocations
+}
+
+// growing returns true if the request holds capacity, but asks for more than it holds.
+func growing(entitlement *v1.Entitlement, request *v1.Request) bool {
+	ra, ok := heldAllocation(entitlement, request)
+	return ok && heldBy(ra, request) && ra.Unit == request.Spec.Unit && ra.Amount < request.Spec.Amount
+}
+
+// heldAllocations returns the allocations recorded for a request, with the licenses of their grants,
+// or nil if any grant they draw on no longer exists.
+func heldAllocations(entitlement *v1.Entitlement, ra v1.RequestAllocation) []v1.Allocation {
+	allocations := make([]v1.Allocation, 0, len(ra.Grants))
+	for _, a := range ra.Grants {
+		grant, ok := entitlement.Status.Grants[a.Grant]
+		if !ok {
+			return nil
+		}
+
+		allocation := allocationFor(grant, a.Amount)
+		allocation.Overage = a.Overage
+		allocations = append(allocations, allocation)
+	}
+
+	return allocations
+}
+
+// shrinkAllocations trims allocations down to amount, giving back what is beyond license first, then
+// what was taken last.
+func shrinkAllocations(allocations []v1.Allocation, amount int) []v1.Allocation {
+	excess := -amount
+	for _, a := range allocations {
+		excess += a.Amount
+	}
+
+	trimmed := append([]v1.Allocation{}, allocations...)
+	for i := len(trimmed) - 1; i >= 0 && excess > 0; i-- {
+		give := trimmed[i].Overage
+		if give > excess {
+			give = excess
+		}
+		trimmed[i].Amount -= give
+		trimmed[i].Overage -= give
+		excess -= give
+	}
+	for i := len(trimmed) - 1; i >= 0 && excess > 0; i-- {
+		give := trimmed[i].Amount
+		if give > excess {
+			give = excess
+		}
+		trimmed[i].Amount -= give
+		excess -= give
+	}
+
+	kept := trimmed[:0]
+	for _, a := range trimmed {
+		if a.Amount > 0 {
+			kept = append(kept, a)
+		}
+	}
+
+	return kept
+}
+
+// mergeAllocations adds allocations to those already held, combining those drawn from the same grant.
+func mergeAllocations(held []v1.Allocation, added []v1.Allocation) []v1.Allocation {
+	merged := append([]v1.Allocation{}, held...)
+	for _, a := range added {
+		found := false
+		for i := range merged {
+			if merged[i].Grant == a.Grant {
+				merged[i].Amount += a.Amount
+				merged[i].Overage += a.Overage
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			merged = append(merged, a)
+		}
+	}
+
+	return merged
+}
@@ -3,33 +3,34 @@ package controllers
 import (
 	"context"
 	v1 "github.com/ebauman/klicense/api/v1"
-	"github.com/ebauman/klicense/kubernetes"
 	license2 "github.com/ebauman/klicense/license"
-	cattleLicensingv1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
 	"github.com/ebauman/klicense/remove"
 	wranglerCorev1 "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/util/retry"
-	"strings"
-	"time"
 )
 
-func RegisterSecretHandler(ctx context.Context,
-	entitlementController cattleLicensingv1.EntitlementController,
-	requestController cattleLicensingv1.RequestController,
-	secretController wranglerCorev1.SecretController) {
+// SecretSource discovers licenses in Secrets labeled with LicensingLabel.
+type SecretSource struct {
+	secretController wranglerCorev1.SecretController
+	handler          *SecretHandler
+}
+
+func NewSecretSource(secretController wranglerCorev1.SecretController) *SecretSource {
+	return &SecretSource{
+		secretController: secretController,
+	}
+}
+
+func (s *SecretSource) Register(ctx context.Context, projector *Projector) {
 	secretHandler := &SecretHandler{
-		entitlementCache:  entitlementController.Cache(),
-		entitlementClient: entitlementController,
-		requestClient: requestController,
-		requestCache: requestController.Cache(),
+		projector: projector,
 	}
+	s.handler = secretHandler
 
-	remove.RegisterScopedOnRemoveHandler(ctx, secretController, "on-license-secret-remove",
+	remove.RegisterScopedOnRemoveHandler(ctx, s.secretController, "on-license-secret-remove",
 		func(key string, obj runtime.Object) (bool, error) {
 			if obj == nil {
 				return false, nil
@@ -45,14 +46,29 @@ func RegisterSecretHandler(ctx context.Context,
 		wranglerCorev1.FromSecretHandlerToHandler(secretHandler.OnRemove),
 		)
 
-	secretController.OnChange(ctx, "secret-on-change", secretHandler.OnSecretChanged)
+	s.secretController.OnChange(ctx, "secret-on-change", secretHandler.OnSecretChanged)
+}
+
+func (s *SecretSource) Start(ctx context.Context) {}
+
+func (s *SecretSource) Rebuild(namespace string) error {
+	secrets, err := s.secretController.Cache().List(namespace, labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range secrets {
+		// a bad secret shouldn't keep the licenses in the others from coming back
+		if _, err := s.handler.OnSecretChanged("", secret); err != nil {
+			logrus.Errorf("error projecting licenses from secret %s/%s: %s", secret.Namespace, secret.Name, err.Error())
+		}
+	}
+
+	return nil
 }
 
 type SecretHandler struct {
-	entitlementCache  cattleLicensingv1.EntitlementCache
-	entitlementClient cattleLicensingv1.EntitlementClient
-	requestCache cattleLicensingv1.RequestCache
-	requestClient cattleLicensingv1.RequestClient
+	projector *Projector
 }
 
 func (s *SecretHandler) shouldManage(secret *corev1.Secret) (bool, error) {
@@ -82,63 +98,12 @@ func (s *SecretHandler) OnSecretChanged(key string, secret *corev1.Secret) (*cor
 		return nil, nil
 	}
 
-	license, err := license2.ValidateSecret(secret)
+	licenses, err := license2.ValidateSecret(secret)
 	if err != nil {
 		return nil, err
 	}
 
-	// if we have a valid license at this point, convert its contents into grants
-	for k, v := range license.Grants {
-		// first, try and get an entitlement in the cluster
-		var url = strings.Split(k, "/")
-		cachedEntitlement, err := s.entitlementCache.Get(secret.Namespace, url[0])
-		var entitlement = &v1.Entitlement{}
-		if errors.IsNotFound(err) {
-			entitlement.Name = url[0]
-			entitlement.Namespace = secret.Namespace
-
-			if entitlement, err = s.entitlementClient.Create(entitlement); err != nil {
-				logrus.Error(err, "error creating entitlement")
-				return nil, err
-			}
-		} else {
-			cachedEntitlement.DeepCopyInto(entitlement)
-		}
-
-		if license.NotAfter.Before(time.Now()) || license.NotBefore.After(time.Now()) {
-			// license is expired, don't add it to the entitlement.
-			logrus.Info("license expired or not yet valid")
-			return nil, nil
-		}
-
-		if entitlement.Status.Grants == nil {
-			entitlement.Status.Grants = make(map[string]v1.Grant, 0)
-		}
-		entitlement.Status.Grants[license.Id] = v1.Grant{
-			Amount:    v,
-			Id:        license.Id,
-			Unit:      url[1],
-			Status:    v1.GrantStatusFree,
-			NotBefore: metav1.NewTime(license.NotBefore),
-			NotAfter:  metav1.NewTime(license.NotAfter),
-			LicenseSecret: kubernetes.NamespacedName{
-				Name:      secret.Name,
-				Namespace: secret.Namespace,
-			},
-		}
-
-		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			_, err = s.entitlementClient.UpdateStatus(entitlement)
-			return err
-		})
-
-		if err != nil {
-			logrus.Errorf("error updating entitlement status: %s", err.Error())
-			return nil, err
-		}
-	}
-
-	return nil, nil
+	return nil, s.projector.Project(secretSource(secret), secret.Namespace, licenses)
 }
 
 func (s *SecretHandler) OnRemove(key string, secret *corev1.Secret) (*corev1.Secret, error) {
@@ -146,50 +111,19 @@ func (s *SecretHandler) OnRemove(key string, secret *corev1.Secret) (*corev1.Sec
 		return nil, nil
 	}
 
-	license, err := license2.ValidateSecret(secret)
-	if err != nil {
+	// remove every grant that is backed by this secret, regardless of whether
+	// the licenses it holds still validate
+	if err := s.projector.Remove(secretSource(secret), secret.Namespace); err != nil {
 		return nil, err
 	}
 
-	// get all entitlements referenced in this license
-	// in each entitlement, remove the corresponding grant
-	for grantName, _ := range license.Grants {
-		// pull out the entitlement name from the license
-		entitlementName := strings.Split(grantName, "/")[0]
-
-		// get the corresponding entitlement
-		cachedEntitlement, err := s.entitlementCache.Get(secret.Namespace, entitlementName)
-		if errors.IsNotFound(err) {
-			continue // nothing to do about an entitlement we can't find
-		}
-
-		if err != nil {
-			logrus.Errorf("error retrieving entitlement from kubernetes: %s", err.Error())
-			return nil, err
-		}
-
-		// once we have the entitlement, copy it and remove the corresponding grant
-		entitlement := cachedEntitlement.DeepCopy()
-		if _, ok := entitlement.Status.Grants[license.Id]; ok {
-			err = s.processGrantDeletion(license.Id, entitlement)
-			if err != nil {
-				logrus.Errorf("error notifying deleting grant from entitlement: %s", err.Error())
-			}
-		}
-
-		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			_, err = s.entitlementClient.UpdateStatus(entitlement)
-			return err
-		})
-		if err != nil {
-			logrus.Errorf("error updating entitlement: %s", err.Error())
-			return nil, err
-		}
-	}
-
 	return secret, nil
 }
 
-func (s *SecretHandler) processGrantDeletion(key string, entitlement *v1.Entitlement) error {
-	return ProcessGrantDeletion(s.requestCache.Get, s.requestClient.UpdateStatus, key, entitlement)
-}
\ No newline at end of file
+func secretSource(secret *corev1.Secret) v1.LicenseSource {
+	return v1.LicenseSource{
+		Type:      v1.LicenseSourceSecret,
+		Namespace: secret.Namespace,
+		Name:      secret.Name,
+	}
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// LicenseSource discovers licenses and feeds them to a Projector.
+type LicenseSource interface {
+	// Register wires the source up to the operator. It is called before controllers are started.
+	Register(ctx context.Context, projector *Projector)
+	// Start begins discovery for sources that are not driven by a controller.
+	// It is called once controllers have started and their caches have synced.
+	Start(ctx context.Context)
+	// Rebuild projects every license the source holds for namespace again, returning once it is done.
+	// It is used to recreate entitlements that were lost.
+	Rebuild(namespace string) error
+}
+
+// SourceNames are the license sources that can be selected with ParseSources.
+var SourceNames = []string{"secret", "configmap", "directory", "http"}
+
+// ParseSources validates a comma-separated list of license source names.
+func ParseSources(value string) ([]string, error) {
+	var sources []string
+	for _, s := range strings.Split(value, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+
+		valid := false
+		for _, n := range SourceNames {
+			if s == n {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown license source %s, must be one of %s", s, strings.Join(SourceNames, ","))
+		}
+
+		sources = append(sources, s)
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("at least one license source is required")
+	}
+
+	return sources, nil
+}
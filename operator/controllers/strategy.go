@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"fmt"
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+// AllocationStrategyAnnotation selects the allocation strategy for a single entitlement.
+const AllocationStrategyAnnotation = "licensing.cattle.io/allocation-strategy"
+
+const (
+	StrategyFirstFit            = "first-fit"
+	StrategyBestFit             = "best-fit"
+	StrategyEarliestExpiryFirst = "earliest-expiry-first"
+	StrategyLatestExpiryFirst   = "latest-expiry-first"
+)
+
+// DefaultAllocationStrategy is used for entitlements without the AllocationStrategyAnnotation.
+// The operator overrides this from its --allocation-strategy flag.
+var DefaultAllocationStrategy = StrategyFirstFit
+
+// AllocationStrategy decides which grants a request draws its capacity from.
+type AllocationStrategy interface {
+	// Select picks allocations covering amount from candidates, which all have capacity available
+	// in the requested unit. Returns nil if amount can't be covered.
+	Select(candidates []v1.Grant, amount int) []v1.Allocation
+}
+
+var strategies = map[string]AllocationStrategy{
+	// grants have no meaningful order of their own, so first-fit walks them in order of id
+	StrategyFirstFit: orderedStrategy{less: func(a, b v1.Grant) bool {
+		return false
+	}},
+	StrategyBestFit: bestFitStrategy{},
+	StrategyEarliestExpiryFirst: orderedStrategy{less: func(a, b v1.Grant) bool {
+		return a.NotAfter.Before(&b.NotAfter)
+	}},
+	StrategyLatestExpiryFirst: orderedStrategy{less: func(a, b v1.Grant) bool {
+		return b.NotAfter.Before(&a.NotAfter)
+	}},
+}
+
+// ValidateStrategy returns an error if name isn't a known allocation strategy.
+func ValidateStrategy(name string) error {
+	if _, ok := strategies[name]; ok {
+		return nil
+	}
+
+	var names []string
+	for n := range strategies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("unknown allocation strategy %s, must be one of %s", name, strings.Join(names, ","))
+}
+
+// strategyFor returns the allocation strategy of an entitlement.
+func strategyFor(entitlement *v1.Entitlement) AllocationStrategy {
+	if name, ok := entitlement.Annotations[AllocationStrategyAnnotation]; ok {
+		if s, ok := strategies[name]; ok {
+			return s
+		}
+
+		logrus.Warnf("entitlement %s/%s has unknown allocation strategy %s, using %s",
+			entitlement.Namespace, entitlement.Name, name, DefaultAllocationStrategy)
+	}
+
+	return strategies[DefaultAllocationStrategy]
+}
+
+// orderedStrategy walks grants in order, using the first that covers the whole amount by itself,
+// or failing that, combining grants in order until the amount is covered.
+type orderedStrategy struct {
+	less func(a, b v1.Grant) bool
+}
+
+func (o orderedStrategy) Select(candidates []v1.Grant, amount int) []v1.Allocation {
+	sortGrants(candidates, o.less)
+
+	for _, grant := range candidates {
+		if grant.Available >= amount {
+			return []v1.Allocation{allocationFor(grant, amount)}
+		}
+	}
+
+	return fill(candidates, amount)
+}
+
+// bestFitStrategy uses the smallest grant that covers the whole amount by itself, keeping large grants
+// for large requests. Failing that it combines grants largest first, so as few grants as possible are drawn from.
+type bestFitStrategy struct{}
+
+func (bestFitStrategy) Select(candidates []v1.Grant, amount int) []v1.Allocation {
+	sortGrants(candidates, func(a, b v1.Grant) bool {
+		return a.Available < b.Available
+	})
+
+	for _, grant := range candidates {
+		if grant.Available >= amount {
+			return []v1.Allocation{allocationFor(grant, amount)}
+		}
+	}
+
+	sortGrants(candidates, func(a, b v1.Grant) bool {
+		return a.Available > b.Available
+	})
+
+	return fill(candidates, amount)
+}
+
+// sortGrants orders grants by less, breaking ties by grant id so that selection is deterministic.
+func sortGrants(grants []v1.Grant, less func(a, b v1.Grant) bool) {
+	sort.SliceStable(grants, func(i, j int) bool {
+		if less(grants[i], grants[j]) {
+			return true
+		}
+		if less(grants[j], grants[i]) {
+			return false
+		}
+		return grants[i].Id < grants[j].Id
+	})
+}
+
+// fill draws from grants in order until amount is covered.
+func fill(grants []v1.Grant, amount int) []v1.Allocation {
+	var allocations []v1.Allocation
+	remaining := amount
+	for _, grant := range grants {
+		if remaining <= 0 {
+			break
+		}
+
+		take := grant.Available
+		if take > remaining {
+			take = remaining
+		}
+
+		allocations = append(allocations, allocationFor(grant, take))
+		remaining -= take
+	}
+
+	if remaining > 0 {
+		return nil
+	}
+
+	return allocations
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func expiring(grant licensingv1.Grant, in time.Duration) licensingv1.Grant {
+	grant.NotAfter = metav1.NewTime(time.Now().Add(in))
+	return grant
+}
+
+func TestStrategies(t *testing.T) {
+	// a expires last, b first
+	grants := []licensingv1.Grant{
+		expiring(testGrant("a", "seats", 10), 72*time.Hour),
+		expiring(testGrant("b", "seats", 4), 24*time.Hour),
+		expiring(testGrant("c", "seats", 6), 48*time.Hour),
+	}
+
+	tests := []struct {
+		strategy string
+		amount   int
+		expected map[string]int
+	}{
+		{StrategyBestFit, 4, map[string]int{"b": 4}},
+		{StrategyBestFit, 5, map[string]int{"c": 5}},
+		{StrategyBestFit, 10, map[string]int{"a": 10}},
+		{StrategyBestFit, 12, map[string]int{"a": 10, "c": 2}},
+		{StrategyBestFit, 20, map[string]int{"a": 10, "c": 6, "b": 4}},
+		{StrategyBestFit, 21, nil},
+		{StrategyFirstFit, 5, map[string]int{"a": 5}},
+		{StrategyFirstFit, 12, map[string]int{"a": 10, "b": 2}},
+		{StrategyFirstFit, 21, nil},
+		{StrategyEarliestExpiryFirst, 3, map[string]int{"b": 3}},
+		{StrategyEarliestExpiryFirst, 5, map[string]int{"c": 5}},
+		{StrategyEarliestExpiryFirst, 12, map[string]int{"a": 2, "b": 4, "c": 6}},
+		{StrategyLatestExpiryFirst, 3, map[string]int{"a": 3}},
+		{StrategyLatestExpiryFirst, 12, map[string]int{"a": 10, "c": 2}},
+	}
+
+	for _, test := range tests {
+		candidates := append([]licensingv1.Grant{}, grants...)
+		allocations := strategies[test.strategy].Select(candidates, test.amount)
+		if got := allocated(allocations); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s selecting %d: expected %v, got %v", test.strategy, test.amount, test.expected, got)
+		}
+	}
+}
+
+func TestSelectGrants(t *testing.T) {
+	tests := []struct {
+		name        string
+		grants      []licensingv1.Grant
+		held        map[string]int
+		annotations map[string]string
+		amount      int
+		expected    map[string]int
+	}{
+		{
+			name:     "grants of other units are ignored",
+			grants:   []licensingv1.Grant{testGrant("a", "cores", 10), testGrant("b", "seats", 2)},
+			amount:   3,
+			expected: nil,
+		},
+		{
+			name:     "capacity held by other requests isn't offered",
+			grants:   []licensingv1.Grant{testGrant("a", "seats", 10), testGrant("b", "seats", 5)},
+			held:     map[string]int{"a": 8},
+			amount:   4,
+			expected: map[string]int{"b": 4},
+		},
+		{
+			name:     "the remaining capacity of several grants is combined",
+			grants:   []licensingv1.Grant{testGrant("a", "seats", 10), testGrant("b", "seats", 5)},
+			held:     map[string]int{"a": 8, "b": 1},
+			amount:   6,
+			expected: map[string]int{"a": 2, "b": 4},
+		},
+		{
+			name:     "fully allocated grants aren't offered",
+			grants:   []licensingv1.Grant{testGrant("a", "seats", 10)},
+			held:     map[string]int{"a": 10},
+			amount:   1,
+			expected: nil,
+		},
+		{
+			name:        "the strategy of the entitlement is used",
+			grants:      []licensingv1.Grant{testGrant("a", "seats", 10), testGrant("b", "seats", 5)},
+			annotations: map[string]string{AllocationStrategyAnnotation: StrategyBestFit},
+			amount:      4,
+			expected:    map[string]int{"b": 4},
+		},
+		{
+			name:     "first-fit is used without a strategy",
+			grants:   []licensingv1.Grant{testGrant("a", "seats", 10), testGrant("b", "seats", 5)},
+			amount:   4,
+			expected: map[string]int{"a": 4},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entitlement := testEntitlement(test.grants...)
+			entitlement.Annotations = test.annotations
+			for grant, amount := range test.held {
+				holder := testRequest("default", "holder-"+grant, "seats", amount)
+				allocate(entitlement, holder, licensingv1.GrantStatusInUse,
+					[]licensingv1.Allocation{{Grant: grant, Amount: amount}})
+			}
+
+			allocations := selectGrants(entitlement, testRequest("default", "request", "seats", test.amount))
+			if got := allocated(allocations); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+// allocated sums allocations by grant, nil if there are none.
+func allocated(allocations []licensingv1.Allocation) map[string]int {
+	if allocations == nil {
+		return nil
+	}
+
+	amounts := map[string]int{}
+	for _, a := range allocations {
+		amounts[a.Grant] += a.Amount
+	}
+
+	return amounts
+}
@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	wranglerCore "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"time"
+)
+
+// Reasons for repairs made by the consistency sweep, used for events and metrics.
+const (
+	ReasonOrphanedAllocation = "OrphanedAllocation"
+	ReasonStaleGrant         = "StaleGrant"
+	ReasonStaleQueueEntry    = "StaleQueueEntry"
+	ReasonMissingGrant       = "MissingGrant"
+	ReasonMissingEntitlement = "MissingEntitlement"
+)
+
+// Sweeper periodically compares license sources, entitlements and requests, and repairs drift
+// left behind by handlers that missed an event. Its rules are:
+//
+//   - an allocation held by a request that no longer exists, or was recreated, is released
+//   - a grant whose license is no longer at its source, e.g. the secret was deleted or unlabeled,
+//     is removed, and requests holding it go back to discover
+//   - a queued request that no longer exists or is no longer waiting is taken out of the queue
+//   - an offered or acknowledged request whose entitlement, or any grant it was offered,
+//     no longer exists goes back to discover
+//
+// Every repair is reported as an event on the object repaired, and counted in the
+// klicense_consistency_repairs_total metric.
+type Sweeper struct {
+	allocator        *Allocator
+	entitlementCache v1.EntitlementCache
+	requestCache     v1.RequestCache
+	requestClient    v1.RequestClient
+	secretCache      wranglerCore.SecretCache
+	configMapCache   wranglerCore.ConfigMapCache
+	recorder         record.EventRecorder
+	interval         time.Duration
+}
+
+func NewSweeper(
+	allocator *Allocator,
+	entitlementController v1.EntitlementController,
+	requestController v1.RequestController,
+	secretCache wranglerCore.SecretCache,
+	configMapCache wranglerCore.ConfigMapCache,
+	recorder record.EventRecorder,
+	interval time.Duration) *Sweeper {
+	return &Sweeper{
+		allocator:        allocator,
+		entitlementCache: entitlementController.Cache(),
+		requestCache:     requestController.Cache(),
+		requestClient:    requestController,
+		secretCache:      secretCache,
+		configMapCache:   configMapCache,
+		recorder:         recorder,
+		interval:         interval,
+	}
+}
+
+// Start runs the sweep every interval until ctx is done. An interval of zero disables the sweep.
+// Caches must have been started.
+func (s *Sweeper) Start(ctx context.Context) {
+	if s.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.Sweep(); err != nil {
+					logrus.Errorf("error sweeping for inconsistencies: %s", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// Sweep runs the consistency rules once over every entitlement and request.
+func (s *Sweeper) Sweep() error {
+	sweepsTotal.Inc()
+
+	entitlements, err := s.entitlementCache.List("", labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entitlements {
+		if err := s.sweepEntitlement(e.Namespace, e.Name); err != nil {
+			logrus.Errorf("error sweeping entitlement %s/%s: %s", e.Namespace, e.Name, err.Error())
+		}
+	}
+
+	requests, err := s.requestCache.List("", labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, r := range requests {
+		if err := s.sweepRequest(r); err != nil {
+			logrus.Errorf("error sweeping request %s/%s: %s", r.Namespace, r.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+type repair struct {
+	reason  string
+	message string
+}
+
+func (s *Sweeper) sweepEntitlement(namespace string, name string) error {
+	var repairs []repair
+	var affected []kubernetes.NamespacedName
+	updated, err := s.allocator.Update(namespace, name, func(entitlement *licensingv1.Entitlement) (bool, error) {
+		repairs, affected = nil, nil
+
+		for key, ra := range entitlement.Status.Allocations {
+			request, err := s.requestCache.Get(ra.Request.Namespace, ra.Request.Name)
+			if err != nil && !errors.IsNotFound(err) {
+				return false, err
+			}
+
+			if errors.IsNotFound(err) || !heldBy(ra, request) {
+				releaseGrants(entitlement, ra.Request)
+				repairs = append(repairs, repair{ReasonOrphanedAllocation,
+					fmt.Sprintf("released %d %s held by request %s, which no longer exists or was recreated", ra.Amount, ra.Unit, key)})
+			}
+		}
+
+		for id, g := range entitlement.Status.Grants {
+			_, found, err := lookupLicense(s.secretCache, s.configMapCache, g)
+			if err != nil {
+				return false, err
+			}
+
+			if !found {
+				source := GrantSource(g)
+				affected = append(affected, ProcessGrantDeletion(id, entitlement)...)
+				repairs = append(repairs, repair{ReasonStaleGrant,
+					fmt.Sprintf("removed grant %s, its license is no longer in %s %s/%s",
+						id, source.Type, source.Namespace, source.Name)})
+			}
+		}
+
+		for _, q := range pruneQueue(s.requestCache, entitlement) {
+			repairs = append(repairs, repair{ReasonStaleQueueEntry,
+				fmt.Sprintf("removed request %s from the queue, it is no longer waiting", q.Name)})
+		}
+
+		if len(repairs) == 0 {
+			return false, nil
+		}
+
+		summarize(entitlement)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range repairs {
+		s.report(updated, r)
+	}
+
+	return ResetRequests(s.requestClient.Get, s.requestClient.UpdateStatus, affected, licensingv1.ReasonGrantDeleted, "prior grant deleted")
+}
+
+func (s *Sweeper) sweepRequest(request *licensingv1.Request) error {
+	if !request.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	if request.Status.Status != licensingv1.UsageRequestStatusOffer &&
+		request.Status.Status != licensingv1.UsageRequestStatusAcknowledged {
+		return nil
+	}
+
+	var r *repair
+	entitlement, err := s.entitlementCache.Get(entitlementNamespace(request), request.Spec.Kind)
+	switch {
+	case errors.IsNotFound(err):
+		r = &repair{ReasonMissingEntitlement, fmt.Sprintf("entitlement %s no longer exists", request.Spec.Kind)}
+	case err != nil:
+		return err
+	default:
+		for _, a := range requestAllocations(request) {
+			if _, ok := entitlement.Status.Grants[a.Grant]; !ok {
+				r = &repair{ReasonMissingGrant, fmt.Sprintf("grant %s no longer exists", a.Grant)}
+				break
+			}
+		}
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	err = ResetRequests(s.requestClient.Get, s.requestClient.UpdateStatus,
+		[]kubernetes.NamespacedName{requestName(request)}, r.reason, r.message)
+	if err != nil {
+		return err
+	}
+
+	s.report(request, *r)
+	return nil
+}
+
+func (s *Sweeper) report(obj runtime.Object, r repair) {
+	logrus.Infof("consistency sweep: %s", r.message)
+	repairsTotal.WithLabelValues(r.reason).Inc()
+	s.recorder.Event(obj, corev1.EventTypeWarning, r.reason, r.message)
+}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	wranglerCore "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PodUIDAnnotation marks a request made on behalf of a pod by the pod admission webhook, and holds the
+// UID of the pod it was made for.
+const PodUIDAnnotation = "licensing.cattle.io/pod-uid"
+
+// podRequestPrefix sets requests made for pods apart from those pods make for themselves, which the
+// client library names after the pod's hostname, i.e. the pod name.
+const podRequestPrefix = "pod-"
+
+// PodRequestName returns the name of the request made for a pod by the pod admission webhook.
+func PodRequestName(pod string) string {
+	return podRequestPrefix + pod
+}
+
+// Annotations that license a workload. They can be set on a pod, or on the object that controls it,
+// e.g. a Deployment, StatefulSet, DaemonSet or Job. Kind and unit are required, amount defaults to 1.
+// By default each pod is licensed as it is admitted, see WorkloadEnforceAnnotation. Pods are only sure to
+// be checked if their pod template also has the licensing.cattle.io/licensed label, see webhook.LicensedLabel.
+const (
+	WorkloadKindAnnotation     = "licensing.cattle.io/kind"
+	WorkloadUnitAnnotation     = "licensing.cattle.io/unit"
+	WorkloadAmountAnnotation   = "licensing.cattle.io/amount"
+	WorkloadPriorityAnnotation = "licensing.cattle.io/priority"
+	// WorkloadEnforceAnnotation chooses how a workload is licensed, EnforcePods or EnforceReplicas
+	WorkloadEnforceAnnotation = "licensing.cattle.io/enforce"
+)
+
+const (
+	// EnforcePods licenses each pod of a workload as it is admitted
+	EnforcePods = "pods"
+	// EnforceReplicas licenses a Deployment or StatefulSet for its replica count, with amount units
+	// per replica, and denies scaling it beyond what is licensed
+	EnforceReplicas = "replicas"
+)
+
+// unboundGracePeriod is how long a request made for a pod is kept before the pod exists. The pod is only
+// created once it is admitted, so until then the request can't be owned by it.
+const unboundGracePeriod = 2 * time.Minute
+
+// WorkloadHandler has requests made for pods owned by their pod once it exists, so they are deleted, and
+// their capacity released, along with it. Requests for pods that were never created, e.g. because they
+// were denied while waiting for capacity, are deleted.
+type WorkloadHandler struct {
+	enqueueAfter  func(namespace string, name string, duration time.Duration)
+	requestClient v1.RequestClient
+	podClient     wranglerCore.PodClient
+}
+
+func (w *WorkloadHandler) OnRequestChanged(key string, request *licensingv1.Request) (*licensingv1.Request, error) {
+	if request == nil || !request.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	uid, ok := request.Annotations[PodUIDAnnotation]
+	if !ok || ownedBy(request, types.UID(uid)) {
+		return nil, nil
+	}
+
+	pod, err := w.podClient.Get(request.Namespace, strings.TrimPrefix(request.Name, podRequestPrefix), metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if err == nil && pod.UID == types.UID(uid) {
+		return nil, w.bind(request, metav1.OwnerReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       pod.Name,
+			UID:        pod.UID,
+		})
+	}
+
+	// the pod may still be being admitted
+	if remaining := time.Until(request.CreationTimestamp.Add(unboundGracePeriod)); remaining > 0 {
+		w.enqueueAfter(request.Namespace, request.Name, remaining)
+		return nil, nil
+	}
+
+	logrus.Infof("pod %s/%s that request %s was made for was never created, deleting the request",
+		request.Namespace, strings.TrimPrefix(request.Name, podRequestPrefix), request.Name)
+	err = w.requestClient.Delete(request.Namespace, request.Name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &request.UID},
+	})
+	if errors.IsNotFound(err) || errors.IsConflict(err) {
+		return nil, nil
+	}
+
+	return nil, err
+}
+
+func (w *WorkloadHandler) bind(request *licensingv1.Request, owner metav1.OwnerReference) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := w.requestClient.Get(request.Namespace, request.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if latest.UID != request.UID {
+			return fmt.Errorf("request %s/%s was recreated", request.Namespace, request.Name)
+		}
+
+		latest = latest.DeepCopy()
+		latest.OwnerReferences = append(latest.OwnerReferences, owner)
+		_, err = w.requestClient.Update(latest)
+		return err
+	})
+}
+
+func ownedBy(request *licensingv1.Request, uid types.UID) bool {
+	for _, ref := range request.OwnerReferences {
+		if ref.UID == uid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WorkloadSpec reads what a workload asks to be licensed for from its annotations.
+func WorkloadSpec(annotations map[string]string) (licensingv1.RequestSpec, error) {
+	spec := licensingv1.RequestSpec{
+		Kind:   annotations[WorkloadKindAnnotation],
+		Unit:   annotations[WorkloadUnitAnnotation],
+		Amount: 1,
+	}
+
+	if spec.Kind == "" || spec.Unit == "" {
+		return spec, fmt.Errorf("licensed workloads need the %s and %s annotations", WorkloadKindAnnotation, WorkloadUnitAnnotation)
+	}
+
+	if value, ok := annotations[WorkloadAmountAnnotation]; ok {
+		amount, err := strconv.Atoi(value)
+		if err != nil || amount < 1 {
+			return spec, fmt.Errorf("%s must be a number of at least 1, got %q", WorkloadAmountAnnotation, value)
+		}
+		spec.Amount = amount
+	}
+
+	if value, ok := annotations[WorkloadPriorityAnnotation]; ok {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			return spec, fmt.Errorf("%s must be a number, got %q", WorkloadPriorityAnnotation, value)
+		}
+		spec.Priority = priority
+	}
+
+	return spec, nil
+}
@@ -3,47 +3,111 @@ package crd
 import (
 	"context"
 	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/api/v1beta2"
 	"github.com/rancher/wrangler/pkg/crd"
-	"k8s.io/apimachinery/pkg/runtime/schema"
+	"github.com/rancher/wrangler/pkg/schemas/openapi"
+	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	schema2 "k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/rest"
+	"path/filepath"
+	"reflect"
 )
 
-func Create(ctx context.Context, cfg *rest.Config) error {
+// Create installs the CRDs. With a conversion webhook, entitlements are served as both v1 and v1beta2
+// and stored as v1beta2; without one they are served and stored as v1 only. Entitlements already stored
+// as v1beta2 can't be served without conversion, so Create refuses to go back to v1 only.
+func Create(ctx context.Context, cfg *rest.Config, conversion *apiextv1.WebhookConversion) error {
+	if conversion == nil {
+		if err := requireV1Storage(ctx, cfg); err != nil {
+			return err
+		}
+	}
+
 	factory, err := crd.NewFactoryFromClient(cfg)
 	if err != nil {
 		return err
 	}
 
-	return factory.BatchCreateCRDs(ctx, List()...).BatchWait()
+	return factory.BatchCreateCRDs(ctx, List(conversion)...).BatchWait()
 }
 
-func List() []crd.CRD {
+func List(conversion *apiextv1.WebhookConversion) []crd.CRD {
+	entitlement := newCRD(&v1.Entitlement{}, validateEntitlement, entitlementColumns)
+	if conversion != nil {
+		entitlement = multiVersion(v1beta2.SchemeGroupVersion.Version, conversion,
+			entitlement,
+			newCRD(&v1beta2.Entitlement{}, validateEntitlementV1beta2, entitlementColumns))
+	}
+
 	return []crd.CRD{
-		newCRD(&v1.Request{}, func(c crd.CRD) crd.CRD {
+		newCRD(&v1.Request{}, validateRequest, func(c crd.CRD) crd.CRD {
 			return c.
+				WithShortNames("lreq").
+				WithCategories("licensing").
 				WithColumn("Kind", ".spec.kind").
 				WithColumn("Unit", ".spec.unit").
 				WithColumn("Amount", ".spec.amount").
-				WithColumn("Status", ".status.status")
+				WithColumn("Priority", ".spec.priority").
+				WithColumn("Status", ".status.status").
+				WithColumn("Ready", `.status.conditions[?(@.type=="Ready")].status`).
+				WithColumn("Reason", `.status.conditions[?(@.type=="Ready")].reason`).
+				WithColumn("Queue Position", ".status.queuePosition")
+		}),
+		entitlement,
+		newCRD(&v1.EntitlementBinding{}, validateBinding, func(c crd.CRD) crd.CRD {
+			return c.
+				WithShortNames("entb").
+				WithCategories("licensing").
+				WithColumn("Kinds", ".spec.kinds").
+				WithColumn("Ready", `.status.conditions[?(@.type=="Ready")].status`).
+				WithColumn("Reason", `.status.conditions[?(@.type=="Ready")].reason`).
+				WithColumn("Namespaces", ".status.namespaces")
 		}),
-		newCRD(&v1.Entitlement{}, func(c crd.CRD) crd.CRD {
+		newCRD(&v1.LicenseQuota{}, validateQuota, func(c crd.CRD) crd.CRD {
 			return c.
-				WithColumn("Licenses", ".status.licenses").
-				WithColumn("Units", ".status.units").
-				WithColumn("Earliest Expiration", ".status.earliestExpiration")
+				WithShortNames("lquota").
+				WithCategories("licensing").
+				WithColumn("Kind", ".spec.kind").
+				WithColumn("Hard", ".status.hard").
+				WithColumn("Used", ".status.used")
 		}),
 	}
 }
 
+// entitlementColumns are the same in every version, as the summary stays in the status.
+func entitlementColumns(c crd.CRD) crd.CRD {
+	return c.
+		WithShortNames("ent").
+		WithCategories("licensing").
+		WithColumn("Ready", `.status.conditions[?(@.type=="Ready")].status`).
+		WithColumn("Expiring", `.status.conditions[?(@.type=="Expiring")].status`).
+		WithColumn("Degraded", `.status.conditions[?(@.type=="Degraded")].status`).
+		WithColumn("Compliant", `.status.conditions[?(@.type=="Compliant")].status`).
+		WithColumn("Licenses", ".status.licenses").
+		WithColumn("Units", ".status.units").
+		WithColumn("Used", ".status.used").
+		WithColumn("Available", ".status.available").
+		WithColumn("Waiting", ".status.waiting").
+		WithColumn("Earliest Expiration", ".status.earliestExpiration")
+}
+
+// newCRD builds a CRD with a structural schema generated from obj, which validate then adds to.
+func newCRD(obj interface{}, validate func(schema *apiextv1.JSONSchemaProps), customize func(crd.CRD) crd.CRD) crd.CRD {
+	schema := openapi.MustGenerate(obj)
+	if validate != nil {
+		validate(schema)
+	}
 
-func newCRD(obj interface{}, customize func(crd.CRD) crd.CRD) crd.CRD {
 	crd := crd.CRD{
-		GVK: schema.GroupVersionKind{
+		GVK: schema2.GroupVersionKind{
 			Group: "licensing.cattle.io",
-			Version: "v1",
+			Version: filepath.Base(reflect.TypeOf(obj).Elem().PkgPath()),
+			Kind: reflect.TypeOf(obj).Elem().Name(),
 		},
 		Status: true,
-		SchemaObject: obj,
+		Schema: schema,
 	}
 
 	if customize != nil {
@@ -51,4 +115,52 @@ func newCRD(obj interface{}, customize func(crd.CRD) crd.CRD) crd.CRD {
 	}
 
 	return crd
-}
\ No newline at end of file
+}
+
+// multiVersion combines CRDs for versions of the same kind into one, stored as the storage version and
+// converted between versions by a webhook. Panics if the CRDs can't be combined, as that is a
+// programming error, the same as a schema that can't be generated.
+func multiVersion(storage string, conversion *apiextv1.WebhookConversion, crds ...crd.CRD) crd.CRD {
+	var combined *apiextv1.CustomResourceDefinition
+	for _, c := range crds {
+		obj, err := c.ToCustomResourceDefinition()
+		if err != nil {
+			panic(err)
+		}
+
+		def := &apiextv1.CustomResourceDefinition{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).Object, def); err != nil {
+			panic(err)
+		}
+
+		versions := def.Spec.Versions
+		if combined == nil {
+			combined = def
+			combined.Spec.Versions = nil
+		}
+
+		for _, version := range versions {
+			version.Storage = version.Name == storage
+			combined.Spec.Versions = append(combined.Spec.Versions, version)
+		}
+	}
+
+	combined.Spec.Conversion = &apiextv1.CustomResourceConversion{
+		Strategy: apiextv1.WebhookConverter,
+		Webhook:  conversion,
+	}
+
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(combined)
+	if err != nil {
+		panic(err)
+	}
+	data["kind"] = crd.CRDKind
+	data["apiVersion"] = apiextv1.SchemeGroupVersion.String()
+	if err := unstructured.SetNestedField(data, false, "spec", "preserveUnknownFields"); err != nil {
+		panic(err)
+	}
+
+	result := crds[0]
+	result.Override = &unstructured.Unstructured{Object: data}
+	return result
+}
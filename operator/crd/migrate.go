@@ -0,0 +1,105 @@
+package crd
+
+import (
+	"context"
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	"github.com/sirupsen/logrus"
+	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+const entitlementCRD = "entitlements.licensing.cattle.io"
+
+// MigrateStorage rewrites every entitlement stored in an older version in the storage version, then
+// records on the CRD that no entitlement is stored in an older version, so that version can be removed.
+// Rewriting an unchanged object is enough, the api server converts it on the way to storage.
+func MigrateStorage(ctx context.Context, cfg *rest.Config, entitlementClient v1.EntitlementClient) error {
+	crds, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	def, err := crds.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, entitlementCRD, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	storage := storageVersion(def)
+	if len(def.Status.StoredVersions) == 1 && def.Status.StoredVersions[0] == storage {
+		return nil
+	}
+
+	logrus.Infof("migrating entitlements from versions %v to %s", def.Status.StoredVersions, storage)
+
+	entitlements, err := entitlementClient.List("", metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entitlements.Items {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			latest, err := entitlementClient.Get(e.Namespace, e.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+
+			_, err = entitlementClient.Update(latest)
+			return err
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := crds.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, entitlementCRD, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		latest.Status.StoredVersions = []string{storageVersion(latest)}
+		_, err = crds.ApiextensionsV1().CustomResourceDefinitions().UpdateStatus(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// requireV1Storage fails if any entitlement may be stored in a version other than v1.
+func requireV1Storage(ctx context.Context, cfg *rest.Config) error {
+	crds, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	def, err := crds.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, entitlementCRD, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, version := range def.Status.StoredVersions {
+		if version != licensingv1.SchemeGroupVersion.Version {
+			return fmt.Errorf("entitlements are stored as %s, which needs the conversion webhook: "+
+				"run the operator with --webhook-address", version)
+		}
+	}
+
+	return nil
+}
+
+func storageVersion(def *apiextv1.CustomResourceDefinition) string {
+	for _, version := range def.Spec.Versions {
+		if version.Storage {
+			return version.Name
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,186 @@
+package crd
+
+import (
+	"encoding/json"
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/license"
+	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+// validateRequest adds the validation that can't be expressed with struct tags to the Request schema.
+func validateRequest(schema *apiextv1.JSONSchemaProps) {
+	spec := schema.Properties["spec"]
+	schema.Required = append(schema.Required, "spec")
+
+	kind := spec.Properties["kind"]
+	kind.Pattern = "^" + license.EntitlementNamePattern + "$"
+	kind.XValidations = append(kind.XValidations, immutable("kind"))
+	spec.Properties["kind"] = kind
+
+	unit := spec.Properties["unit"]
+	unit.XValidations = append(unit.XValidations, immutable("unit"))
+	spec.Properties["unit"] = unit
+
+	schema.Properties["spec"] = spec
+
+	status := schema.Properties["status"]
+	setEnum(&status, "status", "",
+		string(v1.UsageRequestStatusDiscover),
+		string(v1.UsageRequestStatusOffer),
+		string(v1.UsageRequestStatusAcknowledged),
+		string(v1.UsageRequestStatusExpired))
+	status.XValidations = append(status.XValidations,
+		apiextv1.ValidationRule{
+			Rule:    "self.status != 'Offer' || (has(self.allocations) && size(self.allocations) > 0) || (has(self.grant) && self.grant != '')",
+			Message: "an offer must include what is offered",
+		},
+		apiextv1.ValidationRule{
+			Rule:    "!has(self.queuePosition) || self.queuePosition == 0 || self.status == 'Discover'",
+			Message: "only requests in Discover can be queued",
+		},
+	)
+	schema.Properties["status"] = status
+}
+
+// validateBinding adds the validation that can't be expressed with struct tags to the EntitlementBinding schema.
+func validateBinding(schema *apiextv1.JSONSchemaProps) {
+	spec := schema.Properties["spec"]
+	schema.Required = append(schema.Required, "spec")
+
+	kinds := spec.Properties["kinds"]
+	if kinds.Items != nil && kinds.Items.Schema != nil {
+		kinds.Items.Schema.Pattern = "^" + license.EntitlementNamePattern + "$"
+	}
+	spec.Properties["kinds"] = kinds
+
+	spec.XValidations = append(spec.XValidations, apiextv1.ValidationRule{
+		Rule:    "(has(self.namespaces) && size(self.namespaces) > 0) || has(self.namespaceSelector)",
+		Message: "a binding must name the namespaces it binds or select them",
+	})
+	schema.Properties["spec"] = spec
+}
+
+// validateQuota adds the validation that can't be expressed with struct tags to the LicenseQuota schema.
+func validateQuota(schema *apiextv1.JSONSchemaProps) {
+	spec := schema.Properties["spec"]
+	schema.Required = append(schema.Required, "spec")
+
+	kind := spec.Properties["kind"]
+	kind.Pattern = "^" + license.EntitlementNamePattern + "$"
+	spec.Properties["kind"] = kind
+
+	hard := spec.Properties["hard"]
+	if hard.AdditionalProperties != nil && hard.AdditionalProperties.Schema != nil {
+		minimum := float64(0)
+		hard.AdditionalProperties.Schema.Minimum = &minimum
+	}
+	spec.Properties["hard"] = hard
+
+	schema.Properties["spec"] = spec
+}
+
+// validateEntitlement adds the validation that can't be expressed with struct tags to the v1 Entitlement schema.
+func validateEntitlement(schema *apiextv1.JSONSchemaProps) {
+	status := schema.Properties["status"]
+
+	grants := status.Properties["grants"]
+	if grants.AdditionalProperties != nil && grants.AdditionalProperties.Schema != nil {
+		grant := grants.AdditionalProperties.Schema
+		setEnum(grant, "grantStatus", grantStatuses...)
+		validateGrantSource(grant)
+		grant.XValidations = append(grant.XValidations, apiextv1.ValidationRule{
+			Rule:    "self.available <= self.amount",
+			Message: "a grant can't have more capacity available than its license grants",
+		})
+	}
+	status.Properties["grants"] = grants
+
+	validateAllocations(&status)
+	validateOverage(&status)
+	schema.Properties["status"] = status
+}
+
+// validateEntitlementV1beta2 adds the validation that can't be expressed with struct tags to the
+// v1beta2 Entitlement schema.
+func validateEntitlementV1beta2(schema *apiextv1.JSONSchemaProps) {
+	spec := schema.Properties["spec"]
+	grants := spec.Properties["grants"]
+	if grants.AdditionalProperties != nil && grants.AdditionalProperties.Schema != nil {
+		validateGrantSource(grants.AdditionalProperties.Schema)
+	}
+	spec.Properties["grants"] = grants
+	schema.Properties["spec"] = spec
+
+	status := schema.Properties["status"]
+	allocated := status.Properties["grants"]
+	if allocated.AdditionalProperties != nil && allocated.AdditionalProperties.Schema != nil {
+		setEnum(allocated.AdditionalProperties.Schema, "grantStatus", grantStatuses...)
+	}
+	status.Properties["grants"] = allocated
+
+	validateAllocations(&status)
+	validateOverage(&status)
+	schema.Properties["status"] = status
+}
+
+func validateGrantSource(grant *apiextv1.JSONSchemaProps) {
+	source := grant.Properties["source"]
+	// grants projected before sources were recorded have an empty source
+	setEnum(&source, "type", "",
+		string(v1.LicenseSourceSecret),
+		string(v1.LicenseSourceConfigMap),
+		string(v1.LicenseSourceDirectory),
+		string(v1.LicenseSourceHTTP))
+	grant.Properties["source"] = source
+}
+
+func validateAllocations(status *apiextv1.JSONSchemaProps) {
+	allocations := status.Properties["allocations"]
+	if allocations.AdditionalProperties != nil && allocations.AdditionalProperties.Schema != nil {
+		setEnum(allocations.AdditionalProperties.Schema, "status", grantStatuses...)
+	}
+	status.Properties["allocations"] = allocations
+}
+
+func validateOverage(status *apiextv1.JSONSchemaProps) {
+	overage := status.Properties["overage"]
+	if overage.AdditionalProperties != nil && overage.AdditionalProperties.Schema != nil {
+		setEnum(overage.AdditionalProperties.Schema, "phase", overagePhases...)
+		setEnum(overage.AdditionalProperties.Schema, "reported", append([]string{""}, overagePhases...)...)
+	}
+	status.Properties["overage"] = overage
+}
+
+func immutable(field string) apiextv1.ValidationRule {
+	return apiextv1.ValidationRule{
+		Rule:    "self == oldSelf",
+		Message: field + " is immutable",
+	}
+}
+
+var grantStatuses = []string{
+	string(v1.GrantStatusFree),
+	string(v1.GrantStatusPending),
+	string(v1.GrantStatusInUse),
+}
+
+var overagePhases = []string{
+	string(v1.OveragePhaseOpen),
+	string(v1.OveragePhaseClosing),
+	string(v1.OveragePhaseClosed),
+}
+
+// setEnum restricts a string property of schema to values.
+func setEnum(schema *apiextv1.JSONSchemaProps, property string, values ...string) {
+	prop, ok := schema.Properties[property]
+	if !ok {
+		return
+	}
+
+	prop.Enum = nil
+	for _, value := range values {
+		raw, _ := json.Marshal(value)
+		prop.Enum = append(prop.Enum, apiextv1.JSON{Raw: raw})
+	}
+	schema.Properties[property] = prop
+}
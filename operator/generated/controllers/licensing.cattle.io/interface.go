@@ -9,11 +9,13 @@ package licensing
 
 import (
 	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	v1beta2 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1beta2"
 	"github.com/rancher/lasso/pkg/controller"
 )
 
 type Interface interface {
 	V1() v1.Interface
+	V1beta2() v1beta2.Interface
 }
 
 type group struct {
@@ -30,3 +32,7 @@ func New(controllerFactory controller.SharedControllerFactory) Interface {
 func (g *group) V1() v1.Interface {
 	return v1.New(g.controllerFactory)
 }
+
+func (g *group) V1beta2() v1beta2.Interface {
+	return v1beta2.New(g.controllerFactory)
+}
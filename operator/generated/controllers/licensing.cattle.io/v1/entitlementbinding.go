@@ -0,0 +1,365 @@
+/*
+Copyright 2022.
+
+All Rights Reserved
+*/
+// Code generated by main. DO NOT EDIT.
+
+package v1
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/rancher/lasso/pkg/client"
+	"github.com/rancher/lasso/pkg/controller"
+	"github.com/rancher/wrangler/pkg/apply"
+	"github.com/rancher/wrangler/pkg/condition"
+	"github.com/rancher/wrangler/pkg/generic"
+	"github.com/rancher/wrangler/pkg/kv"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+type EntitlementBindingHandler func(string, *v1.EntitlementBinding) (*v1.EntitlementBinding, error)
+
+type EntitlementBindingController interface {
+	generic.ControllerMeta
+	EntitlementBindingClient
+
+	OnChange(ctx context.Context, name string, sync EntitlementBindingHandler)
+	OnRemove(ctx context.Context, name string, sync EntitlementBindingHandler)
+	Enqueue(namespace, name string)
+	EnqueueAfter(namespace, name string, duration time.Duration)
+
+	Cache() EntitlementBindingCache
+}
+
+type EntitlementBindingClient interface {
+	Create(*v1.EntitlementBinding) (*v1.EntitlementBinding, error)
+	Update(*v1.EntitlementBinding) (*v1.EntitlementBinding, error)
+	UpdateStatus(*v1.EntitlementBinding) (*v1.EntitlementBinding, error)
+	Delete(namespace, name string, options *metav1.DeleteOptions) error
+	Get(namespace, name string, options metav1.GetOptions) (*v1.EntitlementBinding, error)
+	List(namespace string, opts metav1.ListOptions) (*v1.EntitlementBindingList, error)
+	Watch(namespace string, opts metav1.ListOptions) (watch.Interface, error)
+	Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (result *v1.EntitlementBinding, err error)
+}
+
+type EntitlementBindingCache interface {
+	Get(namespace, name string) (*v1.EntitlementBinding, error)
+	List(namespace string, selector labels.Selector) ([]*v1.EntitlementBinding, error)
+
+	AddIndexer(indexName string, indexer EntitlementBindingIndexer)
+	GetByIndex(indexName, key string) ([]*v1.EntitlementBinding, error)
+}
+
+type EntitlementBindingIndexer func(obj *v1.EntitlementBinding) ([]string, error)
+
+type entitlementBindingController struct {
+	controller    controller.SharedController
+	client        *client.Client
+	gvk           schema.GroupVersionKind
+	groupResource schema.GroupResource
+}
+
+func NewEntitlementBindingController(gvk schema.GroupVersionKind, resource string, namespaced bool, controller controller.SharedControllerFactory) EntitlementBindingController {
+	c := controller.ForResourceKind(gvk.GroupVersion().WithResource(resource), gvk.Kind, namespaced)
+	return &entitlementBindingController{
+		controller: c,
+		client:     c.Client(),
+		gvk:        gvk,
+		groupResource: schema.GroupResource{
+			Group:    gvk.Group,
+			Resource: resource,
+		},
+	}
+}
+
+func FromEntitlementBindingHandlerToHandler(sync EntitlementBindingHandler) generic.Handler {
+	return func(key string, obj runtime.Object) (ret runtime.Object, err error) {
+		var v *v1.EntitlementBinding
+		if obj == nil {
+			v, err = sync(key, nil)
+		} else {
+			v, err = sync(key, obj.(*v1.EntitlementBinding))
+		}
+		if v == nil {
+			return nil, err
+		}
+		return v, err
+	}
+}
+
+func (c *entitlementBindingController) Updater() generic.Updater {
+	return func(obj runtime.Object) (runtime.Object, error) {
+		newObj, err := c.Update(obj.(*v1.EntitlementBinding))
+		if newObj == nil {
+			return nil, err
+		}
+		return newObj, err
+	}
+}
+
+func UpdateEntitlementBindingDeepCopyOnChange(client EntitlementBindingClient, obj *v1.EntitlementBinding, handler func(obj *v1.EntitlementBinding) (*v1.EntitlementBinding, error)) (*v1.EntitlementBinding, error) {
+	if obj == nil {
+		return obj, nil
+	}
+
+	copyObj := obj.DeepCopy()
+	newObj, err := handler(copyObj)
+	if newObj != nil {
+		copyObj = newObj
+	}
+	if obj.ResourceVersion == copyObj.ResourceVersion && !equality.Semantic.DeepEqual(obj, copyObj) {
+		return client.Update(copyObj)
+	}
+
+	return copyObj, err
+}
+
+func (c *entitlementBindingController) AddGenericHandler(ctx context.Context, name string, handler generic.Handler) {
+	c.controller.RegisterHandler(ctx, name, controller.SharedControllerHandlerFunc(handler))
+}
+
+func (c *entitlementBindingController) AddGenericRemoveHandler(ctx context.Context, name string, handler generic.Handler) {
+	c.AddGenericHandler(ctx, name, generic.NewRemoveHandler(name, c.Updater(), handler))
+}
+
+func (c *entitlementBindingController) OnChange(ctx context.Context, name string, sync EntitlementBindingHandler) {
+	c.AddGenericHandler(ctx, name, FromEntitlementBindingHandlerToHandler(sync))
+}
+
+func (c *entitlementBindingController) OnRemove(ctx context.Context, name string, sync EntitlementBindingHandler) {
+	c.AddGenericHandler(ctx, name, generic.NewRemoveHandler(name, c.Updater(), FromEntitlementBindingHandlerToHandler(sync)))
+}
+
+func (c *entitlementBindingController) Enqueue(namespace, name string) {
+	c.controller.Enqueue(namespace, name)
+}
+
+func (c *entitlementBindingController) EnqueueAfter(namespace, name string, duration time.Duration) {
+	c.controller.EnqueueAfter(namespace, name, duration)
+}
+
+func (c *entitlementBindingController) Informer() cache.SharedIndexInformer {
+	return c.controller.Informer()
+}
+
+func (c *entitlementBindingController) GroupVersionKind() schema.GroupVersionKind {
+	return c.gvk
+}
+
+func (c *entitlementBindingController) Cache() EntitlementBindingCache {
+	return &entitlementBindingCache{
+		indexer:  c.Informer().GetIndexer(),
+		resource: c.groupResource,
+	}
+}
+
+func (c *entitlementBindingController) Create(obj *v1.EntitlementBinding) (*v1.EntitlementBinding, error) {
+	result := &v1.EntitlementBinding{}
+	return result, c.client.Create(context.TODO(), obj.Namespace, obj, result, metav1.CreateOptions{})
+}
+
+func (c *entitlementBindingController) Update(obj *v1.EntitlementBinding) (*v1.EntitlementBinding, error) {
+	result := &v1.EntitlementBinding{}
+	return result, c.client.Update(context.TODO(), obj.Namespace, obj, result, metav1.UpdateOptions{})
+}
+
+func (c *entitlementBindingController) UpdateStatus(obj *v1.EntitlementBinding) (*v1.EntitlementBinding, error) {
+	result := &v1.EntitlementBinding{}
+	return result, c.client.UpdateStatus(context.TODO(), obj.Namespace, obj, result, metav1.UpdateOptions{})
+}
+
+func (c *entitlementBindingController) Delete(namespace, name string, options *metav1.DeleteOptions) error {
+	if options == nil {
+		options = &metav1.DeleteOptions{}
+	}
+	return c.client.Delete(context.TODO(), namespace, name, *options)
+}
+
+func (c *entitlementBindingController) Get(namespace, name string, options metav1.GetOptions) (*v1.EntitlementBinding, error) {
+	result := &v1.EntitlementBinding{}
+	return result, c.client.Get(context.TODO(), namespace, name, result, options)
+}
+
+func (c *entitlementBindingController) List(namespace string, opts metav1.ListOptions) (*v1.EntitlementBindingList, error) {
+	result := &v1.EntitlementBindingList{}
+	return result, c.client.List(context.TODO(), namespace, result, opts)
+}
+
+func (c *entitlementBindingController) Watch(namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	return c.client.Watch(context.TODO(), namespace, opts)
+}
+
+func (c *entitlementBindingController) Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (*v1.EntitlementBinding, error) {
+	result := &v1.EntitlementBinding{}
+	return result, c.client.Patch(context.TODO(), namespace, name, pt, data, result, metav1.PatchOptions{}, subresources...)
+}
+
+type entitlementBindingCache struct {
+	indexer  cache.Indexer
+	resource schema.GroupResource
+}
+
+func (c *entitlementBindingCache) Get(namespace, name string) (*v1.EntitlementBinding, error) {
+	obj, exists, err := c.indexer.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(c.resource, name)
+	}
+	return obj.(*v1.EntitlementBinding), nil
+}
+
+func (c *entitlementBindingCache) List(namespace string, selector labels.Selector) (ret []*v1.EntitlementBinding, err error) {
+
+	err = cache.ListAllByNamespace(c.indexer, namespace, selector, func(m interface{}) {
+		ret = append(ret, m.(*v1.EntitlementBinding))
+	})
+
+	return ret, err
+}
+
+func (c *entitlementBindingCache) AddIndexer(indexName string, indexer EntitlementBindingIndexer) {
+	utilruntime.Must(c.indexer.AddIndexers(map[string]cache.IndexFunc{
+		indexName: func(obj interface{}) (strings []string, e error) {
+			return indexer(obj.(*v1.EntitlementBinding))
+		},
+	}))
+}
+
+func (c *entitlementBindingCache) GetByIndex(indexName, key string) (result []*v1.EntitlementBinding, err error) {
+	objs, err := c.indexer.ByIndex(indexName, key)
+	if err != nil {
+		return nil, err
+	}
+	result = make([]*v1.EntitlementBinding, 0, len(objs))
+	for _, obj := range objs {
+		result = append(result, obj.(*v1.EntitlementBinding))
+	}
+	return result, nil
+}
+
+type EntitlementBindingStatusHandler func(obj *v1.EntitlementBinding, status v1.EntitlementBindingStatus) (v1.EntitlementBindingStatus, error)
+
+type EntitlementBindingGeneratingHandler func(obj *v1.EntitlementBinding, status v1.EntitlementBindingStatus) ([]runtime.Object, v1.EntitlementBindingStatus, error)
+
+func RegisterEntitlementBindingStatusHandler(ctx context.Context, controller EntitlementBindingController, condition condition.Cond, name string, handler EntitlementBindingStatusHandler) {
+	statusHandler := &entitlementBindingStatusHandler{
+		client:    controller,
+		condition: condition,
+		handler:   handler,
+	}
+	controller.AddGenericHandler(ctx, name, FromEntitlementBindingHandlerToHandler(statusHandler.sync))
+}
+
+func RegisterEntitlementBindingGeneratingHandler(ctx context.Context, controller EntitlementBindingController, apply apply.Apply,
+	condition condition.Cond, name string, handler EntitlementBindingGeneratingHandler, opts *generic.GeneratingHandlerOptions) {
+	statusHandler := &entitlementBindingGeneratingHandler{
+		EntitlementBindingGeneratingHandler: handler,
+		apply:                               apply,
+		name:                                name,
+		gvk:                                 controller.GroupVersionKind(),
+	}
+	if opts != nil {
+		statusHandler.opts = *opts
+	}
+	controller.OnChange(ctx, name, statusHandler.Remove)
+	RegisterEntitlementBindingStatusHandler(ctx, controller, condition, name, statusHandler.Handle)
+}
+
+type entitlementBindingStatusHandler struct {
+	client    EntitlementBindingClient
+	condition condition.Cond
+	handler   EntitlementBindingStatusHandler
+}
+
+func (a *entitlementBindingStatusHandler) sync(key string, obj *v1.EntitlementBinding) (*v1.EntitlementBinding, error) {
+	if obj == nil {
+		return obj, nil
+	}
+
+	origStatus := obj.Status.DeepCopy()
+	obj = obj.DeepCopy()
+	newStatus, err := a.handler(obj, obj.Status)
+	if err != nil {
+		// Revert to old status on error
+		newStatus = *origStatus.DeepCopy()
+	}
+
+	if a.condition != "" {
+		if errors.IsConflict(err) {
+			a.condition.SetError(&newStatus, "", nil)
+		} else {
+			a.condition.SetError(&newStatus, "", err)
+		}
+	}
+	if !equality.Semantic.DeepEqual(origStatus, &newStatus) {
+		if a.condition != "" {
+			// Since status has changed, update the lastUpdatedTime
+			a.condition.LastUpdated(&newStatus, time.Now().UTC().Format(time.RFC3339))
+		}
+
+		var newErr error
+		obj.Status = newStatus
+		newObj, newErr := a.client.UpdateStatus(obj)
+		if err == nil {
+			err = newErr
+		}
+		if newErr == nil {
+			obj = newObj
+		}
+	}
+	return obj, err
+}
+
+type entitlementBindingGeneratingHandler struct {
+	EntitlementBindingGeneratingHandler
+	apply apply.Apply
+	opts  generic.GeneratingHandlerOptions
+	gvk   schema.GroupVersionKind
+	name  string
+}
+
+func (a *entitlementBindingGeneratingHandler) Remove(key string, obj *v1.EntitlementBinding) (*v1.EntitlementBinding, error) {
+	if obj != nil {
+		return obj, nil
+	}
+
+	obj = &v1.EntitlementBinding{}
+	obj.Namespace, obj.Name = kv.RSplit(key, "/")
+	obj.SetGroupVersionKind(a.gvk)
+
+	return nil, generic.ConfigureApplyForObject(a.apply, obj, &a.opts).
+		WithOwner(obj).
+		WithSetID(a.name).
+		ApplyObjects()
+}
+
+func (a *entitlementBindingGeneratingHandler) Handle(obj *v1.EntitlementBinding, status v1.EntitlementBindingStatus) (v1.EntitlementBindingStatus, error) {
+	if !obj.DeletionTimestamp.IsZero() {
+		return status, nil
+	}
+
+	objs, newStatus, err := a.EntitlementBindingGeneratingHandler(obj, status)
+	if err != nil {
+		return newStatus, err
+	}
+
+	return newStatus, generic.ConfigureApplyForObject(a.apply, obj, &a.opts).
+		WithOwner(obj).
+		WithSetID(a.name).
+		ApplyObjects(objs...)
+}
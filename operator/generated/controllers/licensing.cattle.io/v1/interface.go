@@ -20,6 +20,8 @@ func init() {
 
 type Interface interface {
 	Entitlement() EntitlementController
+	EntitlementBinding() EntitlementBindingController
+	LicenseQuota() LicenseQuotaController
 	Request() RequestController
 }
 
@@ -36,6 +38,12 @@ type version struct {
 func (c *version) Entitlement() EntitlementController {
 	return NewEntitlementController(schema.GroupVersionKind{Group: "licensing.cattle.io", Version: "v1", Kind: "Entitlement"}, "entitlements", true, c.controllerFactory)
 }
+func (c *version) EntitlementBinding() EntitlementBindingController {
+	return NewEntitlementBindingController(schema.GroupVersionKind{Group: "licensing.cattle.io", Version: "v1", Kind: "EntitlementBinding"}, "entitlementbindings", true, c.controllerFactory)
+}
+func (c *version) LicenseQuota() LicenseQuotaController {
+	return NewLicenseQuotaController(schema.GroupVersionKind{Group: "licensing.cattle.io", Version: "v1", Kind: "LicenseQuota"}, "licensequotas", true, c.controllerFactory)
+}
 func (c *version) Request() RequestController {
 	return NewRequestController(schema.GroupVersionKind{Group: "licensing.cattle.io", Version: "v1", Kind: "Request"}, "requests", true, c.controllerFactory)
 }
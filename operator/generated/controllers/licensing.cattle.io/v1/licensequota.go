@@ -0,0 +1,365 @@
+/*
+Copyright 2022.
+
+All Rights Reserved
+*/
+// Code generated by main. DO NOT EDIT.
+
+package v1
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/rancher/lasso/pkg/client"
+	"github.com/rancher/lasso/pkg/controller"
+	"github.com/rancher/wrangler/pkg/apply"
+	"github.com/rancher/wrangler/pkg/condition"
+	"github.com/rancher/wrangler/pkg/generic"
+	"github.com/rancher/wrangler/pkg/kv"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+type LicenseQuotaHandler func(string, *v1.LicenseQuota) (*v1.LicenseQuota, error)
+
+type LicenseQuotaController interface {
+	generic.ControllerMeta
+	LicenseQuotaClient
+
+	OnChange(ctx context.Context, name string, sync LicenseQuotaHandler)
+	OnRemove(ctx context.Context, name string, sync LicenseQuotaHandler)
+	Enqueue(namespace, name string)
+	EnqueueAfter(namespace, name string, duration time.Duration)
+
+	Cache() LicenseQuotaCache
+}
+
+type LicenseQuotaClient interface {
+	Create(*v1.LicenseQuota) (*v1.LicenseQuota, error)
+	Update(*v1.LicenseQuota) (*v1.LicenseQuota, error)
+	UpdateStatus(*v1.LicenseQuota) (*v1.LicenseQuota, error)
+	Delete(namespace, name string, options *metav1.DeleteOptions) error
+	Get(namespace, name string, options metav1.GetOptions) (*v1.LicenseQuota, error)
+	List(namespace string, opts metav1.ListOptions) (*v1.LicenseQuotaList, error)
+	Watch(namespace string, opts metav1.ListOptions) (watch.Interface, error)
+	Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (result *v1.LicenseQuota, err error)
+}
+
+type LicenseQuotaCache interface {
+	Get(namespace, name string) (*v1.LicenseQuota, error)
+	List(namespace string, selector labels.Selector) ([]*v1.LicenseQuota, error)
+
+	AddIndexer(indexName string, indexer LicenseQuotaIndexer)
+	GetByIndex(indexName, key string) ([]*v1.LicenseQuota, error)
+}
+
+type LicenseQuotaIndexer func(obj *v1.LicenseQuota) ([]string, error)
+
+type licenseQuotaController struct {
+	controller    controller.SharedController
+	client        *client.Client
+	gvk           schema.GroupVersionKind
+	groupResource schema.GroupResource
+}
+
+func NewLicenseQuotaController(gvk schema.GroupVersionKind, resource string, namespaced bool, controller controller.SharedControllerFactory) LicenseQuotaController {
+	c := controller.ForResourceKind(gvk.GroupVersion().WithResource(resource), gvk.Kind, namespaced)
+	return &licenseQuotaController{
+		controller: c,
+		client:     c.Client(),
+		gvk:        gvk,
+		groupResource: schema.GroupResource{
+			Group:    gvk.Group,
+			Resource: resource,
+		},
+	}
+}
+
+func FromLicenseQuotaHandlerToHandler(sync LicenseQuotaHandler) generic.Handler {
+	return func(key string, obj runtime.Object) (ret runtime.Object, err error) {
+		var v *v1.LicenseQuota
+		if obj == nil {
+			v, err = sync(key, nil)
+		} else {
+			v, err = sync(key, obj.(*v1.LicenseQuota))
+		}
+		if v == nil {
+			return nil, err
+		}
+		return v, err
+	}
+}
+
+func (c *licenseQuotaController) Updater() generic.Updater {
+	return func(obj runtime.Object) (runtime.Object, error) {
+		newObj, err := c.Update(obj.(*v1.LicenseQuota))
+		if newObj == nil {
+			return nil, err
+		}
+		return newObj, err
+	}
+}
+
+func UpdateLicenseQuotaDeepCopyOnChange(client LicenseQuotaClient, obj *v1.LicenseQuota, handler func(obj *v1.LicenseQuota) (*v1.LicenseQuota, error)) (*v1.LicenseQuota, error) {
+	if obj == nil {
+		return obj, nil
+	}
+
+	copyObj := obj.DeepCopy()
+	newObj, err := handler(copyObj)
+	if newObj != nil {
+		copyObj = newObj
+	}
+	if obj.ResourceVersion == copyObj.ResourceVersion && !equality.Semantic.DeepEqual(obj, copyObj) {
+		return client.Update(copyObj)
+	}
+
+	return copyObj, err
+}
+
+func (c *licenseQuotaController) AddGenericHandler(ctx context.Context, name string, handler generic.Handler) {
+	c.controller.RegisterHandler(ctx, name, controller.SharedControllerHandlerFunc(handler))
+}
+
+func (c *licenseQuotaController) AddGenericRemoveHandler(ctx context.Context, name string, handler generic.Handler) {
+	c.AddGenericHandler(ctx, name, generic.NewRemoveHandler(name, c.Updater(), handler))
+}
+
+func (c *licenseQuotaController) OnChange(ctx context.Context, name string, sync LicenseQuotaHandler) {
+	c.AddGenericHandler(ctx, name, FromLicenseQuotaHandlerToHandler(sync))
+}
+
+func (c *licenseQuotaController) OnRemove(ctx context.Context, name string, sync LicenseQuotaHandler) {
+	c.AddGenericHandler(ctx, name, generic.NewRemoveHandler(name, c.Updater(), FromLicenseQuotaHandlerToHandler(sync)))
+}
+
+func (c *licenseQuotaController) Enqueue(namespace, name string) {
+	c.controller.Enqueue(namespace, name)
+}
+
+func (c *licenseQuotaController) EnqueueAfter(namespace, name string, duration time.Duration) {
+	c.controller.EnqueueAfter(namespace, name, duration)
+}
+
+func (c *licenseQuotaController) Informer() cache.SharedIndexInformer {
+	return c.controller.Informer()
+}
+
+func (c *licenseQuotaController) GroupVersionKind() schema.GroupVersionKind {
+	return c.gvk
+}
+
+func (c *licenseQuotaController) Cache() LicenseQuotaCache {
+	return &licenseQuotaCache{
+		indexer:  c.Informer().GetIndexer(),
+		resource: c.groupResource,
+	}
+}
+
+func (c *licenseQuotaController) Create(obj *v1.LicenseQuota) (*v1.LicenseQuota, error) {
+	result := &v1.LicenseQuota{}
+	return result, c.client.Create(context.TODO(), obj.Namespace, obj, result, metav1.CreateOptions{})
+}
+
+func (c *licenseQuotaController) Update(obj *v1.LicenseQuota) (*v1.LicenseQuota, error) {
+	result := &v1.LicenseQuota{}
+	return result, c.client.Update(context.TODO(), obj.Namespace, obj, result, metav1.UpdateOptions{})
+}
+
+func (c *licenseQuotaController) UpdateStatus(obj *v1.LicenseQuota) (*v1.LicenseQuota, error) {
+	result := &v1.LicenseQuota{}
+	return result, c.client.UpdateStatus(context.TODO(), obj.Namespace, obj, result, metav1.UpdateOptions{})
+}
+
+func (c *licenseQuotaController) Delete(namespace, name string, options *metav1.DeleteOptions) error {
+	if options == nil {
+		options = &metav1.DeleteOptions{}
+	}
+	return c.client.Delete(context.TODO(), namespace, name, *options)
+}
+
+func (c *licenseQuotaController) Get(namespace, name string, options metav1.GetOptions) (*v1.LicenseQuota, error) {
+	result := &v1.LicenseQuota{}
+	return result, c.client.Get(context.TODO(), namespace, name, result, options)
+}
+
+func (c *licenseQuotaController) List(namespace string, opts metav1.ListOptions) (*v1.LicenseQuotaList, error) {
+	result := &v1.LicenseQuotaList{}
+	return result, c.client.List(context.TODO(), namespace, result, opts)
+}
+
+func (c *licenseQuotaController) Watch(namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	return c.client.Watch(context.TODO(), namespace, opts)
+}
+
+func (c *licenseQuotaController) Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (*v1.LicenseQuota, error) {
+	result := &v1.LicenseQuota{}
+	return result, c.client.Patch(context.TODO(), namespace, name, pt, data, result, metav1.PatchOptions{}, subresources...)
+}
+
+type licenseQuotaCache struct {
+	indexer  cache.Indexer
+	resource schema.GroupResource
+}
+
+func (c *licenseQuotaCache) Get(namespace, name string) (*v1.LicenseQuota, error) {
+	obj, exists, err := c.indexer.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(c.resource, name)
+	}
+	return obj.(*v1.LicenseQuota), nil
+}
+
+func (c *licenseQuotaCache) List(namespace string, selector labels.Selector) (ret []*v1.LicenseQuota, err error) {
+
+	err = cache.ListAllByNamespace(c.indexer, namespace, selector, func(m interface{}) {
+		ret = append(ret, m.(*v1.LicenseQuota))
+	})
+
+	return ret, err
+}
+
+func (c *licenseQuotaCache) AddIndexer(indexName string, indexer LicenseQuotaIndexer) {
+	utilruntime.Must(c.indexer.AddIndexers(map[string]cache.IndexFunc{
+		indexName: func(obj interface{}) (strings []string, e error) {
+			return indexer(obj.(*v1.LicenseQuota))
+		},
+	}))
+}
+
+func (c *licenseQuotaCache) GetByIndex(indexName, key string) (result []*v1.LicenseQuota, err error) {
+	objs, err := c.indexer.ByIndex(indexName, key)
+	if err != nil {
+		return nil, err
+	}
+	result = make([]*v1.LicenseQuota, 0, len(objs))
+	for _, obj := range objs {
+		result = append(result, obj.(*v1.LicenseQuota))
+	}
+	return result, nil
+}
+
+type LicenseQuotaStatusHandler func(obj *v1.LicenseQuota, status v1.LicenseQuotaStatus) (v1.LicenseQuotaStatus, error)
+
+type LicenseQuotaGeneratingHandler func(obj *v1.LicenseQuota, status v1.LicenseQuotaStatus) ([]runtime.Object, v1.LicenseQuotaStatus, error)
+
+func RegisterLicenseQuotaStatusHandler(ctx context.Context, controller LicenseQuotaController, condition condition.Cond, name string, handler LicenseQuotaStatusHandler) {
+	statusHandler := &licenseQuotaStatusHandler{
+		client:    controller,
+		condition: condition,
+		handler:   handler,
+	}
+	controller.AddGenericHandler(ctx, name, FromLicenseQuotaHandlerToHandler(statusHandler.sync))
+}
+
+func RegisterLicenseQuotaGeneratingHandler(ctx context.Context, controller LicenseQuotaController, apply apply.Apply,
+	condition condition.Cond, name string, handler LicenseQuotaGeneratingHandler, opts *generic.GeneratingHandlerOptions) {
+	statusHandler := &licenseQuotaGeneratingHandler{
+		LicenseQuotaGeneratingHandler: handler,
+		apply:                         apply,
+		name:                          name,
+		gvk:                           controller.GroupVersionKind(),
+	}
+	if opts != nil {
+		statusHandler.opts = *opts
+	}
+	controller.OnChange(ctx, name, statusHandler.Remove)
+	RegisterLicenseQuotaStatusHandler(ctx, controller, condition, name, statusHandler.Handle)
+}
+
+type licenseQuotaStatusHandler struct {
+	client    LicenseQuotaClient
+	condition condition.Cond
+	handler   LicenseQuotaStatusHandler
+}
+
+func (a *licenseQuotaStatusHandler) sync(key string, obj *v1.LicenseQuota) (*v1.LicenseQuota, error) {
+	if obj == nil {
+		return obj, nil
+	}
+
+	origStatus := obj.Status.DeepCopy()
+	obj = obj.DeepCopy()
+	newStatus, err := a.handler(obj, obj.Status)
+	if err != nil {
+		// Revert to old status on error
+		newStatus = *origStatus.DeepCopy()
+	}
+
+	if a.condition != "" {
+		if errors.IsConflict(err) {
+			a.condition.SetError(&newStatus, "", nil)
+		} else {
+			a.condition.SetError(&newStatus, "", err)
+		}
+	}
+	if !equality.Semantic.DeepEqual(origStatus, &newStatus) {
+		if a.condition != "" {
+			// Since status has changed, update the lastUpdatedTime
+			a.condition.LastUpdated(&newStatus, time.Now().UTC().Format(time.RFC3339))
+		}
+
+		var newErr error
+		obj.Status = newStatus
+		newObj, newErr := a.client.UpdateStatus(obj)
+		if err == nil {
+			err = newErr
+		}
+		if newErr == nil {
+			obj = newObj
+		}
+	}
+	return obj, err
+}
+
+type licenseQuotaGeneratingHandler struct {
+	LicenseQuotaGeneratingHandler
+	apply apply.Apply
+	opts  generic.GeneratingHandlerOptions
+	gvk   schema.GroupVersionKind
+	name  string
+}
+
+func (a *licenseQuotaGeneratingHandler) Remove(key string, obj *v1.LicenseQuota) (*v1.LicenseQuota, error) {
+	if obj != nil {
+		return obj, nil
+	}
+
+	obj = &v1.LicenseQuota{}
+	obj.Namespace, obj.Name = kv.RSplit(key, "/")
+	obj.SetGroupVersionKind(a.gvk)
+
+	return nil, generic.ConfigureApplyForObject(a.apply, obj, &a.opts).
+		WithOwner(obj).
+		WithSetID(a.name).
+		ApplyObjects()
+}
+
+func (a *licenseQuotaGeneratingHandler) Handle(obj *v1.LicenseQuota, status v1.LicenseQuotaStatus) (v1.LicenseQuotaStatus, error) {
+	if !obj.DeletionTimestamp.IsZero() {
+		return status, nil
+	}
+
+	objs, newStatus, err := a.LicenseQuotaGeneratingHandler(obj, status)
+	if err != nil {
+		return newStatus, err
+	}
+
+	return newStatus, generic.ConfigureApplyForObject(a.apply, obj, &a.opts).
+		WithOwner(obj).
+		WithSetID(a.name).
+		ApplyObjects(objs...)
+}
@@ -0,0 +1,365 @@
+/*
+Copyright 2022.
+
+All Rights Reserved
+*/
+// Code generated by main. DO NOT EDIT.
+
+package v1beta2
+
+import (
+	"context"
+	"time"
+
+	v1beta2 "github.com/ebauman/klicense/api/v1beta2"
+	"github.com/rancher/lasso/pkg/client"
+	"github.com/rancher/lasso/pkg/controller"
+	"github.com/rancher/wrangler/pkg/apply"
+	"github.com/rancher/wrangler/pkg/condition"
+	"github.com/rancher/wrangler/pkg/generic"
+	"github.com/rancher/wrangler/pkg/kv"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+type EntitlementHandler func(string, *v1beta2.Entitlement) (*v1beta2.Entitlement, error)
+
+type EntitlementController interface {
+	generic.ControllerMeta
+	EntitlementClient
+
+	OnChange(ctx context.Context, name string, sync EntitlementHandler)
+	OnRemove(ctx context.Context, name string, sync EntitlementHandler)
+	Enqueue(namespace, name string)
+	EnqueueAfter(namespace, name string, duration time.Duration)
+
+	Cache() EntitlementCache
+}
+
+type EntitlementClient interface {
+	Create(*v1beta2.Entitlement) (*v1beta2.Entitlement, error)
+	Update(*v1beta2.Entitlement) (*v1beta2.Entitlement, error)
+	UpdateStatus(*v1beta2.Entitlement) (*v1beta2.Entitlement, error)
+	Delete(namespace, name string, options *metav1.DeleteOptions) error
+	Get(namespace, name string, options metav1.GetOptions) (*v1beta2.Entitlement, error)
+	List(namespace string, opts metav1.ListOptions) (*v1beta2.EntitlementList, error)
+	Watch(namespace string, opts metav1.ListOptions) (watch.Interface, error)
+	Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (result *v1beta2.Entitlement, err error)
+}
+
+type EntitlementCache interface {
+	Get(namespace, name string) (*v1beta2.Entitlement, error)
+	List(namespace string, selector labels.Selector) ([]*v1beta2.Entitlement, error)
+
+	AddIndexer(indexName string, indexer EntitlementIndexer)
+	GetByIndex(indexName, key string) ([]*v1beta2.Entitlement, error)
+}
+
+type EntitlementIndexer func(obj *v1beta2.Entitlement) ([]string, error)
+
+type entitlementController struct {
+	controller    controller.SharedController
+	client        *client.Client
+	gvk           schema.GroupVersionKind
+	groupResource schema.GroupResource
+}
+
+func NewEntitlementController(gvk schema.GroupVersionKind, resource string, namespaced bool, controller controller.SharedControllerFactory) EntitlementController {
+	c := controller.ForResourceKind(gvk.GroupVersion().WithResource(resource), gvk.Kind, namespaced)
+	return &entitlementController{
+		controller: c,
+		client:     c.Client(),
+		gvk:        gvk,
+		groupResource: schema.GroupResource{
+			Group:    gvk.Group,
+			Resource: resource,
+		},
+	}
+}
+
+func FromEntitlementHandlerToHandler(sync EntitlementHandler) generic.Handler {
+	return func(key string, obj runtime.Object) (ret runtime.Object, err error) {
+		var v *v1beta2.Entitlement
+		if obj == nil {
+			v, err = sync(key, nil)
+		} else {
+			v, err = sync(key, obj.(*v1beta2.Entitlement))
+		}
+		if v == nil {
+			return nil, err
+		}
+		return v, err
+	}
+}
+
+func (c *entitlementController) Updater() generic.Updater {
+	return func(obj runtime.Object) (runtime.Object, error) {
+		newObj, err := c.Update(obj.(*v1beta2.Entitlement))
+		if newObj == nil {
+			return nil, err
+		}
+		return newObj, err
+	}
+}
+
+func UpdateEntitlementDeepCopyOnChange(client EntitlementClient, obj *v1beta2.Entitlement, handler func(obj *v1beta2.Entitlement) (*v1beta2.Entitlement, error)) (*v1beta2.Entitlement, error) {
+	if obj == nil {
+		return obj, nil
+	}
+
+	copyObj := obj.DeepCopy()
+	newObj, err := handler(copyObj)
+	if newObj != nil {
+		copyObj = newObj
+	}
+	if obj.ResourceVersion == copyObj.ResourceVersion && !equality.Semantic.DeepEqual(obj, copyObj) {
+		return client.Update(copyObj)
+	}
+
+	return copyObj, err
+}
+
+func (c *entitlementController) AddGenericHandler(ctx context.Context, name string, handler generic.Handler) {
+	c.controller.RegisterHandler(ctx, name, controller.SharedControllerHandlerFunc(handler))
+}
+
+func (c *entitlementController) AddGenericRemoveHandler(ctx context.Context, name string, handler generic.Handler) {
+	c.AddGenericHandler(ctx, name, generic.NewRemoveHandler(name, c.Updater(), handler))
+}
+
+func (c *entitlementController) OnChange(ctx context.Context, name string, sync EntitlementHandler) {
+	c.AddGenericHandler(ctx, name, FromEntitlementHandlerToHandler(sync))
+}
+
+func (c *entitlementController) OnRemove(ctx context.Context, name string, sync EntitlementHandler) {
+	c.AddGenericHandler(ctx, name, generic.NewRemoveHandler(name, c.Updater(), FromEntitlementHandlerToHandler(sync)))
+}
+
+func (c *entitlementController) Enqueue(namespace, name string) {
+	c.controller.Enqueue(namespace, name)
+}
+
+func (c *entitlementController) EnqueueAfter(namespace, name string, duration time.Duration) {
+	c.controller.EnqueueAfter(namespace, name, duration)
+}
+
+func (c *entitlementController) Informer() cache.SharedIndexInformer {
+	return c.controller.Informer()
+}
+
+func (c *entitlementController) GroupVersionKind() schema.GroupVersionKind {
+	return c.gvk
+}
+
+func (c *entitlementController) Cache() EntitlementCache {
+	return &entitlementCache{
+		indexer:  c.Informer().GetIndexer(),
+		resource: c.groupResource,
+	}
+}
+
+func (c *entitlementController) Create(obj *v1beta2.Entitlement) (*v1beta2.Entitlement, error) {
+	result := &v1beta2.Entitlement{}
+	return result, c.client.Create(context.TODO(), obj.Namespace, obj, result, metav1.CreateOptions{})
+}
+
+func (c *entitlementController) Update(obj *v1beta2.Entitlement) (*v1beta2.Entitlement, error) {
+	result := &v1beta2.Entitlement{}
+	return result, c.client.Update(context.TODO(), obj.Namespace, obj, result, metav1.UpdateOptions{})
+}
+
+func (c *entitlementController) UpdateStatus(obj *v1beta2.Entitlement) (*v1beta2.Entitlement, error) {
+	result := &v1beta2.Entitlement{}
+	return result, c.client.UpdateStatus(context.TODO(), obj.Namespace, obj, result, metav1.UpdateOptions{})
+}
+
+func (c *entitlementController) Delete(namespace, name string, options *metav1.DeleteOptions) error {
+	if options == nil {
+		options = &metav1.DeleteOptions{}
+	}
+	return c.client.Delete(context.TODO(), namespace, name, *options)
+}
+
+func (c *entitlementController) Get(namespace, name string, options metav1.GetOptions) (*v1beta2.Entitlement, error) {
+	result := &v1beta2.Entitlement{}
+	return result, c.client.Get(context.TODO(), namespace, name, result, options)
+}
+
+func (c *entitlementController) List(namespace string, opts metav1.ListOptions) (*v1beta2.EntitlementList, error) {
+	result := &v1beta2.EntitlementList{}
+	return result, c.client.List(context.TODO(), namespace, result, opts)
+}
+
+func (c *entitlementController) Watch(namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	return c.client.Watch(context.TODO(), namespace, opts)
+}
+
+func (c *entitlementController) Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (*v1beta2.Entitlement, error) {
+	result := &v1beta2.Entitlement{}
+	return result, c.client.Patch(context.TODO(), namespace, name, pt, data, result, metav1.PatchOptions{}, subresources...)
+}
+
+type entitlementCache struct {
+	indexer  cache.Indexer
+	resource schema.GroupResource
+}
+
+func (c *entitlementCache) Get(namespace, name string) (*v1beta2.Entitlement, error) {
+	obj, exists, err := c.indexer.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(c.resource, name)
+	}
+	return obj.(*v1beta2.Entitlement), nil
+}
+
+func (c *entitlementCache) List(namespace string, selector labels.Selector) (ret []*v1beta2.Entitlement, err error) {
+
+	err = cache.ListAllByNamespace(c.indexer, namespace, selector, func(m interface{}) {
+		ret = append(ret, m.(*v1beta2.Entitlement))
+	})
+
+	return ret, err
+}
+
+func (c *entitlementCache) AddIndexer(indexName string, indexer EntitlementIndexer) {
+	utilruntime.Must(c.indexer.AddIndexers(map[string]cache.IndexFunc{
+		indexName: func(obj interface{}) (strings []string, e error) {
+			return indexer(obj.(*v1beta2.Entitlement))
+		},
+	}))
+}
+
+func (c *entitlementCache) GetByIndex(indexName, key string) (result []*v1beta2.Entitlement, err error) {
+	objs, err := c.indexer.ByIndex(indexName, key)
+	if err != nil {
+		return nil, err
+	}
+	result = make([]*v1beta2.Entitlement, 0, len(objs))
+	for _, obj := range objs {
+		result = append(result, obj.(*v1beta2.Entitlement))
+	}
+	return result, nil
+}
+
+type EntitlementStatusHandler func(obj *v1beta2.Entitlement, status v1beta2.EntitlementStatus) (v1beta2.EntitlementStatus, error)
+
+type EntitlementGeneratingHandler func(obj *v1beta2.Entitlement, status v1beta2.EntitlementStatus) ([]runtime.Object, v1beta2.EntitlementStatus, error)
+
+func RegisterEntitlementStatusHandler(ctx context.Context, controller EntitlementController, condition condition.Cond, name string, handler EntitlementStatusHandler) {
+	statusHandler := &entitlementStatusHandler{
+		client:    controller,
+		condition: condition,
+		handler:   handler,
+	}
+	controller.AddGenericHandler(ctx, name, FromEntitlementHandlerToHandler(statusHandler.sync))
+}
+
+func RegisterEntitlementGeneratingHandler(ctx context.Context, controller EntitlementController, apply apply.Apply,
+	condition condition.Cond, name string, handler EntitlementGeneratingHandler, opts *generic.GeneratingHandlerOptions) {
+	statusHandler := &entitlementGeneratingHandler{
+		EntitlementGeneratingHandler: handler,
+		apply:                        apply,
+		name:                         name,
+		gvk:                          controller.GroupVersionKind(),
+	}
+	if opts != nil {
+		statusHandler.opts = *opts
+	}
+	controller.OnChange(ctx, name, statusHandler.Remove)
+	RegisterEntitlementStatusHandler(ctx, controller, condition, name, statusHandler.Handle)
+}
+
+type entitlementStatusHandler struct {
+	client    EntitlementClient
+	condition condition.Cond
+	handler   EntitlementStatusHandler
+}
+
+func (a *entitlementStatusHandler) sync(key string, obj *v1beta2.Entitlement) (*v1beta2.Entitlement, error) {
+	if obj == nil {
+		return obj, nil
+	}
+
+	origStatus := obj.Status.DeepCopy()
+	obj = obj.DeepCopy()
+	newStatus, err := a.handler(obj, obj.Status)
+	if err != nil {
+		// Revert to old status on error
+		newStatus = *origStatus.DeepCopy()
+	}
+
+	if a.condition != "" {
+		if errors.IsConflict(err) {
+			a.condition.SetError(&newStatus, "", nil)
+		} else {
+			a.condition.SetError(&newStatus, "", err)
+		}
+	}
+	if !equality.Semantic.DeepEqual(origStatus, &newStatus) {
+		if a.condition != "" {
+			// Since status has changed, update the lastUpdatedTime
+			a.condition.LastUpdated(&newStatus, time.Now().UTC().Format(time.RFC3339))
+		}
+
+		var newErr error
+		obj.Status = newStatus
+		newObj, newErr := a.client.UpdateStatus(obj)
+		if err == nil {
+			err = newErr
+		}
+		if newErr == nil {
+			obj = newObj
+		}
+	}
+	return obj, err
+}
+
+type entitlementGeneratingHandler struct {
+	EntitlementGeneratingHandler
+	apply apply.Apply
+	opts  generic.GeneratingHandlerOptions
+	gvk   schema.GroupVersionKind
+	name  string
+}
+
+func (a *entitlementGeneratingHandler) Remove(key string, obj *v1beta2.Entitlement) (*v1beta2.Entitlement, error) {
+	if obj != nil {
+		return obj, nil
+	}
+
+	obj = &v1beta2.Entitlement{}
+	obj.Namespace, obj.Name = kv.RSplit(key, "/")
+	obj.SetGroupVersionKind(a.gvk)
+
+	return nil, generic.ConfigureApplyForObject(a.apply, obj, &a.opts).
+		WithOwner(obj).
+		WithSetID(a.name).
+		ApplyObjects()
+}
+
+func (a *entitlementGeneratingHandler) Handle(obj *v1beta2.Entitlement, status v1beta2.EntitlementStatus) (v1beta2.EntitlementStatus, error) {
+	if !obj.DeletionTimestamp.IsZero() {
+		return status, nil
+	}
+
+	objs, newStatus, err := a.EntitlementGeneratingHandler(obj, status)
+	if err != nil {
+		return newStatus, err
+	}
+
+	return newStatus, generic.ConfigureApplyForObject(a.apply, obj, &a.opts).
+		WithOwner(obj).
+		WithSetID(a.name).
+		ApplyObjects(objs...)
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2022.
+
+All Rights Reserved
+*/
+// Code generated by main. DO NOT EDIT.
+
+package v1beta2
+
+import (
+	v1beta2 "github.com/ebauman/klicense/api/v1beta2"
+	"github.com/rancher/lasso/pkg/controller"
+	"github.com/rancher/wrangler/pkg/schemes"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func init() {
+	schemes.Register(v1beta2.AddToScheme)
+}
+
+type Interface interface {
+	Entitlement() EntitlementController
+}
+
+func New(controllerFactory controller.SharedControllerFactory) Interface {
+	return &version{
+		controllerFactory: controllerFactory,
+	}
+}
+
+type version struct {
+	controllerFactory controller.SharedControllerFactory
+}
+
+func (c *version) Entitlement() EntitlementController {
+	return NewEntitlementController(schema.GroupVersionKind{Group: "licensing.cattle.io", Version: "v1beta2", Kind: "Entitlement"}, "entitlements", true, c.controllerFactory)
+}
@@ -2,30 +2,118 @@ package main
 
 import (
 	"flag"
+	"github.com/ebauman/klicense/license"
 	"github.com/ebauman/klicense/operator/controllers"
 	"github.com/ebauman/klicense/operator/crd"
 	"github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io"
+	"github.com/ebauman/klicense/operator/webhook"
+	wranglerApps "github.com/rancher/wrangler-api/pkg/generated/controllers/apps"
 	wranglerCore "github.com/rancher/wrangler-api/pkg/generated/controllers/core"
+	wranglerCorev1 "github.com/rancher/wrangler-api/pkg/generated/controllers/core/v1"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rancher/wrangler/pkg/kubeconfig"
+	"github.com/rancher/wrangler/pkg/schemes"
 	"github.com/rancher/wrangler/pkg/signals"
 	"github.com/rancher/wrangler/pkg/start"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"net/http"
+	"time"
 )
 
 var (
 	kubeconfigFile string
 	installCRD bool
+	licenseKeys string
+
+	licenseSources string
+	sourceNamespace string
+	licenseNamespace string
+	licenseDir string
+	licenseDirResync time.Duration
+	licenseURL string
+	licenseURLInterval time.Duration
+
+	allocationStrategy string
+	preemption bool
+	offerTimeout time.Duration
+	expiryWarning time.Duration
+	overageWarning time.Duration
+
+	sweepInterval time.Duration
+	metricsAddress string
+
+	webhookAddress string
+	webhookService string
+	webhookNamespace string
+	webhookPort int
+	webhookSecret string
+	licenseSecretPolicy string
+	podAdmissionTimeout time.Duration
+
+	measureInterval time.Duration
 )
 
 func init() {
 	flag.StringVar(&kubeconfigFile, "kubeconfig", "", "Path to a kubeconfig file. Only required if out-of-cluster")
 	flag.BoolVar(&installCRD, "installcrd", true, "Install new version of CRD")
+	flag.StringVar(&licenseKeys, "license-keys", "license", "Comma-separated data keys (glob patterns allowed) to read licenses from in license secrets. Overridden per secret by the "+license.DataKeysAnnotation+" annotation")
+	flag.StringVar(&licenseSources, "sources", "secret", "Comma-separated license sources to enable: secret, configmap, directory, http")
+	flag.StringVar(&sourceNamespace, "source-namespace", "default", "Namespace that entitlements for licenses from the directory and http sources are created in")
+	flag.StringVar(&licenseNamespace, "license-namespace", "", "Only honour EntitlementBindings in this namespace, where licenses shared with other namespaces are installed. Empty honours bindings in any namespace, which is only safe if creating them is restricted")
+	flag.StringVar(&licenseDir, "license-dir", "", "Directory to read license files from when the directory source is enabled")
+	flag.DurationVar(&licenseDirResync, "license-dir-resync", 5*time.Minute, "How often to rescan the license directory in addition to watching it")
+	flag.StringVar(&licenseURL, "license-url", "", "URL to fetch licenses from when the http source is enabled")
+	flag.DurationVar(&licenseURLInterval, "license-url-interval", 10*time.Minute, "How often to poll the license URL")
+	flag.StringVar(&allocationStrategy, "allocation-strategy", controllers.StrategyFirstFit, "Default strategy for choosing grants: first-fit, best-fit, earliest-expiry-first or latest-expiry-first. Overridden per entitlement by the "+controllers.AllocationStrategyAnnotation+" annotation")
+	flag.BoolVar(&preemption, "preemption", false, "Allow higher priority requests to evict lower priority requests when capacity is short. Overridden per entitlement by the "+controllers.PreemptionAnnotation+" annotation")
+	flag.DurationVar(&offerTimeout, "offer-timeout", 2*time.Minute, "How long a client has to acknowledge an offer before it is offered to the next waiting request. 0 waits forever")
+	flag.DurationVar(&expiryWarning, "expiry-warning", 30*24*time.Hour, "How long before a license expires that its entitlement is marked Expiring")
+	flag.DurationVar(&overageWarning, "overage-warning", 7*24*time.Hour, "How long before the overage window of a unit closes that it is reported as closing. Overage is allowed by a license, and can be limited per entitlement by the "+controllers.OveragePercentAnnotation+" and "+controllers.OverageDaysAnnotation+" annotations")
+	flag.DurationVar(&sweepInterval, "sweep-interval", 10*time.Minute, "How often to check license sources, entitlements and requests against each other and repair drift. 0 disables")
+	flag.StringVar(&metricsAddress, "metrics-address", ":8080", "Address to serve prometheus metrics on. Empty disables")
+	flag.StringVar(&webhookAddress, "webhook-address", "", "Address to serve webhooks on, e.g. :9443: entitlement conversion between v1 and v1beta2, request and license secret validation, licensed pod admission, and scaling of workloads licensed by their replicas. The api server reaches them through --webhook-service, which has to exist. Empty disables webhooks: entitlements are then served and stored as v1 only, without v1beta2 or its storage migration, and the operator refuses to start if they are already stored as v1beta2")
+	flag.StringVar(&webhookService, "webhook-service", "klicense-operator", "Name of the service the api server reaches webhooks through")
+	flag.StringVar(&webhookNamespace, "webhook-namespace", "klicense-system", "Namespace of the webhook service, and of the secret holding its certificate")
+	flag.IntVar(&webhookPort, "webhook-port", 443, "Port of the webhook service")
+	flag.StringVar(&webhookSecret, "webhook-secret", "klicense-webhook-tls", "Secret to keep the webhook serving certificate in. Generated if it doesn't exist")
+	flag.StringVar(&licenseSecretPolicy, "license-secret-policy", webhook.PolicyWarn, "What the validating webhook does with a license secret that holds no valid license: warn or reject")
+	flag.DurationVar(&podAdmissionTimeout, "pod-admission-timeout", 10*time.Second, "How long admitting a licensed pod waits for a license before the pod is denied. The api server waits 30s at most for a webhook")
+	flag.DurationVar(&measureInterval, "measure-interval", 5*time.Minute, "How often to measure units of entitlements annotated with "+controllers.MeasureAnnotation+" from the cluster. 0 disables")
 	flag.Parse()
 }
 
 func main() {
 	ctx := signals.SetupSignalContext()
 
+	if keys := license.SplitKeys(licenseKeys); len(keys) > 0 {
+		license.DefaultDataKeys = keys
+	}
+
+	if err := controllers.ValidateStrategy(allocationStrategy); err != nil {
+		logrus.Fatalf("error parsing allocation strategy: %s", err.Error())
+	}
+	controllers.DefaultAllocationStrategy = allocationStrategy
+	controllers.DefaultPreemption = preemption
+	controllers.DefaultOfferTimeout = offerTimeout
+	controllers.ExpiryWarning = expiryWarning
+	controllers.OverageWarning = overageWarning
+	controllers.LicenseNamespace = licenseNamespace
+	if licenseNamespace == "" {
+		logrus.Warn("--license-namespace is not set, so EntitlementBindings in any namespace are honoured: " +
+			"anyone who can create one in a namespace can share that namespace's licenses with any other")
+	}
+
+	if err := webhook.ValidatePolicy(licenseSecretPolicy); err != nil {
+		logrus.Fatalf("error parsing license secret policy: %s", err.Error())
+	}
+	webhook.LicenseSecretPolicy = licenseSecretPolicy
+	webhook.PodAdmissionTimeout = podAdmissionTimeout
+
 	cfg, err := kubeconfig.GetNonInteractiveClientConfig(kubeconfigFile).ClientConfig()
 	if err != nil {
 		logrus.Fatalf("Error building kubeconfig: %s", err.Error())
@@ -35,30 +123,177 @@ func main() {
 
 	wrangler := wranglerCore.NewFactoryFromConfigOrDie(cfg)
 
+	apps := wranglerApps.NewFactoryFromConfigOrDie(cfg)
+
+	kube, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		logrus.Fatalf("error building kubernetes client: %s", err.Error())
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kube.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(schemes.All, corev1.EventSource{Component: "klicense-operator"})
+
+	// the conversion webhook has to be up before entitlements are stored as v1beta2
+	var conversion *apiextv1.WebhookConversion
+	var caBundle []byte
+	var server *webhook.Server
+	service := webhook.Service{Namespace: webhookNamespace, Name: webhookService, Port: int32(webhookPort)}
+	if webhookAddress != "" {
+		certificate, err := webhook.EnsureCertificate(ctx, kube, webhookNamespace, webhookSecret, webhookService)
+		if err != nil {
+			logrus.Fatalf("error loading webhook certificate: %s", err.Error())
+		}
+		caBundle = certificate.CABundle
+
+		resolver := controllers.NewEntitlementResolver(
+			licensingFactory.Licensing().V1().Entitlement(),
+			licensingFactory.Licensing().V1().EntitlementBinding(),
+			wrangler.Core().V1().Namespace())
+
+		server = webhook.NewServer(webhookAddress, certificate)
+		server.Handle(webhook.ConversionPath, webhook.ConversionHandler{})
+		server.HandleAfterSync(webhook.RequestValidationPath,
+			webhook.NewAdmissionHandler(webhook.NewRequestValidator(licensingFactory.Licensing().V1().Entitlement(), resolver).Admit))
+		server.HandleAfterSync(webhook.SecretValidationPath, webhook.NewAdmissionHandler(webhook.AdmitSecret))
+		server.HandleAfterSync(webhook.PodMutationPath, webhook.NewMutatingHandler(webhook.NewPodMutator(kube).Mutate))
+		server.HandleAfterSync(webhook.PodValidationPath,
+			webhook.NewAdmissionHandler(webhook.NewPodValidator(licensingFactory.Licensing().V1().Request()).Admit))
+		server.HandleAfterSync(webhook.ReplicaValidationPath,
+			webhook.NewAdmissionHandler(webhook.NewReplicaValidator(
+				kube,
+				licensingFactory.Licensing().V1().Entitlement(),
+				licensingFactory.Licensing().V1().Request(),
+				resolver,
+				controllers.NewQuotaChecker(licensingFactory.Licensing().V1().LicenseQuota(), licensingFactory.Licensing().V1().Request()),
+				recorder).Admit))
+		server.Start(ctx)
+
+		conversion = service.Conversion(caBundle)
+	}
+
 	if installCRD {
-		err = crd.Create(ctx, cfg)
+		err = crd.Create(ctx, cfg, conversion)
 		if err != nil {
 			logrus.Fatalf("error installing crd: %s", err.Error())
 		}
+
+		if conversion != nil {
+			if err = crd.MigrateStorage(ctx, cfg, licensingFactory.Licensing().V1().Entitlement()); err != nil {
+				logrus.Fatalf("error migrating entitlement storage: %s", err.Error())
+			}
+		}
 	}
 
-	controllers.RegisterSecretHandler(ctx,
+	if webhookAddress != "" {
+		if err = webhook.EnsureValidatingWebhooks(ctx, kube, service, caBundle); err != nil {
+			logrus.Fatalf("error registering validating webhooks: %s", err.Error())
+		}
+
+		if err = webhook.EnsureMutatingWebhooks(ctx, kube, service, caBundle); err != nil {
+			logrus.Fatalf("error registering mutating webhooks: %s", err.Error())
+		}
+	}
+
+	enabledSources, err := controllers.ParseSources(licenseSources)
+	if err != nil {
+		logrus.Fatalf("error parsing license sources: %s", err.Error())
+	}
+
+	var sources []controllers.LicenseSource
+	var configMapCache wranglerCorev1.ConfigMapCache
+	for _, s := range enabledSources {
+		switch s {
+		case "secret":
+			sources = append(sources, controllers.NewSecretSource(wrangler.Core().V1().Secret()))
+		case "configmap":
+			configMapCache = wrangler.Core().V1().ConfigMap().Cache()
+			sources = append(sources, controllers.NewConfigMapSource(wrangler.Core().V1().ConfigMap()))
+		case "directory":
+			if licenseDir == "" {
+				logrus.Fatalf("--license-dir is required for the directory source")
+			}
+			sources = append(sources, controllers.NewDirectorySource(licenseDir, sourceNamespace, licenseDirResync))
+		case "http":
+			if licenseURL == "" {
+				logrus.Fatalf("--license-url is required for the http source")
+			}
+			sources = append(sources, controllers.NewHTTPSource(licenseURL, sourceNamespace, licenseURLInterval))
+		}
+	}
+
+	allocator := controllers.NewAllocator(licensingFactory.Licensing().V1().Entitlement())
+
+	projector := controllers.NewProjector(
+		allocator,
 		licensingFactory.Licensing().V1().Entitlement(),
-		licensingFactory.Licensing().V1().Request(),
-		wrangler.Core().V1().Secret())
+		licensingFactory.Licensing().V1().Request())
 
+	for _, s := range sources {
+		s.Register(ctx, projector)
+	}
+
+	rebuilder := controllers.NewRebuilder(sources, allocator, licensingFactory.Licensing().V1().Request())
 
 	controllers.Register(
 		ctx,
+		allocator,
+		rebuilder,
 		licensingFactory.Licensing().V1().Entitlement(),
 		licensingFactory.Licensing().V1().Request(),
+		licensingFactory.Licensing().V1().EntitlementBinding(),
+		licensingFactory.Licensing().V1().LicenseQuota(),
 		wrangler.Core().V1().Secret(),
+		configMapCache,
+		wrangler.Core().V1().Namespace(),
+		wrangler.Core().V1().Pod(),
+		wrangler.Core().V1().Node().Cache(),
+		apps.Apps().V1().Deployment(),
+		apps.Apps().V1().StatefulSet(),
+		recorder,
 		)
 
+	sweeper := controllers.NewSweeper(
+		allocator,
+		licensingFactory.Licensing().V1().Entitlement(),
+		licensingFactory.Licensing().V1().Request(),
+		wrangler.Core().V1().Secret().Cache(),
+		configMapCache,
+		recorder,
+		sweepInterval)
 
-	if err := start.All(ctx, 2, licensingFactory, wrangler); err != nil {
+	meter := controllers.NewMeter(
+		allocator,
+		licensingFactory.Licensing().V1().Entitlement(),
+		kube,
+		recorder,
+		measureInterval)
+
+	if err := start.All(ctx, 2, licensingFactory, wrangler, apps); err != nil {
 		logrus.Fatalf("error starting: %s", err.Error())
 	}
 
+	if server != nil {
+		// conversion is served from the start, admission waits for the caches
+		server.Synced()
+	}
+
+	for _, s := range sources {
+		s.Start(ctx)
+	}
+
+	sweeper.Start(ctx)
+	meter.Start(ctx)
+
+	if metricsAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			if err := http.ListenAndServe(metricsAddress, mux); err != nil {
+				logrus.Errorf("error serving metrics: %s", err.Error())
+			}
+		}()
+	}
+
 	<-ctx.Done()
 }
\ No newline at end of file
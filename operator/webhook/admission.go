@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+)
+
+// AdmitFunc decides on an admission request. A nil error admits the object, with any warnings
+// shown to the user; an error denies it, with the error as the reason.
+type AdmitFunc func(request *admissionv1.AdmissionRequest) (warnings []string, err error)
+
+// MutateFunc is an AdmitFunc that may also change the object, by returning a JSON patch to apply to it.
+type MutateFunc func(request *admissionv1.AdmissionRequest) (patch []byte, warnings []string, err error)
+
+// AdmissionHandler serves admission reviews, deciding on them with an AdmitFunc or MutateFunc.
+type AdmissionHandler struct {
+	mutate MutateFunc
+}
+
+func NewAdmissionHandler(admit AdmitFunc) *AdmissionHandler {
+	return &AdmissionHandler{
+		mutate: func(request *admissionv1.AdmissionRequest) ([]byte, []string, error) {
+			warnings, err := admit(request)
+			return nil, warnings, err
+		},
+	}
+}
+
+func NewMutatingHandler(mutate MutateFunc) *AdmissionHandler {
+	return &AdmissionHandler{mutate: mutate}
+}
+
+func (h *AdmissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	review := &admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(review); err != nil || review.Request == nil {
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionv1.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+
+	patch, warnings, err := h.mutate(review.Request)
+	response.Warnings = warnings
+	if err == nil && patch != nil {
+		patchType := admissionv1.PatchTypeJSONPatch
+		response.Patch = patch
+		response.PatchType = &patchType
+	}
+	if err != nil {
+		logrus.Infof("denied %s of %s %s/%s: %s", review.Request.Operation, review.Request.Kind.Kind,
+			review.Request.Namespace, review.Request.Name, err.Error())
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		}
+	}
+
+	review.Request = nil
+	review.Response = response
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		logrus.Errorf("error writing admission review: %s", err.Error())
+	}
+}
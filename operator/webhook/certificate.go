@@ -0,0 +1,140 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/ebauman/klicense/cert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"math/big"
+	"time"
+)
+
+const (
+	certificateValidity = 10 * 365 * 24 * time.Hour
+	// a certificate this close to expiring is replaced
+	certificateRenewal = 30 * 24 * time.Hour
+)
+
+// Certificate is the serving certificate of the webhook server, and the CA bundle the api server
+// verifies it with.
+type Certificate struct {
+	TLS      tls.Certificate
+	CABundle []byte
+}
+
+// EnsureCertificate loads the webhook serving certificate from a secret, generating a self-signed one
+// for the webhook service if the secret doesn't exist or its certificate is about to expire. Keeping it
+// in a secret means every replica, and every restart, serves the same certificate.
+func EnsureCertificate(ctx context.Context, kube clientset.Interface, namespace string, secretName string, service string) (*Certificate, error) {
+	secrets := kube.CoreV1().Secrets(namespace)
+
+	secret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		secret = nil
+	case err != nil:
+		return nil, err
+	default:
+		c, err := loadCertificate(secret)
+		if err == nil && time.Until(c.TLS.Leaf.NotAfter) > certificateRenewal {
+			return c, nil
+		}
+	}
+
+	certPem, keyPem, err := generateCertificate(namespace, service)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: namespace,
+			},
+			Type: corev1.SecretTypeTLS,
+		}
+	}
+	secret = secret.DeepCopy()
+	secret.Data = map[string][]byte{
+		corev1.TLSCertKey:       certPem,
+		corev1.TLSPrivateKeyKey: keyPem,
+	}
+
+	if secret.ResourceVersion == "" {
+		secret, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		secret, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if errors.IsAlreadyExists(err) || errors.IsConflict(err) {
+		// another replica got there first, use theirs
+		secret, err = secrets.Get(ctx, secretName, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return loadCertificate(secret)
+}
+
+func loadCertificate(secret *corev1.Secret) (*Certificate, error) {
+	certPem, keyPem := secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+
+	pair, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate from secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate from secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+
+	return &Certificate{TLS: pair, CABundle: certPem}, nil
+}
+
+// generateCertificate returns a self-signed certificate, and its key, valid for the names a service is
+// reachable at within the cluster.
+func generateCertificate(namespace string, service string) ([]byte, []byte, error) {
+	key, err := cert.Generate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := fmt.Sprintf("%s.%s.svc", service, namespace)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{service, service + "." + namespace, name, name + ".cluster.local"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return certPem, keyPem, nil
+}
@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/api/v1beta2"
+	"github.com/sirupsen/logrus"
+	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/http"
+)
+
+// ConversionPath is where the api server sends conversion reviews.
+const ConversionPath = "/convert"
+
+// ConversionHandler converts licensing objects between the versions the api server stores and serves them in.
+type ConversionHandler struct{}
+
+func (h ConversionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	review := &apiextv1.ConversionReview{}
+	if err := json.NewDecoder(r.Body).Decode(review); err != nil || review.Request == nil {
+		http.Error(w, "invalid conversion review", http.StatusBadRequest)
+		return
+	}
+
+	response := &apiextv1.ConversionResponse{
+		UID:    review.Request.UID,
+		Result: metav1.Status{Status: metav1.StatusSuccess},
+	}
+
+	for _, obj := range review.Request.Objects {
+		converted, err := convert(obj.Raw, review.Request.DesiredAPIVersion)
+		if err != nil {
+			logrus.Errorf("error converting object to %s: %s", review.Request.DesiredAPIVersion, err.Error())
+			response.ConvertedObjects = nil
+			response.Result = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+			break
+		}
+
+		response.ConvertedObjects = append(response.ConvertedObjects, runtime.RawExtension{Raw: converted})
+	}
+
+	review.Request = nil
+	review.Response = response
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		logrus.Errorf("error writing conversion review: %s", err.Error())
+	}
+}
+
+func convert(raw []byte, desired string) ([]byte, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(raw, &typeMeta); err != nil {
+		return nil, err
+	}
+
+	if typeMeta.APIVersion == desired {
+		return raw, nil
+	}
+
+	if typeMeta.Kind != "Entitlement" {
+		return nil, fmt.Errorf("can't convert %s from %s to %s", typeMeta.Kind, typeMeta.APIVersion, desired)
+	}
+
+	switch {
+	case typeMeta.APIVersion == v1.SchemeGroupVersion.String() && desired == v1beta2.SchemeGroupVersion.String():
+		in := &v1.Entitlement{}
+		if err := json.Unmarshal(raw, in); err != nil {
+			return nil, err
+		}
+		return json.Marshal(convertFromV1(in))
+	case typeMeta.APIVersion == v1beta2.SchemeGroupVersion.String() && desired == v1.SchemeGroupVersion.String():
+		in := &v1beta2.Entitlement{}
+		if err := json.Unmarshal(raw, in); err != nil {
+			return nil, err
+		}
+		return json.Marshal(convertToV1(in))
+	}
+
+	return nil, fmt.Errorf("can't convert %s from %s to %s", typeMeta.Kind, typeMeta.APIVersion, desired)
+}
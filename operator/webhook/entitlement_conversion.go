@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	v1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/api/v1beta2"
+	"github.com/ebauman/klicense/operator/controllers"
+)
+
+// The conversions live here rather than with the types, as the types are loaded by code generation
+// before anything is generated for them.
+
+// convertFromV1 splits the grants of a v1 entitlement into what its licenses grant, which goes in the
+// spec, and how much of each grant is allocated, which stays in the status. Grants still allocated whole
+// to a request are recorded as its allocation first, as v1beta2 has nowhere else to keep that.
+func convertFromV1(in *v1.Entitlement) *v1beta2.Entitlement {
+	in = in.DeepCopy()
+	controllers.MigrateGrantRequests(in)
+
+	out := &v1beta2.Entitlement{
+		TypeMeta:   in.TypeMeta,
+		ObjectMeta: *in.ObjectMeta.DeepCopy(),
+	}
+	out.APIVersion = v1beta2.SchemeGroupVersion.String()
+
+	status := in.Status.DeepCopy()
+	out.Status = v1beta2.EntitlementStatus{
+		Allocations:        status.Allocations,
+		Usage:              status.Usage,
+		Used:               status.Used,
+		Available:          status.Available,
+		Queue:              status.Queue,
+		Waiting:            status.Waiting,
+		Licenses:           status.Licenses,
+		Units:              status.Units,
+		EarliestExpiration: status.EarliestExpiration,
+		Measured:           status.Measured,
+		Overage:            status.Overage,
+		ObservedGeneration: status.ObservedGeneration,
+		Conditions:         status.Conditions,
+	}
+
+	if status.Grants != nil {
+		out.Spec.Grants = map[string]v1beta2.LicensedGrant{}
+		out.Status.Grants = map[string]v1beta2.GrantAllocation{}
+	}
+	for id, g := range status.Grants {
+		out.Spec.Grants[id] = v1beta2.LicensedGrant{
+			Id:            g.Id,
+			Amount:        g.Amount,
+			Unit:          g.Unit,
+			NotBefore:     g.NotBefore,
+			NotAfter:      g.NotAfter,
+			LicenseSecret: g.LicenseSecret,
+			Source:        g.Source,
+			License:       g.License,
+			OveragePolicy: g.OveragePolicy,
+			Constraints:   g.Constraints,
+		}
+		out.Status.Grants[id] = v1beta2.GrantAllocation{
+			Status:    g.Status,
+			Allocated: g.Allocated,
+			Available: g.Available,
+			Overage:   g.Overage,
+		}
+	}
+
+	return out
+}
+
+// convertToV1 joins the grants in the spec of an entitlement with their allocation in its status.
+// A grant only in the spec has nothing allocated yet; an allocation whose grant isn't in the spec
+// is dropped, as there is nothing left to allocate from.
+func convertToV1(in *v1beta2.Entitlement) *v1.Entitlement {
+	out := &v1.Entitlement{
+		TypeMeta:   in.TypeMeta,
+		ObjectMeta: *in.ObjectMeta.DeepCopy(),
+	}
+	out.APIVersion = v1.SchemeGroupVersion.String()
+
+	status := in.Status.DeepCopy()
+	out.Status = v1.EntitlementStatus{
+		Allocations:        status.Allocations,
+		Usage:              status.Usage,
+		Used:               status.Used,
+		Available:          status.Available,
+		Queue:              status.Queue,
+		Waiting:            status.Waiting,
+		Licenses:           status.Licenses,
+		Units:              status.Units,
+		EarliestExpiration: status.EarliestExpiration,
+		Measured:           status.Measured,
+		Overage:            status.Overage,
+		ObservedGeneration: status.ObservedGeneration,
+		Conditions:         status.Conditions,
+	}
+
+	if in.Spec.Grants != nil {
+		out.Status.Grants = map[string]v1.Grant{}
+	}
+	for id, g := range in.Spec.Grants {
+		grant := v1.Grant{
+			Id:            g.Id,
+			Amount:        g.Amount,
+			Unit:          g.Unit,
+			NotBefore:     g.NotBefore,
+			NotAfter:      g.NotAfter,
+			LicenseSecret: g.LicenseSecret,
+			Source:        g.Source,
+			License:       g.License,
+			OveragePolicy: g.OveragePolicy,
+			Constraints:   g.Constraints,
+			Status:        v1.GrantStatusFree,
+			Available:     g.Amount,
+		}
+
+		if a, ok := status.Grants[id]; ok {
+			grant.Status = a.Status
+			grant.Allocated = a.Allocated
+			grant.Available = a.Available
+			grant.Overage = a.Overage
+		}
+
+		out.Status.Grants[id] = grant
+	}
+
+	return out
+}
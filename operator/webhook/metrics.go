@@ -0,0 +1,17 @@
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scaleDeniedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "klicense",
+		Name:      "scale_denied_total",
+		Help:      "Number of times scaling a workload licensed by its replicas was denied for lack of capacity.",
+	}, []string{"namespace", "entitlement", "unit"})
+)
+
+func init() {
+	prometheus.MustRegister(scaleDeniedTotal)
+}
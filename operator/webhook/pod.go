@@ -0,0 +1,325 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/operator/controllers"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"strings"
+	"time"
+)
+
+// LicensedLabel marks pods that are only admitted once licensed. It is added to pods with the workload
+// annotations, and can be put on a pod template directly so the pod is checked even if the annotations
+// couldn't be looked up on its controller. Pods created with it are not admitted while the operator is down,
+// so licensed workloads should put it on their pod templates.
+const LicensedLabel = "licensing.cattle.io/licensed"
+
+// Paths the api server sends pods to.
+const (
+	PodMutationPath   = "/mutate/pods"
+	PodValidationPath = "/validate/pods"
+)
+
+var workloadAnnotations = []string{
+	controllers.WorkloadKindAnnotation,
+	controllers.WorkloadUnitAnnotation,
+	controllers.WorkloadAmountAnnotation,
+	controllers.WorkloadPriorityAnnotation,
+}
+
+// PodAdmissionTimeout is how long a pod's admission waits for its request to be offered capacity before
+// the pod is denied. The operator overrides this from its --pod-admission-timeout flag.
+var PodAdmissionTimeout = 10 * time.Second
+
+// PodMutator copies the workload annotations from the controllers of a pod onto the pod, and labels it
+// with LicensedLabel, so that it is checked by the PodValidator.
+type PodMutator struct {
+	kube clientset.Interface
+}
+
+func NewPodMutator(kube clientset.Interface) *PodMutator {
+	return &PodMutator{kube: kube}
+}
+
+func (m *PodMutator) Mutate(ar *admissionv1.AdmissionRequest) ([]byte, []string, error) {
+	if ar.Operation != admissionv1.Create {
+		return nil, nil, nil
+	}
+
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(ar.Object.Raw, pod); err != nil {
+		return nil, nil, fmt.Errorf("error decoding pod: %v", err)
+	}
+
+	annotations := pod.Annotations
+	if _, ok := annotations[controllers.WorkloadKindAnnotation]; !ok {
+		var err error
+		annotations, err = m.controllerAnnotations(ar.Namespace, metav1.GetControllerOf(pod))
+		if err != nil {
+			// the pod is still checked if its template is labeled
+			return nil, []string{fmt.Sprintf("could not look up license annotations: %s", err.Error())}, nil
+		}
+	}
+
+	if _, ok := annotations[controllers.WorkloadKindAnnotation]; !ok {
+		return nil, nil, nil
+	}
+
+	var patch []map[string]interface{}
+	if pod.Annotations == nil {
+		patch = append(patch, map[string]interface{}{"op": "add", "path": "/metadata/annotations", "value": map[string]string{}})
+	}
+	for _, key := range workloadAnnotations {
+		if value, ok := annotations[key]; ok && pod.Annotations[key] != value {
+			patch = append(patch, map[string]interface{}{"op": "add", "path": "/metadata/annotations/" + escape(key), "value": value})
+		}
+	}
+
+	if pod.Labels == nil {
+		patch = append(patch, map[string]interface{}{"op": "add", "path": "/metadata/labels", "value": map[string]string{}})
+	}
+	if pod.Labels[LicensedLabel] != "true" {
+		patch = append(patch, map[string]interface{}{"op": "add", "path": "/metadata/labels/" + escape(LicensedLabel), "value": "true"})
+	}
+
+	if len(patch) == 0 {
+		return nil, nil, nil
+	}
+
+	data, err := json.Marshal(patch)
+	return data, nil, err
+}
+
+// controllerAnnotations walks up the controllers of a pod, returning the annotations of the first one
+// that has the workload annotations, or nil if none has.
+func (m *PodMutator) controllerAnnotations(namespace string, controller *metav1.OwnerReference) (map[string]string, error) {
+	ctx := context.Background()
+	for controller != nil {
+		var meta metav1.Object
+		var err error
+		switch controller.Kind {
+		case "ReplicaSet":
+			meta, err = m.kube.AppsV1().ReplicaSets(namespace).Get(ctx, controller.Name, metav1.GetOptions{})
+		case "Deployment":
+			meta, err = m.kube.AppsV1().Deployments(namespace).Get(ctx, controller.Name, metav1.GetOptions{})
+		case "StatefulSet":
+			meta, err = m.kube.AppsV1().StatefulSets(namespace).Get(ctx, controller.Name, metav1.GetOptions{})
+		case "DaemonSet":
+			meta, err = m.kube.AppsV1().DaemonSets(namespace).Get(ctx, controller.Name, metav1.GetOptions{})
+		case "Job":
+			meta, err = m.kube.BatchV1().Jobs(namespace).Get(ctx, controller.Name, metav1.GetOptions{})
+		case "CronJob":
+			meta, err = m.kube.BatchV1().CronJobs(namespace).Get(ctx, controller.Name, metav1.GetOptions{})
+		default:
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := meta.GetAnnotations()[controllers.WorkloadKindAnnotation]; ok {
+			if meta.GetAnnotations()[controllers.WorkloadEnforceAnnotation] == controllers.EnforceReplicas {
+				// the workload is licensed by its replicas, not its pods
+				return nil, nil
+			}
+			return meta.GetAnnotations(), nil
+		}
+
+		var next *metav1.OwnerReference
+		for _, ref := range meta.GetOwnerReferences() {
+			if ref.Controller != nil && *ref.Controller {
+				next = ref.DeepCopy()
+				break
+			}
+		}
+		controller = next
+	}
+
+	return nil, nil
+}
+
+// escape escapes a key for use in a JSON patch path.
+func escape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// PodValidator admits licensed pods only once they hold a license. A request named after the pod, see
+// controllers.PodRequestName, is made on its behalf and acknowledged as soon as it is offered; a pod whose
+// request isn't offered capacity within PodAdmissionTimeout is denied, and admitted when it is retried
+// once capacity is free. The operator has the request owned by the pod once it exists, so deleting the pod
+// releases it.
+type PodValidator struct {
+	requestClient v1.RequestClient
+}
+
+func NewPodValidator(requestClient v1.RequestClient) *PodValidator {
+	return &PodValidator{requestClient: requestClient}
+}
+
+func (v *PodValidator) Admit(ar *admissionv1.AdmissionRequest) ([]string, error) {
+	if ar.Operation != admissionv1.Create {
+		return nil, nil
+	}
+
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(ar.Object.Raw, pod); err != nil {
+		return nil, fmt.Errorf("error decoding pod: %v", err)
+	}
+	pod.Namespace = ar.Namespace
+
+	spec, err := controllers.WorkloadSpec(pod.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	if ar.DryRun != nil && *ar.DryRun {
+		return []string{"pod license is not checked in a dry run"}, nil
+	}
+
+	request, err := v.ensureRequest(pod, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = v.discover(request); err != nil {
+		return nil, fmt.Errorf("error licensing pod: %v", err)
+	}
+
+	var waiting *licensingv1.Request
+	err = wait.PollImmediate(250*time.Millisecond, PodAdmissionTimeout, func() (bool, error) {
+		latest, err := v.requestClient.Get(request.Namespace, request.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		waiting = latest
+
+		switch latest.Status.Status {
+		case licensingv1.UsageRequestStatusAcknowledged:
+			return true, nil
+		case licensingv1.UsageRequestStatusOffer:
+			return true, v.acknowledge(latest)
+		}
+
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		message := fmt.Sprintf("waiting for %d %s of %s", spec.Amount, spec.Unit, spec.Kind)
+		if waiting.Status.QueuePosition > 0 {
+			message += fmt.Sprintf(", at position %d in the queue", waiting.Status.QueuePosition)
+		}
+		if waiting.Status.Message != "" {
+			message += ": " + waiting.Status.Message
+		}
+		return nil, fmt.Errorf("pod is not licensed: %s", message)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error licensing pod: %v", err)
+	}
+
+	return nil, nil
+}
+
+// ensureRequest returns the request for a pod, making it if it doesn't exist. It is named apart from the
+// pod, which may make a request of its own name with the client library. A request left by an earlier
+// pod of the same name is taken over, so a replaced pod keeps the capacity of the one it replaces.
+func (v *PodValidator) ensureRequest(pod *corev1.Pod, spec licensingv1.RequestSpec) (*licensingv1.Request, error) {
+	uid := string(pod.UID)
+	name := controllers.PodRequestName(pod.Name)
+
+	existing, err := v.requestClient.Get(pod.Namespace, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		request, err := v.requestClient.Create(&licensingv1.Request{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   pod.Namespace,
+				Annotations: map[string]string{controllers.PodUIDAnnotation: uid},
+			},
+			Spec: spec,
+		})
+		return request, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := existing.Annotations[controllers.PodUIDAnnotation]; !ok {
+		return nil, fmt.Errorf("request %s/%s exists and wasn't made for a pod", pod.Namespace, name)
+	}
+
+	if existing.Spec.Kind != spec.Kind || existing.Spec.Unit != spec.Unit {
+		// kind and unit can't change, the request has to go first
+		_ = v.requestClient.Delete(existing.Namespace, existing.Name, &metav1.DeleteOptions{})
+		return nil, fmt.Errorf("request %s/%s of an earlier pod is for a different license and is being deleted, retry",
+			pod.Namespace, name)
+	}
+
+	if existing.Annotations[controllers.PodUIDAnnotation] == uid && existing.Spec == spec {
+		return existing, nil
+	}
+
+	var request *licensingv1.Request
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := v.requestClient.Get(existing.Namespace, existing.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		latest = latest.DeepCopy()
+		latest.Annotations[controllers.PodUIDAnnotation] = uid
+		// the earlier pod no longer owns it, the operator has the new one own it once it exists
+		latest.OwnerReferences = nil
+		latest.Spec = spec
+		request, err = v.requestClient.Update(latest)
+		return err
+	})
+
+	return request, err
+}
+
+// discover has the operator look for capacity for a request that isn't looking or holding any, e.g.
+// because it was only just made, or because its offer expired while its pod was denied.
+func (v *PodValidator) discover(request *licensingv1.Request) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := v.requestClient.Get(request.Namespace, request.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if latest.Status.Status != "" && latest.Status.Status != licensingv1.UsageRequestStatusExpired {
+			return nil
+		}
+
+		latest = latest.DeepCopy()
+		latest.Status.Status = licensingv1.UsageRequestStatusDiscover
+		_, err = v.requestClient.UpdateStatus(latest)
+		return err
+	})
+}
+
+func (v *PodValidator) acknowledge(request *licensingv1.Request) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := v.requestClient.Get(request.Namespace, request.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if latest.Status.Status != licensingv1.UsageRequestStatusOffer {
+			return nil
+		}
+
+		latest = latest.DeepCopy()
+		latest.Status.Status = licensingv1.UsageRequestStatusAcknowledged
+		_, err = v.requestClient.UpdateStatus(latest)
+		return err
+	})
+}
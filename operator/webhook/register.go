@@ -0,0 +1,245 @@
+package webhook
+
+import (
+	"context"
+	"github.com/ebauman/klicense/api"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// WebhookName is the name of the operator's ValidatingWebhookConfiguration and MutatingWebhookConfiguration.
+const WebhookName = "klicense-operator"
+
+// the api server gives up on a webhook after at most 30 seconds
+const maxWebhookTimeout = 30
+
+// leave the control plane alone
+var notKubeSystem = &metav1.LabelSelector{
+	MatchExpressions: []metav1.LabelSelectorRequirement{{
+		Key:      "kubernetes.io/metadata.name",
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   []string{"kube-system"},
+	}},
+}
+
+// EnsureValidatingWebhooks creates or updates the configuration that has the api server send Requests,
+// Secrets, licensed Pods, and Deployments and StatefulSets being scaled to the operator for validation.
+// Requests, Secrets and workloads fail open, so that an operator that is down doesn't block writes; the
+// operator still checks everything it reads, and licenses what workloads are scaled to, reporting a
+// workload it can't license with a ReplicasUnlicensed event. Licensed pods fail closed, as admitting them
+// is what licenses them.
+func EnsureValidatingWebhooks(ctx context.Context, kube clientset.Interface, service Service, caBundle []byte) error {
+	ignore := admissionregistrationv1.Ignore
+	fail := admissionregistrationv1.Fail
+	none := admissionregistrationv1.SideEffectClassNone
+	noneOnDryRun := admissionregistrationv1.SideEffectClassNoneOnDryRun
+	equivalent := admissionregistrationv1.Equivalent
+	namespaced := admissionregistrationv1.NamespacedScope
+	timeout := int32(5)
+	podTimeout := int32(PodAdmissionTimeout.Seconds()) + timeout
+	if podTimeout > maxWebhookTimeout {
+		podTimeout = maxWebhookTimeout
+	}
+	operations := []admissionregistrationv1.OperationType{
+		admissionregistrationv1.Create,
+		admissionregistrationv1.Update,
+	}
+
+	config := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: WebhookName,
+		},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{
+				Name:         "requests." + api.GroupName,
+				ClientConfig: service.admissionClientConfig(RequestValidationPath, caBundle),
+				Rules: []admissionregistrationv1.RuleWithOperations{{
+					Operations: operations,
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{api.GroupName},
+						APIVersions: []string{"*"},
+						Resources:   []string{"requests"},
+						Scope:       &namespaced,
+					},
+				}},
+				FailurePolicy:           &ignore,
+				MatchPolicy:             &equivalent,
+				SideEffects:             &none,
+				TimeoutSeconds:          &timeout,
+				AdmissionReviewVersions: []string{"v1"},
+			},
+			{
+				Name:         "secrets." + api.GroupName,
+				ClientConfig: service.admissionClientConfig(SecretValidationPath, caBundle),
+				Rules: []admissionregistrationv1.RuleWithOperations{{
+					Operations: operations,
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"secrets"},
+						Scope:       &namespaced,
+					},
+				}},
+				NamespaceSelector:       notKubeSystem,
+				FailurePolicy:           &ignore,
+				MatchPolicy:             &equivalent,
+				SideEffects:             &none,
+				TimeoutSeconds:          &timeout,
+				AdmissionReviewVersions: []string{"v1"},
+			},
+			{
+				Name:         "pods." + api.GroupName,
+				ClientConfig: service.admissionClientConfig(PodValidationPath, caBundle),
+				Rules: []admissionregistrationv1.RuleWithOperations{{
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"pods"},
+						Scope:       &namespaced,
+					},
+				}},
+				ObjectSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{LicensedLabel: "true"},
+				},
+				NamespaceSelector: notKubeSystem,
+				FailurePolicy:     &fail,
+				MatchPolicy:       &equivalent,
+				// a request is made for the pod
+				SideEffects:             &noneOnDryRun,
+				TimeoutSeconds:          &podTimeout,
+				AdmissionReviewVersions: []string{"v1"},
+			},
+			{
+				Name:         "replicas." + api.GroupName,
+				ClientConfig: service.admissionClientConfig(ReplicaValidationPath, caBundle),
+				Rules: []admissionregistrationv1.RuleWithOperations{{
+					Operations: operations,
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{"apps"},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"deployments", "deployments/scale", "statefulsets", "statefulsets/scale"},
+						Scope:       &namespaced,
+					},
+				}},
+				NamespaceSelector: notKubeSystem,
+				FailurePolicy:     &ignore,
+				MatchPolicy:       &equivalent,
+				// denied scale-ups are recorded as events
+				SideEffects:             &noneOnDryRun,
+				TimeoutSeconds:          &timeout,
+				AdmissionReviewVersions: []string{"v1"},
+			},
+		},
+	}
+
+	configs := kube.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := configs.Get(ctx, config.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			_, err = configs.Create(ctx, config, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		existing = existing.DeepCopy()
+		existing.Webhooks = config.Webhooks
+		_, err = configs.Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// EnsureMutatingWebhooks creates or updates the configuration that has the api server send new Pods to
+// the operator, to be labeled for validation if they, or their controllers, have the workload annotations.
+// Pods already labeled with LicensedLabel, e.g. by their pod template, fail closed, so they aren't admitted
+// unlicensed while the operator is down. Other pods fail open, so that an operator that is down doesn't
+// block pods that aren't licensed; only the label on the pod template makes a workload's pods safe from that.
+func EnsureMutatingWebhooks(ctx context.Context, kube clientset.Interface, service Service, caBundle []byte) error {
+	ignore := admissionregistrationv1.Ignore
+	fail := admissionregistrationv1.Fail
+	none := admissionregistrationv1.SideEffectClassNone
+	equivalent := admissionregistrationv1.Equivalent
+	namespaced := admissionregistrationv1.NamespacedScope
+	never := admissionregistrationv1.NeverReinvocationPolicy
+	timeout := int32(5)
+
+	config := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: WebhookName,
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name:         "pods." + api.GroupName,
+				ClientConfig: service.admissionClientConfig(PodMutationPath, caBundle),
+				Rules: []admissionregistrationv1.RuleWithOperations{{
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"pods"},
+						Scope:       &namespaced,
+					},
+				}},
+				ObjectSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{{
+						Key:      LicensedLabel,
+						Operator: metav1.LabelSelectorOpNotIn,
+						Values:   []string{"true"},
+					}},
+				},
+				NamespaceSelector:       notKubeSystem,
+				FailurePolicy:           &ignore,
+				MatchPolicy:             &equivalent,
+				SideEffects:             &none,
+				TimeoutSeconds:          &timeout,
+				ReinvocationPolicy:      &never,
+				AdmissionReviewVersions: []string{"v1"},
+			},
+			{
+				Name:         "licensed-pods." + api.GroupName,
+				ClientConfig: service.admissionClientConfig(PodMutationPath, caBundle),
+				Rules: []admissionregistrationv1.RuleWithOperations{{
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"pods"},
+						Scope:       &namespaced,
+					},
+				}},
+				ObjectSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{LicensedLabel: "true"},
+				},
+				NamespaceSelector:       notKubeSystem,
+				FailurePolicy:           &fail,
+				MatchPolicy:             &equivalent,
+				SideEffects:             &none,
+				TimeoutSeconds:          &timeout,
+				ReinvocationPolicy:      &never,
+				AdmissionReviewVersions: []string{"v1"},
+			},
+		},
+	}
+
+	configs := kube.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := configs.Get(ctx, config.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			_, err = configs.Create(ctx, config, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		existing = existing.DeepCopy()
+		existing.Webhooks = config.Webhooks
+		_, err = configs.Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	})
+}
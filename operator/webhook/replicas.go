@@ -0,0 +1,291 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/kubernetes"
+	"github.com/ebauman/klicense/operator/controllers"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// ReplicaValidationPath is where the api server sends Deployments, StatefulSets and their scale
+// subresources to be validated.
+const ReplicaValidationPath = "/validate/replicas"
+
+// workload is a Deployment or StatefulSet.
+type workload interface {
+	metav1.Object
+	runtime.Object
+}
+
+// ReplicaValidator denies scaling up Deployments and StatefulSets licensed by their replicas beyond what
+// they can be licensed for: what their request already holds, plus what is still available of their
+// unit, including what the overage policy still allows, and no more than the LicenseQuotas of their
+// namespace allow. Scaling down, and workloads licensed by their pods, are always admitted. A denied
+// scale-up is reported with a ScaleDenied event on the workload and in the klicense_scale_denied_total metric.
+type ReplicaValidator struct {
+	kube              clientset.Interface
+	entitlementClient v1.EntitlementClient
+	requestClient     v1.RequestClient
+	resolver          *controllers.EntitlementResolver
+	quotas            *controllers.QuotaChecker
+	recorder          record.EventRecorder
+}
+
+func NewReplicaValidator(
+	kube clientset.Interface,
+	entitlementClient v1.EntitlementClient,
+	requestClient v1.RequestClient,
+	resolver *controllers.EntitlementResolver,
+	quotas *controllers.QuotaChecker,
+	recorder record.EventRecorder) *ReplicaValidator {
+	return &ReplicaValidator{
+		kube:              kube,
+		entitlementClient: entitlementClient,
+		requestClient:     requestClient,
+		resolver:          resolver,
+		quotas:            quotas,
+		recorder:          recorder,
+	}
+}
+
+func (v *ReplicaValidator) Admit(ar *admissionv1.AdmissionRequest) ([]string, error) {
+	if ar.Operation != admissionv1.Create && ar.Operation != admissionv1.Update {
+		return nil, nil
+	}
+
+	var kind string
+	switch ar.Resource.Resource {
+	case "deployments":
+		kind = "Deployment"
+	case "statefulsets":
+		kind = "StatefulSet"
+	default:
+		return nil, nil
+	}
+
+	var current, old workload
+	var replicas, oldReplicas int32
+	switch ar.SubResource {
+	case "scale":
+		scale, oldScale := &autoscalingv1.Scale{}, &autoscalingv1.Scale{}
+		if err := json.Unmarshal(ar.Object.Raw, scale); err != nil {
+			return nil, fmt.Errorf("error decoding scale: %v", err)
+		}
+		if err := json.Unmarshal(ar.OldObject.Raw, oldScale); err != nil {
+			return nil, fmt.Errorf("error decoding scale: %v", err)
+		}
+		if scale.Spec.Replicas <= oldScale.Spec.Replicas {
+			return nil, nil
+		}
+
+		var err error
+		current, err = v.get(kind, ar.Namespace, ar.Name)
+		if err != nil {
+			// the operator still licenses what the workload is scaled to
+			return []string{fmt.Sprintf("could not check license of %s %s: %s", kind, ar.Name, err.Error())}, nil
+		}
+		old = current
+		replicas, oldReplicas = scale.Spec.Replicas, oldScale.Spec.Replicas
+	case "":
+		var err error
+		current, replicas, err = decodeWorkload(kind, ar.Object.Raw)
+		if err != nil {
+			return nil, err
+		}
+		if ar.Operation == admissionv1.Update {
+			old, oldReplicas, err = decodeWorkload(kind, ar.OldObject.Raw)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, nil
+	}
+	current.SetNamespace(ar.Namespace)
+
+	if !enforcesReplicas(current) || !current.GetDeletionTimestamp().IsZero() {
+		return nil, nil
+	}
+
+	spec, err := controllers.WorkloadSpec(current.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+
+	needed := int(replicas) * spec.Amount
+	if needed == 0 {
+		return nil, nil
+	}
+
+	// only more of the same license is checked, what the workload already had was admitted before
+	if old != nil && enforcesReplicas(old) {
+		previous, err := controllers.WorkloadSpec(old.GetAnnotations())
+		if err == nil && previous.Kind == spec.Kind && previous.Unit == spec.Unit && int(oldReplicas)*previous.Amount >= needed {
+			return nil, nil
+		}
+	}
+
+	held, err := v.held(current, kind, spec)
+	if err != nil {
+		return []string{fmt.Sprintf("could not check license of %s %s: %s", kind, current.GetName(), err.Error())}, nil
+	}
+
+	namespace, err := v.resolver.Resolve(current.GetNamespace(), spec.Kind)
+	if err != nil {
+		return []string{fmt.Sprintf("could not check entitlement %q: %s", spec.Kind, err.Error())}, nil
+	}
+
+	available := held
+	entitlement, err := v.entitlementClient.Get(namespace, spec.Kind, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+	case err != nil:
+		return []string{fmt.Sprintf("could not check entitlement %q: %s", spec.Kind, err.Error())}, nil
+	default:
+		// requests queued ahead are served first, what they wait for isn't available to the workload
+		usage := entitlement.Status.Usage[spec.Unit]
+		request := kubernetes.NamespacedName{
+			Namespace: current.GetNamespace(),
+			Name:      controllers.ReplicaRequestName(kind, current.GetName()),
+		}
+		if free := usage.Available + usage.OverageAvailable - queuedAhead(entitlement, request, spec); free > 0 {
+			available += free
+		}
+	}
+
+	var message string
+	if needed > available {
+		message = fmt.Sprintf("%d replicas need %d %s of %s, only %d are available to it",
+			replicas, needed, spec.Unit, spec.Kind, available)
+	} else if err == nil {
+		// the request for the replicas is checked against the quotas of its namespace the same way the
+		// operator checks it, as if it asked for all the replicas need
+		request := &licensingv1.Request{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: current.GetNamespace(),
+				Name:      controllers.ReplicaRequestName(kind, current.GetName()),
+			},
+			Spec: spec,
+		}
+		request.Spec.Amount = needed
+
+		quota, err := v.quotas.Exceeded(entitlement, request)
+		if err != nil {
+			return []string{fmt.Sprintf("could not check quotas of %s %s: %s", kind, current.GetName(), err.Error())}, nil
+		}
+		message = quota
+	}
+
+	if message == "" {
+		return nil, nil
+	}
+
+	if ar.DryRun == nil || !*ar.DryRun {
+		v.recorder.Event(current, corev1.EventTypeWarning, licensingv1.ReasonScaleDenied, "scale-up denied: "+message)
+		scaleDeniedTotal.WithLabelValues(current.GetNamespace(), spec.Kind, spec.Unit).Inc()
+	}
+
+	return nil, fmt.Errorf("%s %s is not licensed to scale: %s", kind, current.GetName(), message)
+}
+
+// queuedAhead returns how much requests queued ahead of the request for a workload's replicas wait for.
+// If it isn't queued yet, it would join behind every request of the same or higher priority. Requests
+// asking for more than is licensed are passed over, and don't count.
+func queuedAhead(entitlement *licensingv1.Entitlement, request kubernetes.NamespacedName, spec licensingv1.RequestSpec) int {
+	ahead := 0
+	for _, q := range entitlement.Status.Queue {
+		if q.Request == request {
+			break
+		}
+
+		if q.Unit != spec.Unit || q.Priority < spec.Priority || q.Amount > entitlement.Status.Usage[q.Unit].Amount {
+			continue
+		}
+
+		ahead += q.Amount
+	}
+
+	return ahead
+}
+
+// held returns how much the request for a workload's replicas has been offered or holds.
+func (v *ReplicaValidator) held(w workload, kind string, spec licensingv1.RequestSpec) (int, error) {
+	request, err := v.requestClient.Get(w.GetNamespace(), controllers.ReplicaRequestName(kind, w.GetName()), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if request.Annotations[controllers.ReplicaWorkloadAnnotation] != kind+"/"+w.GetName() ||
+		request.Spec.Kind != spec.Kind || request.Spec.Unit != spec.Unit {
+		return 0, nil
+	}
+
+	if request.Status.Status != licensingv1.UsageRequestStatusOffer &&
+		request.Status.Status != licensingv1.UsageRequestStatusAcknowledged {
+		return 0, nil
+	}
+
+	// a request that was scaled up may still be waiting for the difference, it holds what it was allocated
+	if len(request.Status.Allocations) == 0 {
+		return request.Spec.Amount, nil
+	}
+
+	held := 0
+	for _, a := range request.Status.Allocations {
+		held += a.Amount
+	}
+
+	return held, nil
+}
+
+func (v *ReplicaValidator) get(kind string, namespace string, name string) (workload, error) {
+	ctx := context.Background()
+	if kind == "StatefulSet" {
+		return v.kube.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+
+	return v.kube.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func decodeWorkload(kind string, raw []byte) (workload, int32, error) {
+	var w workload
+	var replicas *int32
+	if kind == "StatefulSet" {
+		statefulSet := &appsv1.StatefulSet{}
+		if err := json.Unmarshal(raw, statefulSet); err != nil {
+			return nil, 0, fmt.Errorf("error decoding statefulset: %v", err)
+		}
+		w, replicas = statefulSet, statefulSet.Spec.Replicas
+	} else {
+		deployment := &appsv1.Deployment{}
+		if err := json.Unmarshal(raw, deployment); err != nil {
+			return nil, 0, fmt.Errorf("error decoding deployment: %v", err)
+		}
+		w, replicas = deployment, deployment.Spec.Replicas
+	}
+
+	if replicas == nil {
+		return w, 1, nil
+	}
+
+	return w, *replicas, nil
+}
+
+func enforcesReplicas(w workload) bool {
+	return w.GetAnnotations()[controllers.WorkloadEnforceAnnotation] == controllers.EnforceReplicas
+}
@@ -0,0 +1,121 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	licensingv1 "github.com/ebauman/klicense/api/v1"
+	"github.com/ebauman/klicense/license"
+	"github.com/ebauman/klicense/operator/controllers"
+	v1 "github.com/ebauman/klicense/operator/generated/controllers/licensing.cattle.io/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RequestValidationPath is where the api server sends Requests to be validated.
+const RequestValidationPath = "/validate/requests"
+
+var entitlementName = regexp.MustCompile("^" + license.EntitlementNamePattern + "$")
+
+// RequestValidator rejects Requests that could never be served: ones for an entitlement or unit that
+// no license grants, in their namespace or one it is bound to, or for no capacity at all.
+type RequestValidator struct {
+	entitlementClient v1.EntitlementClient
+	resolver          *controllers.EntitlementResolver
+}
+
+func NewRequestValidator(entitlementClient v1.EntitlementClient, resolver *controllers.EntitlementResolver) *RequestValidator {
+	return &RequestValidator{
+		entitlementClient: entitlementClient,
+		resolver:          resolver,
+	}
+}
+
+func (v *RequestValidator) Admit(ar *admissionv1.AdmissionRequest) ([]string, error) {
+	if ar.Operation != admissionv1.Create && ar.Operation != admissionv1.Update {
+		return nil, nil
+	}
+
+	request := &licensingv1.Request{}
+	if err := json.Unmarshal(ar.Object.Raw, request); err != nil {
+		return nil, fmt.Errorf("error decoding request: %v", err)
+	}
+
+	if !request.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	if ar.Operation == admissionv1.Update {
+		old := &licensingv1.Request{}
+		if err := json.Unmarshal(ar.OldObject.Raw, old); err != nil {
+			return nil, fmt.Errorf("error decoding request: %v", err)
+		}
+
+		// the licenses may have changed since the request was made, which the operator deals with.
+		// only what is being asked for now is checked
+		if equality.Semantic.DeepEqual(old.Spec, request.Spec) {
+			return nil, nil
+		}
+	}
+
+	spec := request.Spec
+	switch {
+	case spec.Kind == "":
+		return nil, fmt.Errorf("spec.kind is required")
+	case !entitlementName.MatchString(spec.Kind):
+		return nil, fmt.Errorf("spec.kind %q is not a valid entitlement name", spec.Kind)
+	case spec.Unit == "":
+		return nil, fmt.Errorf("spec.unit is required")
+	case spec.Amount < 1:
+		return nil, fmt.Errorf("spec.amount must be at least 1, got %d", spec.Amount)
+	}
+
+	namespace, err := v.resolver.Resolve(request.Namespace, spec.Kind)
+	if err != nil {
+		return []string{fmt.Sprintf("could not check entitlement %q: %s", spec.Kind, err.Error())}, nil
+	}
+
+	entitlement, err := v.entitlementClient.Get(namespace, spec.Kind, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, fmt.Errorf("no license grants entitlement %q in namespace %s, nor is one shared with it by an EntitlementBinding",
+			spec.Kind, request.Namespace)
+	}
+	if err != nil {
+		// the operator checks again once the request is admitted
+		return []string{fmt.Sprintf("could not check entitlement %q: %s", spec.Kind, err.Error())}, nil
+	}
+
+	granted := 0
+	units := map[string]bool{}
+	for _, g := range entitlement.Status.Grants {
+		units[g.Unit] = true
+		if g.Unit == spec.Unit {
+			granted += g.Amount
+		}
+	}
+
+	if !units[spec.Unit] {
+		var licensed []string
+		for u := range units {
+			licensed = append(licensed, u)
+		}
+		sort.Strings(licensed)
+
+		if len(licensed) == 0 {
+			return nil, fmt.Errorf("no license grants entitlement %q in namespace %s", spec.Kind, namespace)
+		}
+		return nil, fmt.Errorf("no license grants unit %q of entitlement %q, licensed units are %s",
+			spec.Unit, spec.Kind, strings.Join(licensed, ", "))
+	}
+
+	if spec.Amount > granted {
+		return []string{fmt.Sprintf("requests %d %s but licenses only grant %d, it will wait until more is licensed",
+			spec.Amount, spec.Unit, granted)}, nil
+	}
+
+	return nil, nil
+}
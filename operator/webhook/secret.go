@@ -0,0 +1,71 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ebauman/klicense/license"
+	"github.com/ebauman/klicense/operator/controllers"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SecretValidationPath is where the api server sends Secrets to be validated.
+const SecretValidationPath = "/validate/secrets"
+
+// Policies for license secrets that hold no valid license.
+const (
+	PolicyWarn   = "warn"
+	PolicyReject = "reject"
+)
+
+// LicenseSecretPolicy is whether a license secret holding no valid license is admitted with a warning,
+// or rejected. The operator overrides this from its --license-secret-policy flag.
+var LicenseSecretPolicy = PolicyWarn
+
+// ValidatePolicy returns an error if policy is not a known license secret policy.
+func ValidatePolicy(policy string) error {
+	if policy != PolicyWarn && policy != PolicyReject {
+		return fmt.Errorf("unknown policy %q, must be %s or %s", policy, PolicyWarn, PolicyReject)
+	}
+
+	return nil
+}
+
+// AdmitSecret checks license secrets the same way the operator does when it reads them, so a secret
+// it would ignore is reported when it is written rather than in the operator's logs. Secrets that
+// hold licenses but aren't labeled as license secrets are admitted with a warning.
+func AdmitSecret(ar *admissionv1.AdmissionRequest) ([]string, error) {
+	if ar.Operation != admissionv1.Create && ar.Operation != admissionv1.Update {
+		return nil, nil
+	}
+
+	secret := &corev1.Secret{}
+	if err := json.Unmarshal(ar.Object.Raw, secret); err != nil {
+		return nil, fmt.Errorf("error decoding secret: %v", err)
+	}
+
+	if !secret.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	licenses, err := license.ValidateSecret(secret)
+
+	if _, ok := secret.Labels[controllers.LicensingLabel]; !ok {
+		if err == nil {
+			return []string{fmt.Sprintf("secret holds %d licenses but isn't labeled %s, the operator ignores it",
+				len(licenses), controllers.LicensingLabel)}, nil
+		}
+		return nil, nil
+	}
+
+	if err == nil {
+		return nil, nil
+	}
+
+	err = fmt.Errorf("license secret %s/%s is invalid: %v", ar.Namespace, secret.Name, err)
+	if LicenseSecretPolicy == PolicyReject {
+		return nil, err
+	}
+
+	return []string{err.Error()}, nil
+}
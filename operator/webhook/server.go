@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Server serves the operator's webhooks over TLS.
+type Server struct {
+	address string
+	cert    *Certificate
+	mux     *http.ServeMux
+	// closed once the caches admission handlers depend on have synced
+	synced chan struct{}
+}
+
+func NewServer(address string, cert *Certificate) *Server {
+	return &Server{
+		address: address,
+		cert:    cert,
+		mux:     http.NewServeMux(),
+		synced:  make(chan struct{}),
+	}
+}
+
+// Handle registers the handler for a webhook path. Handlers must be registered before Start.
+func (s *Server) Handle(path string, handler http.Handler) {
+	s.mux.Handle(path, handler)
+}
+
+// HandleAfterSync registers the handler for a webhook path that must not answer until Synced is called.
+// Requests that arrive before then wait for it, and fail with 503 if the api server gives up first, so
+// nothing is admitted or denied on the strength of a cache that hasn't been filled yet. Webhook
+// configurations outlive the operator, so the api server calls these as soon as the server is up.
+func (s *Server) HandleAfterSync(path string, handler http.Handler) {
+	s.mux.Handle(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-s.synced:
+			handler.ServeHTTP(w, r)
+		case <-r.Context().Done():
+			http.Error(w, "webhook caches not yet synced", http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+// Synced releases the handlers registered with HandleAfterSync. It must be called once.
+func (s *Server) Synced() {
+	close(s.synced)
+}
+
+// Start serves webhooks until ctx is done.
+func (s *Server) Start(ctx context.Context) {
+	server := &http.Server{
+		Addr:    s.address,
+		Handler: s.mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{s.cert.TLS},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdown)
+	}()
+
+	go func() {
+		logrus.Infof("serving webhooks on %s", s.address)
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("error serving webhooks: %s", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,44 @@
+package webhook
+
+import (
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+// Service is the service the api server reaches the webhook server through.
+type Service struct {
+	Namespace string
+	Name      string
+	Port      int32
+}
+
+// Conversion returns the webhook conversion for CRDs, served at ConversionPath.
+func (s Service) Conversion(caBundle []byte) *apiextv1.WebhookConversion {
+	path := ConversionPath
+	port := s.Port
+	return &apiextv1.WebhookConversion{
+		ClientConfig: &apiextv1.WebhookClientConfig{
+			Service: &apiextv1.ServiceReference{
+				Namespace: s.Namespace,
+				Name:      s.Name,
+				Path:      &path,
+				Port:      &port,
+			},
+			CABundle: caBundle,
+		},
+		ConversionReviewVersions: []string{"v1"},
+	}
+}
+
+func (s Service) admissionClientConfig(path string, caBundle []byte) admissionregistrationv1.WebhookClientConfig {
+	port := s.Port
+	return admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{
+			Namespace: s.Namespace,
+			Name:      s.Name,
+			Path:      &path,
+			Port:      &port,
+		},
+		CABundle: caBundle,
+	}
+}